@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"time"
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
@@ -29,7 +30,23 @@ func ConnectToDB() {
 			log.Fatal("Failed to connect to DB:", err)
 		}
 
-		if err := DB.AutoMigrate(&models.User{}, &models.Vault{}, &models.Upload{}, &models.CoverImage{}, &models.RefreshToken{}); err != nil {
+		if err := DB.AutoMigrate(&models.User{}, &models.Vault{}, &models.Upload{}, &models.CoverImage{}, &models.RefreshToken{}, &models.PendingDeletion{}, &models.TusUpload{}, &models.Blob{}, &models.UserBlob{}, &models.Rendition{}, &models.UploadMetadata{}, &models.VaultStatusChange{}, &models.VaultRecipient{}, &models.CapsuleReminder{}, &models.VaultCycle{}, &models.VaultCycleUpload{}); err != nil {
+			log.Fatal("Auto-migration failed:", err)
+		}
+
+		// Upload keys stopped being unique once uploads started sharing blobs;
+		// the plain index that replaces it has a name of its own
+		if DB.Migrator().HasIndex(&models.Upload{}, "idx_uploads_key") {
+			if err := DB.Migrator().DropIndex(&models.Upload{}, "idx_uploads_key"); err != nil {
+				log.Fatal("Auto-migration failed:", err)
+			}
+		}
+
+		// Capsules used to stay "open" once their unlock date passed; they
+		// are "unlocked" now, and "open" is only for vaults being filled
+		if err := DB.Model(&models.Vault{}).
+			Where("status = ? AND unlock_date <= ?", "open", time.Now()).
+			Update("status", "unlocked").Error; err != nil {
 			log.Fatal("Auto-migration failed:", err)
 		}
 		
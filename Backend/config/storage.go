@@ -9,19 +9,59 @@ import (
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"photovault/storage"
 )
 
-var R2Client *s3.Client
-var R2Bucket string
+// Storage is the blob store every handler reads and writes objects through.
+var Storage storage.Store
 
-func ConnectToR2() {
+// ConnectToStorage picks the storage backend from STORAGE_BACKEND ("r2" or
+// "local"). When unset it defaults to "local" for APP_ENV=test and "r2"
+// otherwise.
+func ConnectToStorage() {
+	backend := os.Getenv("STORAGE_BACKEND")
+	if backend == "" {
+		backend = "r2"
+		if os.Getenv("APP_ENV") == "test" {
+			backend = "local"
+		}
+	}
+
+	switch backend {
+	case "local":
+		connectToLocalStorage()
+	case "r2":
+		connectToR2()
+	default:
+		log.Fatalf("❌ Unknown STORAGE_BACKEND %q (expected r2 or local)", backend)
+	}
+}
+
+func connectToLocalStorage() {
+	root := GetEnv("LOCAL_STORAGE_DIR", "uploads")
+	baseURL := GetEnv("LOCAL_STORAGE_URL", "http://localhost:8080")
+
+	secret := GetEnv("LOCAL_STORAGE_SECRET", os.Getenv("secret_token"))
+	if secret == "" {
+		// Anyone could forge presigned URLs with a well-known fallback
+		log.Fatal("❌ LOCAL_STORAGE_SECRET (or secret_token) must be set to sign local storage URLs")
+	}
+
+	store, err := storage.NewLocalStore(root, baseURL, []byte(secret))
+	if err != nil {
+		log.Fatalf("❌ failed to open local storage at %s: %v", root, err)
+	}
+	Storage = store
+	log.Println("✅ Using local storage at:", root)
+}
+
+func connectToR2() {
 	accountID := os.Getenv("accountID")
 	accessKey := os.Getenv("accessKey")
 	secretKey := os.Getenv("secretKey")
-	R2Bucket = os.Getenv("R2Bucket")
+	bucket := os.Getenv("R2Bucket")
 
-	if(os.Getenv("APP_ENV") != "test"){
-	if accountID == "" || accessKey == "" || secretKey == "" || R2Bucket == "" {
+	if accountID == "" || accessKey == "" || secretKey == "" || bucket == "" {
 		log.Fatal("❌ Missing R2 environment variables")
 	}
 
@@ -33,7 +73,7 @@ func ConnectToR2() {
 		if service == s3.ServiceID {
 			return aws.Endpoint{
 				URL:           endpoint,
-				SigningRegion: "auto", 
+				SigningRegion: "auto",
 			}, nil
 		}
 		return aws.Endpoint{}, &aws.EndpointNotFoundError{}
@@ -49,7 +89,6 @@ func ConnectToR2() {
 		log.Fatalf("❌ failed to load R2 config: %v", err)
 	}
 
-	R2Client = s3.NewFromConfig(cfg)
-	}
-	log.Println("✅ Connected to R2 bucket:", R2Bucket)
+	Storage = storage.NewR2Store(s3.NewFromConfig(cfg), bucket)
+	log.Println("✅ Connected to R2 bucket:", bucket)
 }
@@ -250,7 +250,7 @@ func LogoutHandler(w http.ResponseWriter, r *http.Request) {
 		token := cookie.Value
 
 		if dbErr := utils.InvalidateRefreshToken(token); dbErr != nil {
-			log.Println("[Logout Error] Database invalidation failed: %v\n", dbErr)
+			log.Printf("[Logout Error] Database invalidation failed: %v\n", dbErr)
 		}
 	}
 
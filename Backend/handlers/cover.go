@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"photovault/config"
+	"photovault/models"
+	"photovault/services"
+	"photovault/utils"
+)
+
+// CoverHistoryResponse is one of a vault's covers, current or replaced.
+type CoverHistoryResponse struct {
+	ID             uint       `json:"id"`
+	Filename       string     `json:"filename"`
+	URL            string     `json:"url"`
+	SourceUploadID *uint      `json:"source_upload_id,omitempty"`
+	UploadTime     time.Time  `json:"upload_time"`
+	ReplacedAt     *time.Time `json:"replaced_at,omitempty"`
+	Current        bool       `json:"current"`
+	BlurHash       string     `json:"blurhash,omitempty"`
+	DominantColor  string     `json:"dominant_color,omitempty"`
+}
+
+// CoverFromUploadHandler makes a cropped copy of one of the user's uploads
+// the cover of a vault, at /cover/from-upload/{vaultId}. The crop is in
+// fractions of the image as shown, edits applied; an aspect ratio such as
+// "16:9" trims it further around its centre.
+func CoverFromUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	vault, ok := ownedVault(w, r, "/cover/from-upload/")
+	if !ok {
+		return
+	}
+	if sealed(w, &vault, services.AccessModify) {
+		return
+	}
+
+	var input struct {
+		UploadID uint             `json:"uploadId"`
+		Crop     *models.CropRect `json:"crop"`
+		Aspect   string           `json:"aspect"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	aspect, err := services.ParseAspect(input.Aspect)
+	if err != nil {
+		http.Error(w, "Invalid aspect ratio", http.StatusBadRequest)
+		return
+	}
+
+	var upload models.Upload
+	err = config.DB.Preload("Vault").
+		Where("deleted_at IS NULL AND pending = ?", false).
+		First(&upload, input.UploadID).Error
+	if err != nil || upload.Vault.UserID != vault.UserID {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	if sealed(w, &upload.Vault, services.AccessView) {
+		return
+	}
+
+	cover, err := services.CoverFromUpload(r.Context(), &vault, &upload, input.Crop, aspect)
+	if errors.Is(err, services.ErrInvalidCrop) {
+		http.Error(w, "Invalid crop", http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, services.ErrNotImage) {
+		http.Error(w, "Upload can't be used as a cover", http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to make cover for vault %d from upload %d: %v", vault.ID, upload.ID, err)
+		http.Error(w, "Failed to save cover image", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(coverHistoryResponse(*cover, vault))
+}
+
+// CoverHistoryHandler lists a vault's current cover and the replaced ones it
+// can switch back to, newest first, at /cover/history/{vaultId}.
+func CoverHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	vault, ok := ownedVault(w, r, "/cover/history/")
+	if !ok {
+		return
+	}
+
+	var covers []models.CoverImage
+	err := config.DB.Where("vault_id = ?", vault.ID).
+		Order("replaced_at IS NOT NULL, replaced_at DESC, id DESC").
+		Find(&covers).Error
+	if err != nil {
+		http.Error(w, "Failed to retrieve cover images", http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]CoverHistoryResponse, 0, len(covers))
+	for _, c := range covers {
+		response = append(response, coverHistoryResponse(c, vault))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// RestoreCoverHandler makes a cover from the vault's history current again,
+// at /cover/restore/{vaultId}.
+func RestoreCoverHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	vault, ok := ownedVault(w, r, "/cover/restore/")
+	if !ok {
+		return
+	}
+	if sealed(w, &vault, services.AccessModify) {
+		return
+	}
+
+	var input struct {
+		CoverID uint `json:"coverId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var cover models.CoverImage
+	if err := config.DB.Where("vault_id = ?", vault.ID).First(&cover, input.CoverID).Error; err != nil {
+		http.Error(w, "Cover image not found", http.StatusNotFound)
+		return
+	}
+	if err := services.SetCover(&vault, &cover); err != nil {
+		http.Error(w, "Failed to link cover image", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(coverHistoryResponse(cover, vault))
+}
+
+// ownedVault loads the vault whose ID follows prefix in the path, answering
+// the request itself if it's missing or not the caller's.
+func ownedVault(w http.ResponseWriter, r *http.Request, prefix string) (models.Vault, bool) {
+	var vault models.Vault
+	vaultId, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, prefix), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid vault ID", http.StatusBadRequest)
+		return vault, false
+	}
+	userId, _, err := utils.GetUserFromToken(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return vault, false
+	}
+	if err := config.DB.First(&vault, vaultId).Error; err != nil || vault.UserID != userId {
+		http.Error(w, "Vault not found or forbidden", http.StatusForbidden)
+		return vault, false
+	}
+	return vault, true
+}
+
+func coverHistoryResponse(c models.CoverImage, vault models.Vault) CoverHistoryResponse {
+	return CoverHistoryResponse{
+		ID:             c.ID,
+		Filename:       c.Filename,
+		URL:            "/image/cover/" + strconv.FormatUint(uint64(c.ID), 10),
+		SourceUploadID: c.SourceUploadID,
+		UploadTime:     c.UploadTime,
+		ReplacedAt:     c.ReplacedAt,
+		Current:        vault.CoverImageID != nil && *vault.CoverImageID == c.ID,
+		BlurHash:       c.BlurHash,
+		DominantColor:  c.DominantColor,
+	}
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"photovault/models"
+	"photovault/services"
+)
+
+// EditImageHandler replaces the edit list of an upload, at
+// /images/edit/{uploadId}. The original file is kept as it is; the edits are
+// applied whenever the upload is shown.
+func EditImageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	upload, ok := ownedUpload(w, r, "/images/edit/", services.AccessModify)
+	if !ok {
+		return
+	}
+
+	var edits models.ImageEdits
+	if err := json.NewDecoder(r.Body).Decode(&edits); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	saveEdits(w, r, &upload, &edits)
+}
+
+// ResetEditsHandler drops every edit of an upload, showing it as uploaded
+// again, at /images/edit/reset/{uploadId}.
+func ResetEditsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	upload, ok := ownedUpload(w, r, "/images/edit/reset/", services.AccessModify)
+	if !ok {
+		return
+	}
+	saveEdits(w, r, &upload, nil)
+}
+
+func saveEdits(w http.ResponseWriter, r *http.Request, upload *models.Upload, edits *models.ImageEdits) {
+	err := services.SetEdits(r.Context(), upload, edits)
+	if errors.Is(err, services.ErrInvalidEdits) {
+		http.Error(w, "Invalid edits: rotate must be a multiple of 90 and crop within the image", http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, services.ErrNotEditable) {
+		http.Error(w, "This file can't be edited", http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to save edits of upload %d: %v", upload.ID, err)
+		http.Error(w, "Failed to save edits", http.StatusInternalServerError)
+		return
+	}
+
+	metadata, err := loadMetadata([]models.Upload{*upload})
+	if err != nil {
+		http.Error(w, "Failed to retrieve metadata", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(uploadResponse(*upload, metadata[upload.ID]))
+}
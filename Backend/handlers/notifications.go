@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"photovault/config"
+	"photovault/models"
+	"photovault/services"
+	"photovault/utils"
+)
+
+// NotificationSettingsHandler reads, or with PATCH changes, whether a user is
+// reminded before their capsules unlock and how many days before. An empty
+// reminderDays goes back to the default schedule.
+func NotificationSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, _, err := utils.GetUserFromToken(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var user models.User
+	if err := config.DB.First(&user, userID).Error; err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPatch:
+		var input struct {
+			CapsuleReminders *bool  `json:"capsuleReminders"`
+			ReminderDays     *[]int `json:"reminderDays"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		updates := map[string]interface{}{}
+		if input.CapsuleReminders != nil {
+			user.CapsuleReminders = *input.CapsuleReminders
+			updates["capsule_reminders"] = user.CapsuleReminders
+		}
+		if input.ReminderDays != nil {
+			days, err := services.NormalizeReminderDays(*input.ReminderDays)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			user.ReminderDays = services.FormatReminderDays(days)
+			updates["reminder_days"] = user.ReminderDays
+		}
+		if len(updates) > 0 {
+			if err := config.DB.Model(&models.User{}).Where("id = ?", userID).Updates(updates).Error; err != nil {
+				http.Error(w, "Failed to update user", http.StatusInternalServerError)
+				return
+			}
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"capsuleReminders": user.CapsuleReminders,
+		"reminderDays":     services.ReminderDays(&user),
+	})
+}
@@ -0,0 +1,351 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"photovault/config"
+	"photovault/models"
+	"photovault/services"
+	"photovault/storage"
+	"photovault/utils"
+)
+
+// presignedUploadTTL is how long a client has to PUT each file.
+const presignedUploadTTL = 15 * time.Minute
+
+type PresignFile struct {
+	Filename    string `json:"filename"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"`
+}
+
+type PresignUploadRequest struct {
+	Files []PresignFile `json:"files"`
+}
+
+type PresignedUpload struct {
+	ID        uint      `json:"id"`
+	Filename  string    `json:"filename"`
+	Key       string    `json:"key"`
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type FinalizeUploadRequest struct {
+	IDs []uint `json:"ids"`
+}
+
+type FinalizeResult struct {
+	ID     uint   `json:"id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// PresignUploadHandler reserves quota for a batch of files, creates pending
+// Upload rows and hands back presigned PUT URLs so clients can send the bytes
+// straight to the bucket. Each upload must then be confirmed through
+// FinalizeUploadHandler.
+func PresignUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	vaultIdStr := strings.TrimPrefix(r.URL.Path, "/upload/presign/")
+	vaultId, err := strconv.ParseUint(vaultIdStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid vault ID", http.StatusBadRequest)
+		return
+	}
+
+	userId, _, err := utils.GetUserFromToken(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var user models.User
+	if err := config.DB.First(&user, userId).Error; err != nil {
+		http.Error(w, "User not found", http.StatusInternalServerError)
+		return
+	}
+	var vault models.Vault
+	if err := config.DB.First(&vault, vaultId).Error; err != nil || vault.UserID != userId {
+		http.Error(w, "Vault not found or forbidden", http.StatusForbidden)
+		return
+	}
+	if sealed(w, &vault, services.AccessModify) {
+		return
+	}
+
+	var req PresignUploadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(req.Files) == 0 {
+		http.Error(w, "No files requested", http.StatusBadRequest)
+		return
+	}
+
+	var batchSize int64
+	for _, f := range req.Files {
+		if f.Filename == "" || f.Size <= 0 {
+			http.Error(w, "Each file needs a filename and a positive size", http.StatusBadRequest)
+			return
+		}
+		// The bytes are checked again on finalize; this just fails early
+		if f.ContentType != "" && !services.IsAllowedType(f.ContentType) {
+			http.Error(w, "Unsupported file type: "+f.Filename, http.StatusUnsupportedMediaType)
+			return
+		}
+		if services.IsVideoType(f.ContentType) && f.Size > utils.VideoLimits[user.PlanType].MaxSize {
+			http.Error(w, errVideoTooLarge.Error()+": "+f.Filename, http.StatusRequestEntityTooLarge)
+			return
+		}
+		batchSize += f.Size
+	}
+
+	// Pending uploads hold their quota until they are finalized or expire
+	reserved, err := reservedStorage(userId)
+	if err != nil {
+		http.Error(w, "Failed to check storage", http.StatusInternalServerError)
+		return
+	}
+	plan := utils.PlanLimits[user.PlanType]
+	if user.TotalStorageUsed+reserved+batchSize > plan.MaxStorage {
+		http.Error(w, "storage limit exceeded", http.StatusForbidden)
+		return
+	}
+
+	expiresAt := time.Now().Add(presignedUploadTTL)
+	responses := []PresignedUpload{}
+	for _, f := range req.Files {
+		upload := models.Upload{
+			VaultID:  uint(vaultId),
+			Filename: f.Filename,
+			Size:     f.Size,
+			Key:      fmt.Sprintf("pending-%d", time.Now().UnixNano()),
+			Pending:  true,
+		}
+		if err := config.DB.Create(&upload).Error; err != nil {
+			http.Error(w, "Failed to log upload", http.StatusInternalServerError)
+			return
+		}
+
+		upload.Key = uploadKey(upload.VaultID, upload.ID, f.Filename)
+		if err := config.DB.Model(&upload).Update("key", upload.Key).Error; err != nil {
+			http.Error(w, "Failed to update upload key", http.StatusInternalServerError)
+			return
+		}
+
+		url, err := config.Storage.Presign(r.Context(), http.MethodPut, upload.Key, storage.PresignOptions{
+			TTL:           presignedUploadTTL,
+			ContentLength: f.Size,
+			ContentType:   f.ContentType,
+		})
+		if err != nil {
+			http.Error(w, "Failed to presign upload: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		responses = append(responses, PresignedUpload{
+			ID:        upload.ID,
+			Filename:  upload.Filename,
+			Key:       upload.Key,
+			URL:       url,
+			ExpiresAt: expiresAt,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(responses)
+}
+
+// FinalizeUploadHandler checks that each presigned upload actually reached
+// the bucket with the declared size and turns it into a regular upload.
+func FinalizeUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	vaultIdStr := strings.TrimPrefix(r.URL.Path, "/upload/finalize/")
+	vaultId, err := strconv.ParseUint(vaultIdStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid vault ID", http.StatusBadRequest)
+		return
+	}
+
+	userId, _, err := utils.GetUserFromToken(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var vault models.Vault
+	if err := config.DB.First(&vault, vaultId).Error; err != nil || vault.UserID != userId {
+		http.Error(w, "Vault not found or forbidden", http.StatusForbidden)
+		return
+	}
+	if sealed(w, &vault, services.AccessModify) {
+		return
+	}
+
+	var req FinalizeUploadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	results := []FinalizeResult{}
+	for _, id := range req.IDs {
+		if err := finalizeUpload(r, &vault, id); err != nil {
+			results = append(results, FinalizeResult{ID: id, Status: "failed", Error: err.Error()})
+			continue
+		}
+		results = append(results, FinalizeResult{ID: id, Status: "uploaded"})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+func finalizeUpload(r *http.Request, vault *models.Vault, id uint) error {
+	var upload models.Upload
+	if err := config.DB.Where("id = ? AND vault_id = ?", id, vault.ID).First(&upload).Error; err != nil {
+		return errors.New("upload not found")
+	}
+	if !upload.Pending {
+		return errors.New("upload already finalized")
+	}
+
+	obj, err := config.Storage.Head(r.Context(), upload.Key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return errors.New("object has not been uploaded")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check object: %w", err)
+	}
+	if obj.Size != upload.Size {
+		// Whatever landed there is not what was reserved; make the client start over
+		config.DB.Delete(&upload)
+		services.DeleteObjects(upload.Key)
+		return fmt.Errorf("object size %d does not match declared size %d", obj.Size, upload.Size)
+	}
+
+	contentType, err := services.SniffObject(r.Context(), upload.Key)
+	if errors.Is(err, services.ErrUnsupportedType) {
+		config.DB.Delete(&upload)
+		services.DeleteObjects(upload.Key)
+		return services.ErrUnsupportedType
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check object type: %w", err)
+	}
+
+	var user models.User
+	if err := config.DB.First(&user, vault.UserID).Error; err != nil {
+		return errors.New("user not found")
+	}
+	if services.IsVideoType(contentType) {
+		if err := checkVideo(r.Context(), upload.Key, obj.Size, utils.VideoLimits[user.PlanType]); err != nil {
+			if videoLimitStatus(err) != 0 {
+				config.DB.Delete(&upload)
+				services.DeleteObjects(upload.Key)
+			}
+			return err
+		}
+	}
+
+	private := services.PrivacyFor(&user, vault)
+	stagedKey, size := upload.Key, upload.Size
+	var sum string
+	if private {
+		// The client uploaded the original, so commit a sanitized copy instead
+		stagedKey, size, sum, err = services.SanitizeObject(r.Context(), upload.Key)
+		if errors.Is(err, services.ErrCannotSanitize) {
+			// The original can't be kept in its place
+			config.DB.Delete(&upload)
+			services.DeleteObjects(upload.Key)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to sanitize object: %w", err)
+		}
+		defer services.DeleteObjects(stagedKey)
+	} else {
+		sum, err = storage.HashObject(r.Context(), config.Storage, upload.Key)
+		if err != nil {
+			return fmt.Errorf("failed to hash object: %w", err)
+		}
+	}
+
+	// The reservation lapses with the URL, so check the quota again
+	limit := utils.PlanLimits[user.PlanType].MaxStorage - user.TotalStorageUsed
+
+	rawKey := upload.Key
+	upload.Size, upload.ContentHash, upload.ContentType = size, sum, contentType
+	err = config.DB.Transaction(func(tx *gorm.DB) error {
+		// Guard on pending so a repeated finalize can't charge twice
+		result := tx.Model(&models.Upload{}).
+			Where("id = ? AND pending = ?", upload.ID, true).
+			Updates(map[string]interface{}{
+				"pending":      false,
+				"size":         size,
+				"content_hash": sum,
+				"content_type": contentType,
+				"order_index":  nextOrderIndex(tx, vault.ID),
+				"upload_time":  time.Now(),
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errors.New("upload already finalized")
+		}
+		_, err := services.CommitUpload(r.Context(), tx, vault, &upload, stagedKey, limit)
+		return err
+	})
+	if errors.Is(err, storage.ErrTooLarge) {
+		return errors.New("storage limit exceeded")
+	}
+	if err != nil {
+		return err
+	}
+
+	services.DeleteObjects(rawKey)
+	services.ProcessUpload(upload, private)
+	log.Printf("Finalized upload %d (%s)", upload.ID, upload.Filename)
+	return nil
+}
+
+// reservedStorage is the size of a user's uploads that are still in flight:
+// pending uploads whose presigned URLs have not expired yet and unfinished
+// resumable uploads.
+func reservedStorage(userID uint) (int64, error) {
+	var presigned int64
+	err := config.DB.Model(&models.Upload{}).
+		Joins("JOIN vaults ON vaults.id = uploads.vault_id").
+		Where("vaults.user_id = ? AND uploads.pending = ?", userID, true).
+		Where("uploads.upload_time > ?", time.Now().Add(-presignedUploadTTL)).
+		Select("COALESCE(SUM(uploads.size), 0)").
+		Scan(&presigned).Error
+	if err != nil {
+		return 0, err
+	}
+
+	var resumable int64
+	err = config.DB.Model(&models.TusUpload{}).
+		Where("user_id = ? AND upload_id IS NULL AND expires_at > ?", userID, time.Now()).
+		Select("COALESCE(SUM(length), 0)").
+		Scan(&resumable).Error
+	return presigned + resumable, err
+}
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"photovault/config"
+	"photovault/models"
+	"photovault/services"
+	"photovault/utils"
+)
+
+// UserPrivacyHandler turns privacy mode on or off for all of a user's vaults
+// that don't set it themselves. With reprocess set, turning it on also
+// sanitizes what those vaults already hold, except in buried capsules, which
+// are listed in skippedSealed.
+func UserPrivacyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPatch {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, _, err := utils.GetUserFromToken(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var input struct {
+		PrivacyMode bool `json:"privacyMode"`
+		Reprocess   bool `json:"reprocess"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := config.DB.Model(&models.User{}).Where("id = ?", userID).Update("privacy_mode", input.PrivacyMode).Error; err != nil {
+		http.Error(w, "Failed to update user", http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusOK
+	skipped := []uint{}
+	if input.PrivacyMode && input.Reprocess {
+		var vaults []models.Vault
+		if err := config.DB.Where("user_id = ? AND privacy_mode IS NULL", userID).Find(&vaults).Error; err != nil {
+			http.Error(w, "Failed to load vaults", http.StatusInternalServerError)
+			return
+		}
+		for _, vault := range vaults {
+			// Buried capsules can't be changed until they open
+			if services.CheckAccess(&vault, services.AccessModify) != nil {
+				skipped = append(skipped, vault.ID)
+				continue
+			}
+			services.ReprocessVault(vault)
+		}
+		status = http.StatusAccepted
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"privacyMode":   input.PrivacyMode,
+		"skippedSealed": skipped,
+	})
+}
+
+// VaultPrivacyHandler sets a vault's own privacy mode, or clears it with
+// null so the vault follows its owner again. With reprocess set and privacy
+// in effect, the vault's existing photos are sanitized too.
+func VaultPrivacyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPatch {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	idStr := strings.TrimPrefix(r.URL.Path, "/vault/privacy/")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, "Invalid vault ID", http.StatusBadRequest)
+		return
+	}
+
+	userID, _, err := utils.GetUserFromToken(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var user models.User
+	if err := config.DB.First(&user, userID).Error; err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	var vault models.Vault
+	if err := config.DB.First(&vault, id).Error; err != nil || vault.UserID != userID {
+		http.Error(w, "Vault not found or forbidden", http.StatusForbidden)
+		return
+	}
+	if sealed(w, &vault, services.AccessModify) {
+		return
+	}
+
+	var input struct {
+		PrivacyMode *bool `json:"privacyMode"`
+		Reprocess   bool  `json:"reprocess"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	vault.PrivacyMode = input.PrivacyMode
+	if err := config.DB.Model(&vault).Update("privacy_mode", vault.PrivacyMode).Error; err != nil {
+		http.Error(w, "Failed to update vault", http.StatusInternalServerError)
+		return
+	}
+
+	private := services.PrivacyFor(&user, &vault)
+	status := http.StatusOK
+	if private && input.Reprocess {
+		services.ReprocessVault(vault)
+		status = http.StatusAccepted
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"privacyMode": vault.PrivacyMode,
+		"effective":   private,
+	})
+}
@@ -0,0 +1,383 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"photovault/config"
+	"photovault/models"
+	"photovault/services"
+	"photovault/utils"
+)
+
+// RecipientResponse is someone a vault is shared with, as its owner sees
+// them. The link itself is only ever in the recipient's email.
+type RecipientResponse struct {
+	ID             uint       `json:"id"`
+	Email          string     `json:"email"`
+	Message        string     `json:"message"`
+	NotifiedAt     *time.Time `json:"notified_at,omitempty"`
+	TokenExpiresAt *time.Time `json:"link_expires_at,omitempty"`
+	RevokedAt      *time.Time `json:"revoked_at,omitempty"`
+	Claimed        bool       `json:"claimed"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// SharedCapsuleResponse is an opened capsule as a recipient sees it.
+type SharedCapsuleResponse struct {
+	RecipientID uint             `json:"recipient_id"`
+	Title       string           `json:"title"`
+	Description string           `json:"description"`
+	UnlockDate  *time.Time       `json:"unlock_date"`
+	From        string           `json:"from"`
+	Message     string           `json:"message"`
+	Claimed     bool             `json:"claimed"`
+	Uploads     []UploadResponse `json:"uploads,omitempty"`
+}
+
+// RecipientsHandler lists the people a vault is shared with, or with POST
+// adds one, at /vault/recipients/{vaultId}. Someone added to a capsule that
+// has already unlocked is sent their link straight away.
+func RecipientsHandler(w http.ResponseWriter, r *http.Request) {
+	vault, ok := ownedVault(w, r, "/vault/recipients/")
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		var recipients []models.VaultRecipient
+		if err := config.DB.Where("vault_id = ?", vault.ID).Order("id").Find(&recipients).Error; err != nil {
+			http.Error(w, "Failed to retrieve recipients", http.StatusInternalServerError)
+			return
+		}
+		response := make([]RecipientResponse, 0, len(recipients))
+		for _, rc := range recipients {
+			response = append(response, recipientResponse(rc))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+
+	case http.MethodPost:
+		var input struct {
+			Email   string `json:"email"`
+			Message string `json:"message"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		addr, err := mail.ParseAddress(strings.TrimSpace(input.Email))
+		if err != nil || len(addr.Address) > 254 {
+			http.Error(w, "Invalid email address", http.StatusBadRequest)
+			return
+		}
+		email := strings.ToLower(addr.Address)
+
+		var existing int64
+		config.DB.Model(&models.VaultRecipient{}).Where("vault_id = ? AND email = ?", vault.ID, email).Count(&existing)
+		if existing > 0 {
+			http.Error(w, "Already a recipient", http.StatusConflict)
+			return
+		}
+
+		recipient := models.VaultRecipient{VaultID: vault.ID, Email: email, Message: input.Message}
+		if err := config.DB.Create(&recipient).Error; err != nil {
+			http.Error(w, "Failed to add recipient", http.StatusInternalServerError)
+			return
+		}
+		if services.CapsuleStatus(&vault) == services.StatusUnlocked {
+			// A failed send is tried again by the capsule scheduler
+			if err := services.SendRecipientLink(&vault, &recipient); err != nil {
+				log.Printf("Failed to send capsule %d to recipient %d: %v", vault.ID, recipient.ID, err)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(recipientResponse(recipient))
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// RevokeRecipientHandler stops a recipient's link and claimed access from
+// working, at /vault/recipients/revoke/{recipientId}.
+func RevokeRecipientHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	recipient, _, ok := ownedRecipient(w, r, "/vault/recipients/revoke/")
+	if !ok {
+		return
+	}
+	if recipient.RevokedAt == nil {
+		if err := services.RevokeRecipient(&recipient); err != nil {
+			http.Error(w, "Failed to revoke recipient", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(recipientResponse(recipient))
+}
+
+// ResendRecipientHandler sends a recipient a new link to an unlocked
+// capsule, replacing one that expired or went astray, at
+// /vault/recipients/resend/{recipientId}. A revoked recipient is restored.
+func ResendRecipientHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	recipient, vault, ok := ownedRecipient(w, r, "/vault/recipients/resend/")
+	if !ok {
+		return
+	}
+	if services.CapsuleStatus(&vault) != services.StatusUnlocked {
+		http.Error(w, "Capsule hasn't unlocked", http.StatusConflict)
+		return
+	}
+	if recipient.RevokedAt != nil {
+		recipient.RevokedAt = nil
+		if err := config.DB.Model(&recipient).Update("revoked_at", nil).Error; err != nil {
+			http.Error(w, "Failed to restore recipient", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := services.SendRecipientLink(&vault, &recipient); err != nil {
+		log.Printf("Failed to send capsule %d to recipient %d: %v", vault.ID, recipient.ID, err)
+		http.Error(w, "Failed to send link", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(recipientResponse(recipient))
+}
+
+// SharedCapsuleHandler is how recipients without an account view an opened
+// capsule, read-only, through the token in their link:
+//
+//	GET  /shared/{token}                  the capsule and its uploads
+//	GET  /shared/{token}/image/{uploadId} one upload, as GetImageHandler
+//	POST /shared/{token}/claim            keep it in the signed-in account
+func SharedCapsuleHandler(w http.ResponseWriter, r *http.Request) {
+	token, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/shared/"), "/")
+	recipient, vault, err := services.RecipientByToken(token)
+	if err != nil {
+		http.Error(w, "This link is invalid or has expired", http.StatusNotFound)
+		return
+	}
+
+	if rest == "claim" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		userId, _, err := utils.GetUserFromToken(r)
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if err := services.ClaimRecipient(recipient, userId); err != nil {
+			if errors.Is(err, services.ErrRecipientLink) {
+				http.Error(w, "Already claimed by another account", http.StatusConflict)
+				return
+			}
+			if errors.Is(err, services.ErrRecipientEmail) {
+				http.Error(w, "Sign in with the email address this link was sent to", http.StatusForbidden)
+				return
+			}
+			http.Error(w, "Failed to claim capsule", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message":     "Capsule claimed",
+			"recipientId": recipient.ID,
+		})
+		return
+	}
+
+	serveShared(w, r, recipient, vault, "/shared/"+token+"/image/", rest)
+}
+
+// ReceivedHandler lists the capsules a signed-in user has claimed, at
+// /received/, and serves each of them like SharedCapsuleHandler, at
+// /received/{recipientId} and /received/{recipientId}/image/{uploadId}.
+func ReceivedHandler(w http.ResponseWriter, r *http.Request) {
+	userId, _, err := utils.GetUserFromToken(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	idStr, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/received/"), "/")
+	if idStr == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var recipients []models.VaultRecipient
+		err := config.DB.Where("claimed_by_id = ? AND revoked_at IS NULL", userId).Order("id").Find(&recipients).Error
+		if err != nil {
+			http.Error(w, "Failed to retrieve capsules", http.StatusInternalServerError)
+			return
+		}
+		response := []SharedCapsuleResponse{}
+		for _, rc := range recipients {
+			recipient, vault, err := services.ClaimedRecipient(rc.ID, userId)
+			if err != nil {
+				continue
+			}
+			resp, err := sharedCapsule(recipient, vault, "", false)
+			if err != nil {
+				http.Error(w, "Failed to retrieve capsules", http.StatusInternalServerError)
+				return
+			}
+			response = append(response, resp)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid capsule ID", http.StatusBadRequest)
+		return
+	}
+	recipient, vault, err := services.ClaimedRecipient(uint(id), userId)
+	if err != nil {
+		http.Error(w, "Capsule not found", http.StatusNotFound)
+		return
+	}
+	serveShared(w, r, recipient, vault, fmt.Sprintf("/received/%d/image/", id), rest)
+}
+
+// serveShared answers a recipient's read-only request for an opened
+// capsule: the capsule itself when rest is empty, or one of its uploads
+// when rest is image/{uploadId}. base is where its uploads are served.
+func serveShared(w http.ResponseWriter, r *http.Request, recipient *models.VaultRecipient, vault *models.Vault, base, rest string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if rest == "" {
+		resp, err := sharedCapsule(recipient, vault, base, true)
+		if err != nil {
+			http.Error(w, "Failed to retrieve capsule", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	uploadId, err := strconv.ParseUint(strings.TrimPrefix(rest, "image/"), 10, 64)
+	if err != nil || !strings.HasPrefix(rest, "image/") {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	var img models.Upload
+	err = config.DB.Where("vault_id = ? AND deleted_at IS NULL AND pending = ?", vault.ID, false).
+		First(&img, uploadId).Error
+	if err != nil {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	serveUpload(w, r, &img)
+}
+
+// sharedCapsule describes an opened capsule to a recipient, with its uploads
+// under base when withUploads is set.
+func sharedCapsule(recipient *models.VaultRecipient, vault *models.Vault, base string, withUploads bool) (SharedCapsuleResponse, error) {
+	var owner models.User
+	if err := config.DB.First(&owner, vault.UserID).Error; err != nil {
+		return SharedCapsuleResponse{}, err
+	}
+	from := owner.DisplayName
+	if from == "" {
+		from = owner.Email
+	}
+	resp := SharedCapsuleResponse{
+		RecipientID: recipient.ID,
+		Title:       vault.Title,
+		Description: vault.Description,
+		UnlockDate:  vault.UnlockDate,
+		From:        from,
+		Message:     recipient.Message,
+		Claimed:     recipient.ClaimedByID != nil,
+	}
+	if !withUploads {
+		return resp, nil
+	}
+
+	var uploads []models.Upload
+	err := config.DB.Where("vault_id = ? AND deleted_at IS NULL AND pending = ?", vault.ID, false).
+		Order("order_index, id").Find(&uploads).Error
+	if err != nil {
+		return resp, err
+	}
+	metadata, err := loadMetadata(uploads)
+	if err != nil {
+		return resp, err
+	}
+	resp.Uploads = []UploadResponse{}
+	for _, u := range uploads {
+		resp.Uploads = append(resp.Uploads, uploadResponseAt(base, u, metadata[u.ID]))
+	}
+	return resp, nil
+}
+
+// ownedRecipient loads the recipient whose ID follows prefix in the path,
+// with their vault, answering the request itself unless the vault is the
+// caller's.
+func ownedRecipient(w http.ResponseWriter, r *http.Request, prefix string) (models.VaultRecipient, models.Vault, bool) {
+	var recipient models.VaultRecipient
+	var vault models.Vault
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, prefix), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid recipient ID", http.StatusBadRequest)
+		return recipient, vault, false
+	}
+	userId, _, err := utils.GetUserFromToken(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return recipient, vault, false
+	}
+	if err := config.DB.First(&recipient, id).Error; err != nil {
+		http.Error(w, "Recipient not found", http.StatusNotFound)
+		return recipient, vault, false
+	}
+	if err := config.DB.First(&vault, recipient.VaultID).Error; err != nil || vault.UserID != userId {
+		http.Error(w, "Vault not found or forbidden", http.StatusForbidden)
+		return recipient, vault, false
+	}
+	return recipient, vault, true
+}
+
+func recipientResponse(rc models.VaultRecipient) RecipientResponse {
+	return RecipientResponse{
+		ID:             rc.ID,
+		Email:          rc.Email,
+		Message:        rc.Message,
+		NotifiedAt:     rc.NotifiedAt,
+		TokenExpiresAt: rc.TokenExpiresAt,
+		RevokedAt:      rc.RevokedAt,
+		Claimed:        rc.ClaimedByID != nil,
+		CreatedAt:      rc.CreatedAt,
+	}
+}
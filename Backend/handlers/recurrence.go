@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"photovault/config"
+	"photovault/models"
+	"photovault/services"
+)
+
+// CycleResponse is one opening of a recurring capsule and the uploads added
+// in it.
+type CycleResponse struct {
+	Number     int       `json:"number"`
+	UnlockDate time.Time `json:"unlock_date"`
+	OpenedAt   time.Time `json:"opened_at"`
+	UploadIDs  []uint    `json:"upload_ids"`
+}
+
+// RecurrenceHandler makes a capsule open again on every occurrence of a
+// rule, starting from its unlock date, at /vault/recurrence/{vaultId}. The
+// rule is "yearly", "monthly" or an RRULE subset; an empty rule makes the
+// capsule a one-off again.
+func RecurrenceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	vault, ok := ownedVault(w, r, "/vault/recurrence/")
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Rule string `json:"rule"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	err := services.SetRecurrence(&vault, input.Rule)
+	if errors.Is(err, services.ErrInvalidRecurrence) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, services.ErrUnlockDateRequired) {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to update vault", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"recurrence":       vault.Recurrence,
+		"recurrence_start": vault.RecurrenceStart,
+	})
+}
+
+// CyclesHandler lists the openings of a recurring capsule, oldest first,
+// with the uploads snapshotted into each, at /vault/cycles/{vaultId}.
+func CyclesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	vault, ok := ownedVault(w, r, "/vault/cycles/")
+	if !ok {
+		return
+	}
+	if sealed(w, &vault, services.AccessView) {
+		return
+	}
+
+	var cycles []models.VaultCycle
+	if err := config.DB.Where("vault_id = ?", vault.ID).Order("number").Find(&cycles).Error; err != nil {
+		http.Error(w, "Failed to retrieve cycles", http.StatusInternalServerError)
+		return
+	}
+
+	response := make([]CycleResponse, 0, len(cycles))
+	for _, c := range cycles {
+		ids := []uint{}
+		if err := config.DB.Model(&models.VaultCycleUpload{}).Where("cycle_id = ?", c.ID).Order("upload_id").Pluck("upload_id", &ids).Error; err != nil {
+			http.Error(w, "Failed to retrieve cycles", http.StatusInternalServerError)
+			return
+		}
+		response = append(response, CycleResponse{
+			Number:     c.Number,
+			UnlockDate: c.UnlockDate,
+			OpenedAt:   c.OpenedAt,
+			UploadIDs:  ids,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
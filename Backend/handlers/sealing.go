@@ -0,0 +1,19 @@
+package handlers
+
+import (
+	"net/http"
+
+	"photovault/models"
+	"photovault/services"
+)
+
+// sealed applies the capsule sealing policy to a request. When the vault
+// refuses the access it answers 423 Locked, saying when the capsule opens,
+// and reports true.
+func sealed(w http.ResponseWriter, vault *models.Vault, access services.Access) bool {
+	if err := services.CheckAccess(vault, access); err != nil {
+		http.Error(w, err.Error(), http.StatusLocked)
+		return true
+	}
+	return false
+}
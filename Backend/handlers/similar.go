@@ -0,0 +1,228 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"photovault/config"
+	"photovault/models"
+	"photovault/services"
+	"photovault/utils"
+)
+
+// defaultSimilarDistance is how many of the 64 hash bits near duplicates may
+// differ in unless the client says otherwise. Bursts and resized copies
+// usually sit well under it; unrelated photos rarely come within 20.
+const (
+	defaultSimilarDistance = 10
+	maxSimilarDistance     = 20
+)
+
+// SimilarCluster is a group of near-duplicate uploads, with the one worth
+// keeping suggested: the largest picture, then the largest file, then the
+// first uploaded.
+type SimilarCluster struct {
+	Keep    uint             `json:"keep"`
+	Uploads []UploadResponse `json:"uploads"`
+}
+
+// SimilarHandler lists clusters of near-duplicate photos in a vault, at
+// /images/similar/{vaultId}, or across all of the user's vaults, at
+// /images/similar/all. ?distance= sets how close they must be.
+func SimilarHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userId, _, err := utils.GetUserFromToken(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	scope := strings.TrimPrefix(r.URL.Path, "/images/similar/")
+	distance, ok := similarDistance(r.URL.Query().Get("distance"))
+	if !ok {
+		http.Error(w, "Invalid distance", http.StatusBadRequest)
+		return
+	}
+
+	clusters, uploads, metadata, status, msg := findSimilar(userId, scope, distance, services.AccessView)
+	if status != 0 {
+		http.Error(w, msg, status)
+		return
+	}
+
+	response := []SimilarCluster{}
+	for _, ids := range clusters {
+		cluster := SimilarCluster{Keep: ids[0]}
+		for _, id := range ids {
+			cluster.Uploads = append(cluster.Uploads, uploadResponse(uploads[id], metadata[id]))
+		}
+		response = append(response, cluster)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// TrashSimilarHandler moves every upload but one in each near-duplicate
+// cluster to the trash, at /images/similar/trash/{vaultId} or
+// /images/similar/trash/all. The suggested upload of each cluster is kept
+// unless another member is listed in "keep".
+func TrashSimilarHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userId, _, err := utils.GetUserFromToken(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var input struct {
+		Distance *int   `json:"distance"`
+		Keep     []uint `json:"keep"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	distance := defaultSimilarDistance
+	if input.Distance != nil {
+		distance = *input.Distance
+		if distance < 0 || distance > maxSimilarDistance {
+			http.Error(w, "Invalid distance", http.StatusBadRequest)
+			return
+		}
+	}
+	keep := make(map[uint]bool, len(input.Keep))
+	for _, id := range input.Keep {
+		keep[id] = true
+	}
+
+	scope := strings.TrimPrefix(r.URL.Path, "/images/similar/trash/")
+	clusters, _, _, status, msg := findSimilar(userId, scope, distance, services.AccessModify)
+	if status != 0 {
+		http.Error(w, msg, status)
+		return
+	}
+
+	trashed := []uint{}
+	for _, ids := range clusters {
+		kept := ids[0]
+		for _, id := range ids {
+			if keep[id] {
+				kept = id
+				break
+			}
+		}
+		for _, id := range ids {
+			if id != kept {
+				trashed = append(trashed, id)
+			}
+		}
+	}
+
+	if len(trashed) > 0 {
+		err := config.DB.Model(&models.Upload{}).
+			Where("id IN ? AND deleted_at IS NULL", trashed).
+			Updates(map[string]interface{}{"deleted_at": time.Now(), "order_index": -1}).Error
+		if err != nil {
+			http.Error(w, "Failed to move to trash", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Moved to trash",
+		"trashed": trashed,
+	})
+}
+
+func similarDistance(s string) (int, bool) {
+	if s == "" {
+		return defaultSimilarDistance, true
+	}
+	d, err := strconv.Atoi(s)
+	if err != nil || d < 0 || d > maxSimilarDistance {
+		return 0, false
+	}
+	return d, true
+}
+
+// findSimilar clusters the hashed photos of one vault, or of all the user's
+// vaults when scope is "all", leaving out vaults the sealing policy keeps
+// from the access. Each cluster starts with its suggested keeper; clusters
+// are ordered by their keeper's upload time. On failure it returns the HTTP
+// status and message to answer with.
+func findSimilar(userId uint, scope string, distance int, access services.Access) ([][]uint, map[uint]models.Upload, map[uint]*models.UploadMetadata, int, string) {
+	query := config.DB.Model(&models.Upload{}).
+		Joins("JOIN vaults ON vaults.id = uploads.vault_id").
+		Joins("JOIN upload_metadata ON upload_metadata.upload_id = uploads.id").
+		Where("vaults.user_id = ? AND uploads.deleted_at IS NULL AND uploads.pending = ?", userId, false).
+		Where("upload_metadata.perceptual_hash IS NOT NULL")
+	if scope != "all" {
+		vaultId, err := strconv.ParseUint(scope, 10, 64)
+		if err != nil {
+			return nil, nil, nil, http.StatusBadRequest, "Invalid vault ID"
+		}
+		var vault models.Vault
+		if err := config.DB.First(&vault, vaultId).Error; err != nil || vault.UserID != userId {
+			return nil, nil, nil, http.StatusForbidden, "Vault not found or forbidden"
+		}
+		if err := services.CheckAccess(&vault, access); err != nil {
+			return nil, nil, nil, http.StatusLocked, err.Error()
+		}
+		query = query.Where("uploads.vault_id = ?", vaultId)
+	} else if access == services.AccessModify || !services.BuriedViewable() {
+		query = query.Where("vaults.status IS DISTINCT FROM ?", services.StatusBuried)
+	}
+
+	var rows []models.Upload
+	if err := query.Find(&rows).Error; err != nil {
+		return nil, nil, nil, http.StatusInternalServerError, "Failed to retrieve uploads"
+	}
+	metadata, err := loadMetadata(rows)
+	if err != nil {
+		return nil, nil, nil, http.StatusInternalServerError, "Failed to retrieve metadata"
+	}
+
+	uploads := make(map[uint]models.Upload, len(rows))
+	hashes := make(map[uint]uint64, len(rows))
+	for _, u := range rows {
+		if m := metadata[u.ID]; m != nil && m.PerceptualHash != nil {
+			uploads[u.ID] = u
+			hashes[u.ID] = uint64(*m.PerceptualHash)
+		}
+	}
+
+	clusters := services.ClusterByHash(hashes, distance)
+	better := func(a, b uint) bool {
+		ma, mb := metadata[a], metadata[b]
+		if pa, pb := ma.Width*ma.Height, mb.Width*mb.Height; pa != pb {
+			return pa > pb
+		}
+		if uploads[a].Size != uploads[b].Size {
+			return uploads[a].Size > uploads[b].Size
+		}
+		return a < b
+	}
+	for _, ids := range clusters {
+		sort.Slice(ids, func(i, j int) bool { return better(ids[i], ids[j]) })
+	}
+	sort.Slice(clusters, func(i, j int) bool {
+		return uploads[clusters[i][0]].UploadTime.Before(uploads[clusters[j][0]].UploadTime)
+	})
+	return clusters, uploads, metadata, 0, ""
+}
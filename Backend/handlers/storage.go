@@ -1,21 +1,25 @@
 package handlers
 
 import (
-	"bytes"
-	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net/http"
-	"photovault/config"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"photovault/config"
+	"photovault/services"
+	"photovault/storage"
 )
 
 func UploadFile(w http.ResponseWriter, r *http.Request) {
 	r.ParseMultipartForm(10 << 20)
-	log.Printf("Content-Type:", r.Header.Get("Content-Type"))
-	log.Printf("r.MultipartForm:", r.MultipartForm)
+	log.Printf("Content-Type: %s", r.Header.Get("Content-Type"))
 	file, header, err := r.FormFile("file")
 	if err != nil {
 		http.Error(w, "file not found"+err.Error(), http.StatusBadRequest)
@@ -23,23 +27,256 @@ func UploadFile(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	buf := bytes.NewBuffer(nil)
-	if _, err := io.Copy(buf, file); err != nil {
-		http.Error(w, "failed to read file", http.StatusInternalServerError)
+	contentType, body, err := services.SniffReader(file)
+	if err != nil {
+		http.Error(w, "Unsupported file type", http.StatusUnsupportedMediaType)
 		return
 	}
 
 	key := "uploads/" + header.Filename
 
-	_, err = config.R2Client.PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket: &config.R2Bucket,
-		Key:    &key,
-		Body:   bytes.NewReader(buf.Bytes()),
-	})
-	if err != nil {
+	if err := config.Storage.Put(r.Context(), key, body, header.Size, contentType); err != nil {
 		http.Error(w, "upload failed: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	fmt.Fprintf(w, "✅ Uploaded %s", key)
 }
+
+// LocalObjectHandler serves presigned URLs issued by the local storage
+// backend, standing in for the bucket when running offline.
+func LocalObjectHandler(w http.ResponseWriter, r *http.Request) {
+	store, ok := config.Storage.(*storage.LocalStore)
+	if !ok {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, "/storage/local/")
+	q := r.URL.Query()
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid or expired signature", http.StatusForbidden)
+		return
+	}
+	opts := storage.PresignOptions{
+		ContentType:        q.Get("type"),
+		ContentDisposition: q.Get("disposition"),
+	}
+	if q.Has("size") {
+		if opts.ContentLength, err = strconv.ParseInt(q.Get("size"), 10, 64); err != nil {
+			http.Error(w, "Invalid or expired signature", http.StatusForbidden)
+			return
+		}
+	}
+	if q.Get("method") != r.Method || !store.Verify(r.Method, key, expires, opts, q.Get("sig")) {
+		http.Error(w, "Invalid or expired signature", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		body, obj, err := store.GetRange(r.Context(), key, storage.GetOptions{Range: r.Header.Get("Range")})
+		if errors.Is(err, storage.ErrNotFound) {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, storage.ErrInvalidRange) {
+			http.Error(w, "Requested range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to retrieve file: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer body.Close()
+
+		if opts.ContentType != "" {
+			w.Header().Set("Content-Type", opts.ContentType)
+		} else {
+			w.Header().Set("Content-Type", objectContentType(obj.ContentType, key))
+		}
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if opts.ContentDisposition != "" {
+			w.Header().Set("Content-Disposition", opts.ContentDisposition)
+		}
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Length", strconv.FormatInt(obj.Size, 10))
+		if obj.ContentRange != "" {
+			w.Header().Set("Content-Range", obj.ContentRange)
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		io.Copy(w, body)
+	case http.MethodPut:
+		if opts.ContentLength > 0 && r.ContentLength != opts.ContentLength {
+			http.Error(w, "Content-Length does not match the signed size", http.StatusForbidden)
+			return
+		}
+		if err := store.Put(r.Context(), key, r.Body, r.ContentLength, r.Header.Get("Content-Type")); err != nil {
+			http.Error(w, "upload failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Cache-Control values for served objects. Upload URLs carry the version
+// they show (see versionedURL), while a vault's cover can be replaced and has
+// to be revalidated.
+const (
+	imageCacheControl = "private, max-age=86400"
+	coverCacheControl = "private, no-cache"
+)
+
+// redirectTTL is how long the presigned URLs handed out by redirect mode stay
+// valid, from IMAGE_REDIRECT_TTL (a Go duration, default 5m).
+func redirectTTL() time.Duration {
+	ttl, err := time.ParseDuration(config.GetEnv("IMAGE_REDIRECT_TTL", "5m"))
+	if err != nil || ttl <= 0 {
+		return 5 * time.Minute
+	}
+	return ttl
+}
+
+// wantsRedirect reports whether the client asked for a presigned URL instead
+// of the bytes, with ?redirect=1.
+func wantsRedirect(r *http.Request) bool {
+	redirect, _ := strconv.ParseBool(r.URL.Query().Get("redirect"))
+	return redirect
+}
+
+// redirectToObject answers with a 302 to a short-lived presigned GET for the
+// object, so the bytes come straight from the bucket. The caller has already
+// checked ownership.
+func redirectToObject(w http.ResponseWriter, r *http.Request, key, filename, contentType string) {
+	ttl := redirectTTL()
+	url, err := config.Storage.Presign(r.Context(), http.MethodGet, key, storage.PresignOptions{
+		TTL:                ttl,
+		ContentType:        objectContentType(contentType, filename),
+		ContentDisposition: contentDisposition(filename),
+	})
+	if err != nil {
+		http.Error(w, "Failed to presign file: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Let the browser reuse the redirect while the URL is still good
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int(ttl.Seconds()/2)))
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+// serveObject streams a stored object to the client, passing Range,
+// If-None-Match and If-Modified-Since through to the storage backend so that
+// revalidations get a 304 and seeks get a 206 without reading the whole
+// object. contentType is the sniffed type recorded for it, if any.
+func serveObject(w http.ResponseWriter, r *http.Request, key, filename, contentType, cacheControl string) {
+	opts := storage.GetOptions{
+		Range:       r.Header.Get("Range"),
+		IfNoneMatch: r.Header.Get("If-None-Match"),
+	}
+	if t, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil {
+		opts.IfModifiedSince = t
+	}
+	if r.Method == http.MethodHead {
+		opts.Range = ""
+	}
+
+	body, obj, err := config.Storage.GetRange(r.Context(), key, opts)
+	if err == nil && opts.Range != "" && !ifRangeMatches(r.Header.Get("If-Range"), obj) {
+		// The client's partial copy is stale, so send the whole object
+		body.Close()
+		opts.Range = ""
+		body, obj, err = config.Storage.GetRange(r.Context(), key, opts)
+	}
+
+	w.Header().Set("Cache-Control", cacheControl)
+	switch {
+	case errors.Is(err, storage.ErrNotModified):
+		// ETag and Last-Modified are only known from a full read, so the
+		// client keeps using the validators it sent
+		if opts.IfNoneMatch != "" && opts.IfNoneMatch != "*" && !strings.Contains(opts.IfNoneMatch, ",") {
+			w.Header().Set("ETag", opts.IfNoneMatch)
+		}
+		w.WriteHeader(http.StatusNotModified)
+		return
+	case errors.Is(err, storage.ErrInvalidRange):
+		if head, err := config.Storage.Head(r.Context(), key); err == nil {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", head.Size))
+		}
+		http.Error(w, "Requested range not satisfiable", http.StatusRequestedRangeNotSatisfiable)
+		return
+	case errors.Is(err, storage.ErrNotFound):
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, "Failed to retrieve file: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer body.Close()
+
+	h := w.Header()
+	if contentType == "" {
+		contentType = obj.ContentType
+	}
+	h.Set("Content-Type", objectContentType(contentType, filename))
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Content-Disposition", contentDisposition(filename))
+	h.Set("Accept-Ranges", "bytes")
+	h.Set("Content-Length", strconv.FormatInt(obj.Size, 10))
+	if obj.ETag != "" {
+		h.Set("ETag", obj.ETag)
+	}
+	if !obj.LastModified.IsZero() {
+		h.Set("Last-Modified", obj.LastModified.UTC().Format(http.TimeFormat))
+	}
+
+	status := http.StatusOK
+	if obj.ContentRange != "" {
+		h.Set("Content-Range", obj.ContentRange)
+		status = http.StatusPartialContent
+	}
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		// Headers are gone already, all we can do is note it
+		log.Printf("Failed to stream %s: %v", key, err)
+	}
+}
+
+// ifRangeMatches reports whether a ranged read may stand given the request's
+// If-Range validator, which is either a strong ETag or an HTTP date.
+func ifRangeMatches(ifRange string, obj *storage.Object) bool {
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, "\"") {
+		return ifRange == obj.ETag
+	}
+	t, err := http.ParseTime(ifRange)
+	return err == nil && !obj.LastModified.IsZero() && obj.LastModified.Truncate(time.Second).Equal(t)
+}
+
+// objectContentType falls back on the filename's extension when the object
+// was stored without a useful type. Types outside the upload allowlist are
+// never served as such, so files stored before sniffing can't render as a
+// page.
+func objectContentType(stored, filename string) string {
+	if services.IsAllowedType(stored) {
+		return stored
+	}
+	if t := mime.TypeByExtension(path.Ext(filename)); services.IsAllowedType(t) {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// contentDisposition shows the object inline under its original filename.
+func contentDisposition(filename string) string {
+	if d := mime.FormatMediaType("inline", map[string]string{"filename": filename}); d != "" {
+		return d
+	}
+	return "inline"
+}
@@ -9,15 +9,22 @@ import (
 
 	"photovault/config"
 	"photovault/models"
+	"photovault/services"
 	"photovault/utils"
 )
 
 type SetReleaseTimeRequest struct {
+	// UnlockDate is a local date and time such as 2026-05-04T09:00, read in
+	// TimeZone, or an RFC3339 instant
 	UnlockDate string `json:"release_time"`
+	// TimeZone, if set, becomes the vault's own IANA time zone
+	TimeZone string `json:"time_zone"`
 }
 
 type GetReleaseTimeResponse struct {
-	UnlockDate *time.Time `json:"release_time"`
+	UnlockDate      *time.Time `json:"release_time"` // UTC
+	UnlockDateLocal *string    `json:"release_time_local"`
+	TimeZone        string     `json:"time_zone"`
 }
 
 func SetVaultReleaseTimeHandler(w http.ResponseWriter, r *http.Request) {
@@ -51,20 +58,50 @@ func SetVaultReleaseTimeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	releaseTime, err := time.Parse(time.RFC3339, req.UnlockDate)
+	var owner models.User
+	if err := config.DB.First(&owner, vault.UserID).Error; err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if req.TimeZone != "" {
+		if _, err := services.LoadTimeZone(req.TimeZone); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		vault.TimeZone = &req.TimeZone
+	}
+
+	releaseTime, err := services.ParseUnlockTime(req.UnlockDate, services.VaultTimeZone(&vault, &owner))
 	if err != nil {
-		http.Error(w, "Invalid time format (expected RFC3339)", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !releaseTime.After(time.Now()) {
+		http.Error(w, services.ErrUnlockInPast.Error(), http.StatusBadRequest)
+		return
+	}
+	releaseTime = releaseTime.UTC()
+
+	if err := services.CheckUnlockDate(&vault, releaseTime); err != nil {
+		http.Error(w, err.Error(), transitionStatus(err))
 		return
 	}
 
 	vault.UnlockDate = &releaseTime
+	if vault.Recurrence != "" {
+		// A new date restarts the series from it
+		vault.RecurrenceStart = &releaseTime
+	}
 	if err := config.DB.Save(&vault).Error; err != nil {
 		http.Error(w, "Failed to update vault", http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"message": "Release time set successfully"})
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":      "Release time set successfully",
+		"release_time": releaseResponse(&vault, &owner),
+	})
 }
 
 func GetVaultReleaseTimeHandler(w http.ResponseWriter, r *http.Request) {
@@ -92,10 +129,60 @@ func GetVaultReleaseTimeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	res := GetReleaseTimeResponse{
-		UnlockDate: vault.UnlockDate,
+	var owner models.User
+	if err := config.DB.First(&owner, vault.UserID).Error; err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(releaseResponse(&vault, &owner))
+}
+
+// UserTimeZoneHandler sets the IANA time zone a user's unlock times are
+// entered and shown in, for vaults without one of their own. Unlock times
+// already set keep the instant they name.
+func UserTimeZoneHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPatch {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userId, _, err := utils.GetUserFromToken(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var input struct {
+		TimeZone string `json:"time_zone"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	loc, err := services.LoadTimeZone(input.TimeZone)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := config.DB.Model(&models.User{}).Where("id = ?", userId).Update("time_zone", loc.String()).Error; err != nil {
+		http.Error(w, "Failed to update user", http.StatusInternalServerError)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(res)
+	json.NewEncoder(w).Encode(map[string]string{"time_zone": loc.String()})
+}
+
+func releaseResponse(vault *models.Vault, owner *models.User) GetReleaseTimeResponse {
+	loc := services.VaultTimeZone(vault, owner)
+	res := GetReleaseTimeResponse{TimeZone: loc.String()}
+	if vault.UnlockDate != nil {
+		utc := vault.UnlockDate.UTC()
+		local := vault.UnlockDate.In(loc).Format(time.RFC3339)
+		res.UnlockDate, res.UnlockDateLocal = &utc, &local
+	}
+	return res
 }
@@ -0,0 +1,141 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"photovault/config"
+	"photovault/models"
+	"photovault/services"
+	"photovault/utils"
+)
+
+type MetadataResponse struct {
+	CapturedAt  *time.Time `json:"captured_at"`
+	CameraMake  string     `json:"camera_make,omitempty"`
+	CameraModel string     `json:"camera_model,omitempty"`
+	Orientation int        `json:"orientation"`
+	Width       int        `json:"width,omitempty"`
+	Height      int        `json:"height,omitempty"`
+	Latitude    *float64   `json:"latitude,omitempty"`
+	Longitude   *float64   `json:"longitude,omitempty"`
+	DurationMs  int64      `json:"duration_ms,omitempty"`
+}
+
+// TimelineMonth is one month of a vault's timeline. Uploads are dated by
+// when they were taken, or by when they were uploaded if that is unknown.
+type TimelineMonth struct {
+	Year    int              `json:"year"`
+	Month   int              `json:"month"`
+	Count   int              `json:"count"`
+	Uploads []UploadResponse `json:"uploads"`
+}
+
+// TimelineHandler lists a vault's uploads oldest first, grouped by the year
+// and month they were taken.
+func TimelineHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	vaultIdStr := strings.TrimPrefix(r.URL.Path, "/images/timeline/")
+	vaultId, err := strconv.ParseUint(vaultIdStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid vault ID", http.StatusBadRequest)
+		return
+	}
+
+	userId, _, err := utils.GetUserFromToken(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var vault models.Vault
+	if err := config.DB.First(&vault, vaultId).Error; err != nil || vault.UserID != userId {
+		http.Error(w, "Vault not found or forbidden", http.StatusForbidden)
+		return
+	}
+	if sealed(w, &vault, services.AccessView) {
+		return
+	}
+
+	uploads := []models.Upload{}
+	err = config.DB.
+		Joins("LEFT JOIN upload_metadata ON upload_metadata.upload_id = uploads.id").
+		Where("uploads.vault_id = ? AND uploads.deleted_at IS NULL AND uploads.pending = ?", vaultId, false).
+		Order("COALESCE(upload_metadata.captured_at, uploads.upload_time), uploads.id").
+		Find(&uploads).Error
+	if err != nil {
+		http.Error(w, "Failed to retrieve uploads", http.StatusInternalServerError)
+		return
+	}
+
+	metadata, err := loadMetadata(uploads)
+	if err != nil {
+		http.Error(w, "Failed to retrieve metadata", http.StatusInternalServerError)
+		return
+	}
+
+	timeline := []TimelineMonth{}
+	for _, u := range uploads {
+		meta := metadata[u.ID]
+		taken := u.UploadTime
+		if meta != nil && meta.CapturedAt != nil {
+			taken = *meta.CapturedAt
+		}
+
+		if n := len(timeline); n == 0 || timeline[n-1].Year != taken.Year() || timeline[n-1].Month != int(taken.Month()) {
+			timeline = append(timeline, TimelineMonth{Year: taken.Year(), Month: int(taken.Month())})
+		}
+		month := &timeline[len(timeline)-1]
+		month.Count++
+		month.Uploads = append(month.Uploads, uploadResponse(u, meta))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(timeline)
+}
+
+// loadMetadata fetches the metadata rows of the given uploads, keyed by
+// upload ID.
+func loadMetadata(uploads []models.Upload) (map[uint]*models.UploadMetadata, error) {
+	ids := make([]uint, 0, len(uploads))
+	for _, u := range uploads {
+		ids = append(ids, u.ID)
+	}
+	byUpload := make(map[uint]*models.UploadMetadata, len(ids))
+	if len(ids) == 0 {
+		return byUpload, nil
+	}
+
+	var rows []models.UploadMetadata
+	if err := config.DB.Where("upload_id IN ?", ids).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	for i := range rows {
+		byUpload[rows[i].UploadID] = &rows[i]
+	}
+	return byUpload, nil
+}
+
+func metadataResponse(m *models.UploadMetadata) *MetadataResponse {
+	if m == nil {
+		return nil
+	}
+	return &MetadataResponse{
+		CapturedAt:  m.CapturedAt,
+		CameraMake:  m.CameraMake,
+		CameraModel: m.CameraModel,
+		Orientation: m.Orientation,
+		Width:       m.Width,
+		Height:      m.Height,
+		Latitude:    m.Latitude,
+		Longitude:   m.Longitude,
+		DurationMs:  m.DurationMs,
+	}
+}
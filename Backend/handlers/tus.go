@@ -0,0 +1,470 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"photovault/config"
+	"photovault/models"
+	"photovault/services"
+	"photovault/storage"
+	"photovault/utils"
+)
+
+// Resumable uploads follow the tus 1.0.0 protocol (https://tus.io) with the
+// creation, expiration and termination extensions:
+//
+//	OPTIONS /upload/...              discovery, see TusOptionsHandler
+//	POST    /upload/{vaultId}        create, returns Location
+//	HEAD    /upload/{vaultId}/{id}   current offset
+//	PATCH   /upload/{vaultId}/{id}   append bytes at Upload-Offset
+//	DELETE  /upload/{vaultId}/{id}   abandon the upload
+//
+// Bytes are forwarded to a multipart upload in storage as soon as a full
+// part is available; a shorter tail is parked under services.TusPendingKey
+// until the next PATCH.
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,expiration,termination"
+	tusUploadTTL  = 24 * time.Hour
+)
+
+var errStorageLimit = errors.New("storage limit exceeded")
+
+// errTusConflict is returned when another PATCH of the same upload moved it
+// on first, such as a client retrying a request that is still running.
+var errTusConflict = errors.New("Upload-Offset does not match")
+
+// TusOptionsHandler answers OPTIONS on /upload/ with what the server
+// supports, for tus clients discovering it and for browsers' preflights
+// alike. Tus-Max-Size is the caller's plan limit, or the largest plan's for
+// anonymous requests.
+func TusOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	var maxSize int64
+	if userId, _, err := utils.GetUserFromToken(r); err == nil {
+		var user models.User
+		if err := config.DB.First(&user, userId).Error; err == nil {
+			maxSize = utils.PlanLimits[user.PlanType].MaxStorage
+		}
+	}
+	if maxSize == 0 {
+		for _, plan := range utils.PlanLimits {
+			if plan.MaxStorage > maxSize {
+				maxSize = plan.MaxStorage
+			}
+		}
+	}
+
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(maxSize, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func TusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+
+	userId, _, err := utils.GetUserFromToken(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	segments := strings.Split(strings.TrimPrefix(r.URL.Path, "/upload/"), "/")
+	vaultId, err := strconv.ParseUint(segments[0], 10, 64)
+	if err != nil || len(segments) > 2 {
+		http.Error(w, "Invalid vault ID", http.StatusBadRequest)
+		return
+	}
+
+	var vault models.Vault
+	if err := config.DB.First(&vault, vaultId).Error; err != nil || vault.UserID != userId {
+		http.Error(w, "Vault not found or forbidden", http.StatusForbidden)
+		return
+	}
+	if (r.Method == http.MethodPost || r.Method == http.MethodPatch) && sealed(w, &vault, services.AccessModify) {
+		return
+	}
+
+	if len(segments) == 1 {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		tusCreate(w, r, &vault)
+		return
+	}
+
+	var upload models.TusUpload
+	if err := config.DB.Where("id = ? AND vault_id = ? AND user_id = ?", segments[1], vault.ID, userId).First(&upload).Error; err != nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+		w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPatch:
+		tusPatch(w, r, &vault, &upload)
+	case http.MethodDelete:
+		tusTerminate(w, r, &upload)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func tusCreate(w http.ResponseWriter, r *http.Request, vault *models.Vault) {
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		http.Error(w, "Upload-Defer-Length is not supported", http.StatusBadRequest)
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+
+	metadata := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	filename := metadata["filename"]
+	if filename == "" {
+		filename = metadata["name"]
+	}
+	if filename == "" {
+		http.Error(w, "Upload-Metadata must include a filename", http.StatusBadRequest)
+		return
+	}
+	// The bytes are checked again once they have all arrived
+	if t := metadata["filetype"]; t != "" && !services.IsAllowedType(t) {
+		http.Error(w, "Unsupported file type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var user models.User
+	if err := config.DB.First(&user, vault.UserID).Error; err != nil {
+		http.Error(w, "User not found", http.StatusInternalServerError)
+		return
+	}
+	reserved, err := reservedStorage(user.ID)
+	if err != nil {
+		http.Error(w, "Failed to check storage", http.StatusInternalServerError)
+		return
+	}
+	if user.TotalStorageUsed+reserved+length > utils.PlanLimits[user.PlanType].MaxStorage {
+		http.Error(w, "storage limit exceeded", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if services.IsVideoType(metadata["filetype"]) && length > utils.VideoLimits[user.PlanType].MaxSize {
+		http.Error(w, errVideoTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	id, err := utils.GenerateToken(16)
+	if err != nil {
+		http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+	upload := models.TusUpload{
+		ID:          id,
+		VaultID:     vault.ID,
+		UserID:      vault.UserID,
+		Filename:    filename,
+		ContentType: metadata["filetype"],
+		Key:         fmt.Sprintf("vaults/%d/uploads/tus-%s_%s", vault.ID, id, safeFilename(filename)),
+		Length:      length,
+		ExpiresAt:   time.Now().Add(tusUploadTTL),
+	}
+
+	upload.MultipartID, err = config.Storage.CreateMultipart(r.Context(), upload.Key, upload.ContentType)
+	if err != nil {
+		http.Error(w, "Failed to start upload: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := config.DB.Create(&upload).Error; err != nil {
+		config.Storage.AbortMultipart(r.Context(), upload.Key, upload.MultipartID)
+		http.Error(w, "Failed to log upload", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/upload/%d/%s", vault.ID, upload.ID))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func tusPatch(w http.ResponseWriter, r *http.Request, vault *models.Vault, upload *models.TusUpload) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+	if offset != upload.Offset {
+		http.Error(w, "Upload-Offset does not match", http.StatusConflict)
+		return
+	}
+	if upload.UploadID == nil && time.Now().After(upload.ExpiresAt) {
+		http.Error(w, "Upload expired", http.StatusGone)
+		return
+	}
+
+	if upload.UploadID == nil {
+		if err := tusReceive(r, upload); errors.Is(err, errTusConflict) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			log.Printf("Resumable upload %s stopped at %d/%d bytes: %v", upload.ID, upload.Offset, upload.Length, err)
+			http.Error(w, "Failed to store upload: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if upload.Offset == upload.Length {
+			if err := tusComplete(r, vault, upload); errors.Is(err, errStorageLimit) {
+				http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			} else if errors.Is(err, errTusConflict) {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			} else if errors.Is(err, services.ErrCannotSanitize) {
+				http.Error(w, "Privacy mode can't remove the metadata of this file", http.StatusUnsupportedMediaType)
+				return
+			} else if status := videoLimitStatus(err); status != 0 {
+				http.Error(w, err.Error(), status)
+				return
+			} else if err != nil {
+				http.Error(w, "Failed to finish upload: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tusReceive streams the request body into multipart parts, saving progress
+// after every part so a dropped connection only loses the bytes in flight.
+func tusReceive(r *http.Request, upload *models.TusUpload) error {
+	// Keep storing what arrived even if the client hangs up mid-request
+	ctx := context.WithoutCancel(r.Context())
+
+	var stored int64
+	for _, p := range upload.Parts {
+		stored += p.Size
+	}
+
+	src := io.LimitReader(r.Body, upload.Length-upload.Offset)
+	if upload.Offset > stored {
+		tail, _, err := config.Storage.Get(ctx, services.TusPendingKey(upload.ID))
+		if err != nil {
+			return fmt.Errorf("failed to load pending bytes: %w", err)
+		}
+		defer tail.Close()
+		src = io.MultiReader(tail, src)
+	}
+
+	buf := make([]byte, storage.MinPartSize)
+	for {
+		n, readErr := io.ReadFull(src, buf)
+		if n == 0 {
+			break
+		}
+
+		end := stored + int64(n)
+		if n == len(buf) || end == upload.Length {
+			part, err := config.Storage.UploadPart(ctx, upload.Key, upload.MultipartID, int32(len(upload.Parts)+1), bytes.NewReader(buf[:n]), int64(n))
+			if err != nil {
+				return err
+			}
+			upload.Parts = append(upload.Parts, part)
+			stored = end
+		} else if err := config.Storage.Put(ctx, services.TusPendingKey(upload.ID), bytes.NewReader(buf[:n]), int64(n), ""); err != nil {
+			return err
+		}
+
+		// Only move on from the offset this request started at, so of two
+		// PATCHes racing from the same offset just one is recorded
+		from := upload.Offset
+		upload.Offset = end
+		upload.ExpiresAt = time.Now().Add(tusUploadTTL)
+		result := config.DB.Model(upload).Where("upload_offset = ?", from).Select("upload_offset", "parts", "expires_at").Updates(upload)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errTusConflict
+		}
+		if readErr != nil {
+			break
+		}
+	}
+
+	if upload.Offset == stored {
+		config.Storage.Delete(ctx, services.TusPendingKey(upload.ID))
+	}
+	return nil
+}
+
+// tusComplete assembles the object and records it as a regular upload.
+func tusComplete(r *http.Request, vault *models.Vault, upload *models.TusUpload) error {
+	ctx := context.WithoutCancel(r.Context())
+
+	if !upload.Assembled {
+		if err := config.Storage.CompleteMultipart(ctx, upload.Key, upload.MultipartID, upload.Parts); err != nil {
+			// A completion whose reply got lost has left the object in place
+			if obj, herr := config.Storage.Head(ctx, upload.Key); herr != nil || obj.Size != upload.Length {
+				return err
+			}
+		}
+		upload.Assembled = true
+		if err := config.DB.Model(upload).Update("assembled", true).Error; err != nil {
+			return err
+		}
+	}
+	contentType, err := services.SniffObject(ctx, upload.Key)
+	if errors.Is(err, services.ErrUnsupportedType) {
+		config.DB.Delete(upload)
+		services.DeleteObjects(upload.Key)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	var user models.User
+	if err := config.DB.First(&user, vault.UserID).Error; err != nil {
+		return errors.New("user not found")
+	}
+	if services.IsVideoType(contentType) {
+		if err := checkVideo(ctx, upload.Key, upload.Length, utils.VideoLimits[user.PlanType]); err != nil {
+			if videoLimitStatus(err) != 0 {
+				config.DB.Delete(upload)
+				services.DeleteObjects(upload.Key)
+			}
+			return err
+		}
+	}
+
+	private := services.PrivacyFor(&user, vault)
+	stagedKey, size := upload.Key, upload.Length
+	var sum string
+	if private {
+		stagedKey, size, sum, err = services.SanitizeObject(ctx, upload.Key)
+		if errors.Is(err, services.ErrCannotSanitize) {
+			// The original can't be kept in its place
+			config.DB.Delete(upload)
+			services.DeleteObjects(upload.Key)
+		}
+		if err != nil {
+			return err
+		}
+		defer services.DeleteObjects(stagedKey)
+	} else if sum, err = storage.HashObject(ctx, config.Storage, upload.Key); err != nil {
+		return err
+	}
+
+	limit := utils.PlanLimits[user.PlanType].MaxStorage - user.TotalStorageUsed
+
+	var row models.Upload
+	err = config.DB.Transaction(func(tx *gorm.DB) error {
+		row = models.Upload{
+			VaultID:     vault.ID,
+			Filename:    upload.Filename,
+			Size:        size,
+			Key:         stagedKey,
+			ContentHash: sum,
+			ContentType: contentType,
+			OrderIndex:  nextOrderIndex(tx, vault.ID),
+		}
+		if err := tx.Create(&row).Error; err != nil {
+			return err
+		}
+		if _, err := services.CommitUpload(ctx, tx, vault, &row, stagedKey, limit); err != nil {
+			return err
+		}
+		upload.UploadID = &row.ID
+		result := tx.Model(upload).Where("upload_id IS NULL").Update("upload_id", row.ID)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			// A retried final PATCH finished it first
+			return errTusConflict
+		}
+		log.Printf("Uploaded %s", upload.Filename)
+		return nil
+	})
+	if errors.Is(err, storage.ErrTooLarge) {
+		config.DB.Delete(upload)
+		services.DeleteObjects(upload.Key)
+		return errStorageLimit
+	}
+	if err != nil {
+		return err
+	}
+
+	// The assembled object now lives on as a blob
+	services.DeleteObjects(upload.Key)
+	services.ProcessUpload(row, private)
+	return nil
+}
+
+func tusTerminate(w http.ResponseWriter, r *http.Request, upload *models.TusUpload) {
+	if upload.UploadID == nil && upload.Assembled {
+		services.DeleteObjects(upload.Key)
+	} else if upload.UploadID == nil {
+		if err := config.Storage.AbortMultipart(r.Context(), upload.Key, upload.MultipartID); err != nil {
+			http.Error(w, "Failed to abort upload: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		services.DeleteObjects(services.TusPendingKey(upload.ID))
+	}
+	if err := config.DB.Delete(upload).Error; err != nil {
+		http.Error(w, "Failed to delete upload", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseTusMetadata decodes "key base64value,key2 base64value2".
+func parseTusMetadata(header string) map[string]string {
+	metadata := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) == 0 {
+			continue
+		}
+		value := ""
+		if len(fields) > 1 {
+			decoded, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				continue
+			}
+			value = string(decoded)
+		}
+		metadata[fields[0]] = value
+	}
+	return metadata
+}
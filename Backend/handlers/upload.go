@@ -11,22 +11,39 @@ import (
 	"fmt"
 	"gorm.io/gorm"
 	"errors"
-	"bytes"
 	"context"
-	"sync"
 	"mime/multipart"
+	"path"
 
 	"photovault/config"
 	"photovault/models"
+	"photovault/services"
+	"photovault/storage"
 	"photovault/utils"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/aws/aws-sdk-go-v2/aws"
 )
 
 type UploadResponse struct {
 	ID       uint   `json:"id"`
 	Filename string `json:"filename"`
 	URL      string `json:"url"`
+	// ContentType is the sniffed type, empty for files stored before sniffing
+	ContentType string `json:"content_type"`
+	// OriginalURL downloads the file as uploaded when URL shows a display
+	// copy of it instead
+	OriginalURL string `json:"original_url,omitempty"`
+	// PosterURL is a still of a video for the grid; its renditions are
+	// stills too
+	PosterURL string `json:"poster_url,omitempty"`
+	// Renditions maps each rendition size to its URL, for grids and previews
+	Renditions map[int]string `json:"renditions"`
+	// Edits are already applied to URL and the renditions
+	Edits *models.ImageEdits `json:"edits,omitempty"`
+	// BlurHash and DominantColor let clients draw a placeholder before any
+	// image bytes arrive; empty until the upload has been processed
+	BlurHash      string `json:"blurhash,omitempty"`
+	DominantColor string `json:"dominant_color,omitempty"`
+	// Metadata is nil until the upload has been read after storing
+	Metadata *MetadataResponse `json:"metadata"`
 }
 
 type OrderUpdate struct {
@@ -35,8 +52,9 @@ type OrderUpdate struct {
 }
 
 func UploadHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodOptions {
-		w.WriteHeader(http.StatusOK)
+	// Resumable uploads share the /upload/ prefix
+	if r.Header.Get("Tus-Resumable") != "" {
+		TusHandler(w, r)
 		return
 	}
 	if r.Method != http.MethodPost {
@@ -44,11 +62,6 @@ func UploadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := r.ParseMultipartForm(50 << 20); err != nil { // 50MB max form
-		http.Error(w, "Error parsing form: "+err.Error(), http.StatusBadRequest)
-		return
-	}
-
 	// Parse vault ID from URL
 	vaultIdStr := strings.TrimPrefix(r.URL.Path, "/upload/")
 	vaultId, err := strconv.ParseUint(vaultIdStr, 10, 64)
@@ -75,102 +88,67 @@ func UploadHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Vault not found or forbidden", http.StatusForbidden)
 		return
 	}
+	if sealed(w, &vault, services.AccessModify) {
+		return
+	}
 
-	files := r.MultipartForm.File["images"]
-	if len(files) == 0 {
-		http.Error(w, "No files uploaded", http.StatusBadRequest)
+	// Read the form part by part instead of parsing it up front, so file
+	// bytes go straight from the connection to storage
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Error parsing form: "+err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	reserved, err := reservedStorage(user.ID)
+	if err != nil {
+		http.Error(w, "Failed to check storage", http.StatusInternalServerError)
+		return
+	}
 	plan := utils.PlanLimits[user.PlanType]
-	var wg sync.WaitGroup
-	errCh := make(chan error, len(files))
-
-	// Upload each file concurrently
-	for _, handler := range files {
-		wg.Add(1)
-		go func(h *multipart.FileHeader) {
-			defer wg.Done()
-
-			// Storage limit check
-			if user.TotalStorageUsed+h.Size > plan.MaxStorage {
-				errCh <- fmt.Errorf("storage limit exceeded")
-				return
-			}
-
-			// Open file
-			file, err := h.Open()
-			if err != nil {
-				errCh <- fmt.Errorf("error opening file: %w", err)
-				return
-			}
-			defer file.Close()
-
-			// Copy into memory
-			buf := new(bytes.Buffer)
-			if _, err := io.Copy(buf, file); err != nil {
-				errCh <- fmt.Errorf("failed to read file: %w", err)
-				return
-			}
-
-			// Find order index
-			var maxIndex int
-			config.DB.Model(&models.Upload{}).
-				Where("vault_id = ?", vaultId).
-				Select("COALESCE(MAX(order_index), 0)").Scan(&maxIndex)
-
-			// Insert with a temporary unique key
-			tempKey := fmt.Sprintf("pending-%d", time.Now().UnixNano())
-			upload := models.Upload{
-				VaultID:    uint(vaultId),
-				Filename:   h.Filename,
-				OrderIndex: maxIndex + 1,
-				Size:       h.Size,
-				Key:        tempKey,
-			}
-			if err := config.DB.Create(&upload).Error; err != nil {
-				errCh <- fmt.Errorf("failed to log upload: %w", err)
-				return
-			}
-
-			// Upload to R2 with the real key
-			safeFilename := strings.ReplaceAll(h.Filename, " ", "_")
-			realKey := fmt.Sprintf("vaults/%d/uploads/%d_%s", vaultId, upload.ID, safeFilename)
-
-			_, err = config.R2Client.PutObject(context.TODO(), &s3.PutObjectInput{
-				Bucket: &config.R2Bucket,
-				Key:    &realKey,
-				Body:   bytes.NewReader(buf.Bytes()),
-			})
-			if err != nil {
-				config.DB.Delete(&upload)
-				errCh <- fmt.Errorf("failed to upload to storage: %w", err)
-				return
-			}
-
-			// Update with real key
-			upload.Key = realKey
-			if err := config.DB.Save(&upload).Error; err != nil {
-				errCh <- fmt.Errorf("failed to update upload key: %w", err)
-				return
-			}
-
-			// Update storage atomically
-			config.DB.Model(&user).UpdateColumn("total_storage_used", gorm.Expr("total_storage_used + ?", h.Size))
-			config.DB.Model(&vault).UpdateColumn("total_storage_used", gorm.Expr("total_storage_used + ?", h.Size))
-
-			log.Printf("Uploaded %s", h.Filename)
-		}(handler)
-	}
-
-	wg.Wait()
-	close(errCh)
-
-	for err := range errCh {
+	remaining := plan.MaxStorage - user.TotalStorageUsed - reserved
+	private := services.PrivacyFor(&user, &vault)
+
+	uploaded := 0
+	for {
+		part, err := nextFilePart(reader, "images")
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, "Error parsing form: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		charged, err := streamUpload(r.Context(), &vault, part, plan.MaxStorage, remaining, utils.VideoLimits[user.PlanType], private)
+		part.Close()
+		if errors.Is(err, storage.ErrTooLarge) {
+			http.Error(w, "storage limit exceeded", http.StatusForbidden)
+			return
+		}
+		if errors.Is(err, services.ErrUnsupportedType) {
+			http.Error(w, "Unsupported file type: "+part.FileName(), http.StatusUnsupportedMediaType)
+			return
+		}
+		if errors.Is(err, services.ErrCannotSanitize) {
+			http.Error(w, "Privacy mode can't remove the metadata of "+part.FileName(), http.StatusUnsupportedMediaType)
+			return
+		}
+		if status := videoLimitStatus(err); status != 0 {
+			http.Error(w, err.Error()+": "+part.FileName(), status)
+			return
+		}
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		remaining -= charged
+		uploaded++
+	}
+
+	if uploaded == 0 {
+		http.Error(w, "No files uploaded", http.StatusBadRequest)
+		return
 	}
 
 	// Success
@@ -179,6 +157,141 @@ func UploadHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 
+// uploadSlots is the worker pool shared by every streaming upload: a file is
+// only sent to storage while it holds a slot, which caps the part buffers in
+// use across the whole server.
+var uploadSlots = make(chan struct{}, uploadWorkers())
+
+func uploadWorkers() int {
+	n, err := strconv.Atoi(config.GetEnv("UPLOAD_WORKERS", "4"))
+	if err != nil || n < 1 {
+		return 4
+	}
+	return n
+}
+
+// streamUpload copies one file from the form into storage, hashing it on the
+// way, and records it as an upload of the blob with that content. maxSize
+// bounds the file itself; limit bounds what the owner is charged, which is
+// nothing when they already have the same content, and videos are held to
+// the plan's video limits as well. With private set the file is sanitized on
+// its way in. It returns the charge.
+func streamUpload(ctx context.Context, vault *models.Vault, part *multipart.Part, maxSize, limit int64, video utils.VideoLimit, private bool) (int64, error) {
+	select {
+	case uploadSlots <- struct{}{}:
+		defer func() { <-uploadSlots }()
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+
+	// Trust the bytes, not the filename or the part's Content-Type
+	contentType, body, err := services.SniffReader(part)
+	if err != nil {
+		return 0, err
+	}
+	isVideo := services.IsVideoType(contentType)
+	if isVideo && video.MaxSize < maxSize {
+		maxSize = video.MaxSize
+	}
+
+	// Insert with a temporary unique key
+	upload := models.Upload{
+		VaultID:     vault.ID,
+		Filename:    part.FileName(),
+		Key:         fmt.Sprintf("pending-%d", time.Now().UnixNano()),
+		ContentType: contentType,
+		Pending:     true,
+	}
+	if err := config.DB.Create(&upload).Error; err != nil {
+		return 0, fmt.Errorf("failed to log upload: %w", err)
+	}
+
+	// Stage the object under the upload's own key until its hash is known
+	if private {
+		clean := services.SanitizingReader(body)
+		defer clean.Close()
+		body = clean
+	}
+	stagedKey := uploadKey(upload.VaultID, upload.ID, upload.Filename)
+	size, sum, err := storage.PutHashed(ctx, config.Storage, stagedKey, body, maxSize, contentType)
+	if err != nil {
+		config.DB.Delete(&upload)
+		if errors.Is(err, storage.ErrTooLarge) && isVideo && maxSize == video.MaxSize {
+			return 0, errVideoTooLarge
+		}
+		if errors.Is(err, storage.ErrTooLarge) {
+			return 0, err
+		}
+		return 0, fmt.Errorf("failed to upload to storage: %w", err)
+	}
+	defer services.DeleteObjects(stagedKey)
+
+	if isVideo {
+		if err := checkVideo(ctx, stagedKey, size, video); err != nil {
+			config.DB.Delete(&upload)
+			return 0, err
+		}
+	}
+
+	upload.Size = size
+	upload.ContentHash = sum
+	var charged int64
+	err = config.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&upload).Updates(map[string]interface{}{
+			"size":         size,
+			"content_hash": sum,
+			"pending":      false,
+			"order_index":  nextOrderIndex(tx, vault.ID),
+		}).Error; err != nil {
+			return err
+		}
+		charged, err = services.CommitUpload(ctx, tx, vault, &upload, stagedKey, limit)
+		return err
+	})
+	if err != nil {
+		config.DB.Delete(&upload)
+		if errors.Is(err, storage.ErrTooLarge) {
+			return 0, err
+		}
+		return 0, fmt.Errorf("failed to update upload key: %w", err)
+	}
+
+	log.Printf("Uploaded %s", upload.Filename)
+	services.ProcessUpload(upload, private)
+	return charged, nil
+}
+
+// nextFilePart skips ahead to the next file in the form field name.
+func nextFilePart(reader *multipart.Reader, name string) (*multipart.Part, error) {
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == name && part.FileName() != "" {
+			return part, nil
+		}
+		part.Close()
+	}
+}
+
+// uploadKey is where an upload's object lives in storage.
+func uploadKey(vaultID, uploadID uint, filename string) string {
+	return fmt.Sprintf("vaults/%d/uploads/%d_%s", vaultID, uploadID, safeFilename(filename))
+}
+
+func safeFilename(filename string) string {
+	return strings.ReplaceAll(path.Base(filename), " ", "_")
+}
+
+func nextOrderIndex(tx *gorm.DB, vaultID uint) int {
+	var maxIndex int
+	tx.Model(&models.Upload{}).
+		Where("vault_id = ?", vaultID).
+		Select("COALESCE(MAX(order_index), 0)").Scan(&maxIndex)
+	return maxIndex + 1
+}
+
 func ImagesHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -203,25 +316,105 @@ func ImagesHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Vault not found or forbidden", http.StatusForbidden)
 		return
 	}
+	if sealed(w, &vault, services.AccessView) {
+		return
+	}
 
 	uploads := []models.Upload{}
-	if err := config.DB.Where("vault_id = ? AND deleted_at IS NULL", vaultId).Find(&uploads).Error; err != nil {
+	if err := config.DB.Where("vault_id = ? AND deleted_at IS NULL AND pending = ?", vaultId, false).Find(&uploads).Error; err != nil {
 		http.Error(w, "Failed to retrieve uploads", http.StatusInternalServerError)
 		return
 	}
 
+	metadata, err := loadMetadata(uploads)
+	if err != nil {
+		http.Error(w, "Failed to retrieve metadata", http.StatusInternalServerError)
+		return
+	}
+
 	responses := []UploadResponse{}
-	url := "/image/"
 	for _, u := range uploads {
-		responses = append(responses, UploadResponse{
-			ID:       u.ID,
-			Filename: u.Filename,
-			URL:	  url + strconv.Itoa(int(u.ID)),
-		})
+		responses = append(responses, uploadResponse(u, metadata[u.ID]))
 	}
 	json.NewEncoder(w).Encode(responses)
 }
 
+// renditionURLs lists the ?size= URLs of an upload's renditions.
+func renditionURLs(base string, u models.Upload) map[int]string {
+	urls := make(map[int]string, len(services.RenditionSizes))
+	for _, size := range services.RenditionSizes {
+		urls[size] = versionedURL(u, fmt.Sprintf("%s%d?size=%d", base, u.ID, size))
+	}
+	return urls
+}
+
+// versionedURL tags a URL of an upload with the version it is shown at, so
+// browsers don't keep showing what they cached before an edit, or before
+// privacy mode replaced the file with a sanitized copy.
+func versionedURL(u models.Upload, url string) string {
+	var version string
+	switch {
+	case u.Edits != nil:
+		version = path.Base(services.RenditionSource(&u))
+	case len(u.ContentHash) >= 16:
+		version = u.ContentHash[:16]
+	default:
+		return url
+	}
+	sep := "?"
+	if strings.Contains(url, "?") {
+		sep = "&"
+	}
+	return url + sep + "v=" + version
+}
+
+// originalURL is where an upload can be downloaded as it was uploaded, for
+// files the gallery shows through a display copy or with edits.
+func originalURL(base string, u models.Upload) string {
+	if u.Edits == nil && !services.NeedsDisplayCopy(u.ContentType) {
+		return ""
+	}
+	return versionedURL(u, fmt.Sprintf("%s%d?original=1", base, u.ID))
+}
+
+// posterURL is the full-size poster frame of a video upload.
+func posterURL(base string, u models.Upload) string {
+	if !services.IsVideoType(u.ContentType) {
+		return ""
+	}
+	return versionedURL(u, fmt.Sprintf("%s%d?poster=1", base, u.ID))
+}
+
+// uploadResponse describes an upload to the gallery.
+func uploadResponse(u models.Upload, meta *models.UploadMetadata) UploadResponse {
+	return uploadResponseAt("/image/", u, meta)
+}
+
+// uploadResponseAt is uploadResponse with the upload's URLs under base,
+// for viewers who reach uploads some other way than the owner.
+func uploadResponseAt(base string, u models.Upload, meta *models.UploadMetadata) UploadResponse {
+	resp := UploadResponse{
+		ID:          u.ID,
+		Filename:    u.Filename,
+		URL:         versionedURL(u, base+strconv.Itoa(int(u.ID))),
+		ContentType: u.ContentType,
+		OriginalURL: originalURL(base, u),
+		PosterURL:   posterURL(base, u),
+		Renditions:  renditionURLs(base, u),
+		Edits:       u.Edits,
+		Metadata:    metadataResponse(meta),
+	}
+	if meta != nil {
+		resp.BlurHash, resp.DominantColor = meta.BlurHash, meta.DominantColor
+	}
+	return resp
+}
+
+// jpegFilename names a JPEG rendition after the file it was made from.
+func jpegFilename(filename string) string {
+	return strings.TrimSuffix(filename, path.Ext(filename)) + ".jpg"
+}
+
 func GetImageHandler(w http.ResponseWriter, r *http.Request) {
         // 1. Get the logged-in user
 		userID, _, err := utils.GetUserFromToken(r)
@@ -250,6 +443,13 @@ func GetImageHandler(w http.ResponseWriter, r *http.Request) {
             http.Error(w, "Forbidden", http.StatusForbidden)
             return
         }
+        if sealed(w, &img.Vault, services.AccessView) {
+            return
+        }
+        if img.Pending {
+            http.Error(w, "Not Found", http.StatusNotFound)
+            return
+        }
 
         // if err := config.DB.First(&img, "id = ?", imageID).Error; err != nil {
         //     http.Error(w, "Not Found", http.StatusNotFound)
@@ -262,25 +462,71 @@ func GetImageHandler(w http.ResponseWriter, r *http.Request) {
         //     return
         // }
 
-		resp, err := config.R2Client.GetObject(context.TODO(), &s3.GetObjectInput{
-			Bucket: &config.R2Bucket,
-			Key:    aws.String(img.Key), // fetch from DB
-		})
-		w.Header().Set("Content-Disposition", "inline; filename="+strconv.Quote(img.Filename))
+        // 5. Serve the file, or the version of it the query asks for
+		serveUpload(w, r, &img)
+}
+
+// serveUpload sends an upload to a viewer who may see it: the original, a
+// resized rendition of it with ?size=, a video's poster frame with
+// ?poster=1, or for edited uploads and formats browsers can't show its
+// display copy unless ?original=1 asks for the file as uploaded. The file
+// is streamed, or the client sent to the bucket for it.
+func serveUpload(w http.ResponseWriter, r *http.Request, img *models.Upload) {
+	key, filename, contentType := img.Key, img.Filename, img.ContentType
+	original, _ := strconv.ParseBool(r.URL.Query().Get("original"))
+	poster, _ := strconv.ParseBool(r.URL.Query().Get("poster"))
+	if poster && services.IsVideoType(img.ContentType) {
+		rendition, err := services.EnsureRendition(r.Context(), img.Key, services.DisplaySize)
+		if errors.Is(err, services.ErrNotImage) {
+			http.Error(w, "No poster for this video", http.StatusNotFound)
+			return
+		}
 		if err != nil {
-			http.Error(w, "Failed to retrieve file: "+err.Error(), http.StatusInternalServerError)
+			http.Error(w, "Failed to render poster: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
-
-        // 5. Serve the file
-		if _, err := io.Copy(w, resp.Body); err != nil {
-			http.Error(w, "Failed to stream file: "+err.Error(), http.StatusInternalServerError)
+		key, filename, contentType = rendition.Key, jpegFilename(filename), "image/jpeg"
+	} else if sizeStr := r.URL.Query().Get("size"); sizeStr != "" {
+		size, err := strconv.Atoi(sizeStr)
+		if err != nil || !services.IsRenditionSize(size) {
+			http.Error(w, "Invalid size", http.StatusBadRequest)
+			return
+		}
+		rendition, err := services.EnsureUploadRendition(r.Context(), img, size)
+		if errors.Is(err, services.ErrNotImage) {
+			http.Error(w, "No renditions for this file type", http.StatusUnsupportedMediaType)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to render image: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
+		key, filename, contentType = rendition.Key, jpegFilename(filename), "image/jpeg"
+	} else if !original && (img.Edits != nil || services.NeedsDisplayCopy(img.ContentType)) {
+		rendition, err := services.EnsureUploadRendition(r.Context(), img, services.DisplaySize)
+		if err == nil {
+			key, filename, contentType = rendition.Key, jpegFilename(filename), "image/jpeg"
+		} else if !errors.Is(err, services.ErrNotImage) {
+			log.Printf("Failed to convert upload %d for display: %v", img.ID, err)
+		}
+		// Without a display copy the original is the best there is
+	}
+
+	if wantsRedirect(r) {
+		redirectToObject(w, r, key, filename, contentType)
+		return
+	}
+	serveObject(w, r, key, filename, contentType, imageCacheControl)
 }
 
 
+
 func UpdateOrder(w http.ResponseWriter, r *http.Request) {
+	userId, _, err := utils.GetUserFromToken(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
 
 	var updates []OrderUpdate
 	if err := json.NewDecoder(r.Body).Decode(&updates); err != nil {
@@ -288,6 +534,26 @@ func UpdateOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Every upload must be the user's, in a vault that isn't sealed
+	ids := make([]uint, 0, len(updates))
+	for _, update := range updates {
+		ids = append(ids, update.ID)
+	}
+	var uploads []models.Upload
+	if err := config.DB.Preload("Vault").Where("id IN ?", ids).Find(&uploads).Error; err != nil {
+		http.Error(w, "Failed to update order", http.StatusInternalServerError)
+		return
+	}
+	for _, u := range uploads {
+		if u.Vault.UserID != userId {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if sealed(w, &u.Vault, services.AccessModify) {
+			return
+		}
+	}
+
 	for _, update := range updates {
 		err := config.DB.Model(&models.Upload{}).
 			Where("id = ?", update.ID).
@@ -311,23 +577,15 @@ func TrashUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	idStr := strings.TrimPrefix(r.URL.Path, "/api/upload/trash/")
-	id, err := strconv.Atoi(idStr)
-	if err != nil {
-		http.Error(w, "Invalid upload ID", http.StatusBadRequest)
-		return
-	}
-
-	var upload models.Upload
-	if err := config.DB.First(&upload, id).Error; err != nil {
-		http.Error(w, "Upload not found", http.StatusNotFound)
+	upload, ok := ownedUpload(w, r, "/api/upload/trash/", services.AccessModify)
+	if !ok {
 		return
 	}
 
 	now := time.Now()
 	upload.DeletedAt = &now
 	upload.OrderIndex = -1
-	if err := config.DB.Save(&upload).Error; err != nil {
+	if err := config.DB.Omit("Vault").Save(&upload).Error; err != nil {
 		http.Error(w, "Failed to move to trash", http.StatusInternalServerError)
 		return
 	}
@@ -360,21 +618,25 @@ func TrashHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Vault not found or forbidden", http.StatusForbidden)
 		return
 	}
+	if sealed(w, &vault, services.AccessView) {
+		return
+	}
 
 	uploads := []models.Upload{}
-	if err := config.DB.Where("vault_id = ? AND deleted_at IS NOT NULL", vaultId).Find(&uploads).Error; err != nil {
+	if err := config.DB.Where("vault_id = ? AND deleted_at IS NOT NULL AND pending = ?", vaultId, false).Find(&uploads).Error; err != nil {
 		http.Error(w, "Failed to retrieve uploads", http.StatusInternalServerError)
 		return
 	}
 
+	metadata, err := loadMetadata(uploads)
+	if err != nil {
+		http.Error(w, "Failed to retrieve metadata", http.StatusInternalServerError)
+		return
+	}
+
 	responses := []UploadResponse{}
-	url := "/image/"
 	for _, u := range uploads {
-		responses = append(responses, UploadResponse{
-			ID:       u.ID,
-			Filename: u.Filename,
-			URL:	  url + strconv.Itoa(int(u.ID)),
-		})
+		responses = append(responses, uploadResponse(u, metadata[u.ID]))
 	}
 	json.NewEncoder(w).Encode(responses)
 }
@@ -417,33 +679,12 @@ func TrashDelete(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Forbidden: not your upload", http.StatusForbidden)
 		return
 	}
-	log.Println("HERERERERERERER")
-	log.Println(upload)
-	log.Println(upload.Size)
-	// Decrement user storage
-	user := &upload.Vault.User
-	user.TotalStorageUsed -= upload.Size
-	if user.TotalStorageUsed < 0 {
-		user.TotalStorageUsed = 0
-	}
-	if err := config.DB.Save(user).Error; err != nil {
-		http.Error(w, "Failed to update user storage", http.StatusInternalServerError)
+	if sealed(w, &upload.Vault, services.AccessModify) {
 		return
 	}
-
-	// Decrement vault storage
-	vault := &upload.Vault
-	vault.TotalStorageUsed -= upload.Size
-	if vault.TotalStorageUsed < 0 {
-		vault.TotalStorageUsed = 0
-	}
-	if err := config.DB.Save(vault).Error; err != nil {
-		http.Error(w, "Failed to update vault storage", http.StatusInternalServerError)
-		return
-	}
-
-	// Delete the upload
-	if err := config.DB.Delete(&upload).Error; err != nil {
+	// Delete the upload, refund its storage and remove the stored object
+	// once no other upload shares it
+	if err := services.RemoveUpload(&upload, userID); err != nil {
 		http.Error(w, "Failed to delete upload", http.StatusInternalServerError)
 		return
 	}
@@ -461,29 +702,50 @@ func TrashRecover(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	idStr := strings.TrimPrefix(r.URL.Path, "/images/trash/recover/")
-	id, err := strconv.Atoi(idStr)
-	if err != nil {
-		http.Error(w, "Invalid upload ID", http.StatusBadRequest)
-		return
-	}
-
-	var upload models.Upload
-	if err := config.DB.First(&upload, id).Error; err != nil {
-		http.Error(w, "Upload not found", http.StatusNotFound)
+	upload, ok := ownedUpload(w, r, "/images/trash/recover/", services.AccessModify)
+	if !ok {
 		return
 	}
 
 	var maxIndex int
 	config.DB.Model(&models.Upload{}).
-		Where("vault_id = ?", id).
+		Where("vault_id = ?", upload.VaultID).
 		Select("COALESCE(MAX(order_index), 0)").Scan(&maxIndex)
 	upload.DeletedAt = nil
 	upload.OrderIndex = maxIndex
-	if err := config.DB.Save(&upload).Error; err != nil {
+	if err := config.DB.Omit("Vault").Save(&upload).Error; err != nil {
 		http.Error(w, "Failed to recover", http.StatusInternalServerError)
 		return
 	}
 
 	json.NewEncoder(w).Encode(map[string]string{"message": "Recovered"})
-}
\ No newline at end of file
+}
+
+// ownedUpload loads the upload whose ID follows prefix in the path,
+// answering the request itself if it isn't the caller's or the sealing
+// policy refuses the access.
+func ownedUpload(w http.ResponseWriter, r *http.Request, prefix string, access services.Access) (models.Upload, bool) {
+	var upload models.Upload
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, prefix), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid upload ID", http.StatusBadRequest)
+		return upload, false
+	}
+	userId, _, err := utils.GetUserFromToken(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return upload, false
+	}
+	if err := config.DB.Preload("Vault").First(&upload, id).Error; err != nil || upload.Pending {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return upload, false
+	}
+	if upload.Vault.UserID != userId {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return upload, false
+	}
+	if sealed(w, &upload.Vault, access) {
+		return upload, false
+	}
+	return upload, true
+}
@@ -6,6 +6,7 @@ import (
 
     "photovault/config"
     "photovault/models"
+    "photovault/services"
 	"photovault/utils"
 )
 
@@ -30,6 +31,10 @@ func UserHandler(w http.ResponseWriter, r *http.Request) {
 		"planType":          user.PlanType,
 		"totalStorageUsed":  user.TotalStorageUsed,
 		"isVerified":        user.IsVerified,
+		"privacyMode":       user.PrivacyMode,
+		"capsuleReminders":  user.CapsuleReminders,
+		"reminderDays":      services.ReminderDays(&user),
+		"timeZone":          user.TimeZone,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
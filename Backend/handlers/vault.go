@@ -3,21 +3,16 @@ package handlers
 import (
 	"encoding/json"
 	"net/http"
-	"io"
-	"os"
-	"path/filepath"
 	"strconv"
-	"fmt"
 	"log"
-	"bytes"
-	"context"
+	"errors"
 
 	"photovault/config"
 	"photovault/utils"
 	"photovault/models"
+	"photovault/services"
+	"photovault/storage"
 	"strings"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/aws/aws-sdk-go-v2/aws"
 )
 
 type NewVaultRequest struct {
@@ -27,6 +22,9 @@ type NewVaultRequest struct {
 	IncludeInCapsule bool   `json:"IncludeInCapsule"`
 }
 
+// maxCoverSize caps a cover image upload.
+const maxCoverSize = 10 << 20
+
 type CoverImageResponse struct {
 	ID       uint   `json:"id"`
 	Filename string `json:"filename"`
@@ -64,7 +62,7 @@ func AddVault(w http.ResponseWriter, r *http.Request) {
 		Title:       req.Name,
 		UserID:      userId,
 		Description: req.Description,
-		Status:      "open",
+		Status:      services.StatusOpen,
 	}
 
 	if err := config.DB.Create(&newVault).Error; err != nil {
@@ -76,6 +74,14 @@ func AddVault(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]interface{}{"vaultId": newVault.ID})
 }
 
+// VaultResponse is a vault as listed by GetVaults, with its cover image's
+// placeholder alongside.
+type VaultResponse struct {
+	models.Vault
+	CoverBlurHash      string `json:"CoverBlurHash,omitempty"`
+	CoverDominantColor string `json:"CoverDominantColor,omitempty"`
+}
+
 func GetVaults(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -94,8 +100,37 @@ func GetVaults(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Covers' placeholders, so the list can be drawn before any cover loads
+	var coverIDs []uint
+	for _, v := range vaults {
+		if v.CoverImageID != nil {
+			coverIDs = append(coverIDs, *v.CoverImageID)
+		}
+	}
+	covers := map[uint]models.CoverImage{}
+	if len(coverIDs) > 0 {
+		var rows []models.CoverImage
+		if err := config.DB.Select("id", "blur_hash", "dominant_color").Where("id IN ?", coverIDs).Find(&rows).Error; err != nil {
+			http.Error(w, "Failed to retrieve cover images", http.StatusInternalServerError)
+			return
+		}
+		for _, c := range rows {
+			covers[c.ID] = c
+		}
+	}
+
+	response := make([]VaultResponse, 0, len(vaults))
+	for _, v := range vaults {
+		resp := VaultResponse{Vault: v}
+		if v.CoverImageID != nil {
+			cover := covers[*v.CoverImageID]
+			resp.CoverBlurHash, resp.CoverDominantColor = cover.BlurHash, cover.DominantColor
+		}
+		response = append(response, resp)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(vaults)
+	json.NewEncoder(w).Encode(response)
 }
 
 func CoverUploadHandler(w http.ResponseWriter, r *http.Request) {
@@ -103,94 +138,81 @@ func CoverUploadHandler(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		return
 	}
-	log.Println("2")
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-log.Println("3")
-	if err := r.ParseMultipartForm(10 << 20); err != nil {
-		http.Error(w, "Error parsing form", http.StatusBadRequest)
-		return
-	}
-log.Println("4")
 	vaultIdStr := strings.TrimPrefix(r.URL.Path, "/cover/upload/")
 	vaultId, err := strconv.ParseUint(vaultIdStr, 10, 64)
 	if err != nil {
 		http.Error(w, "Invalid vault ID", http.StatusBadRequest)
 		return
 	}
-log.Println("5")
 	userId, _, err := utils.GetUserFromToken(r)
 	if err != nil {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
-log.Println("6")
 	var user models.User
 	if err := config.DB.First(&user, userId).Error; err != nil {
 		http.Error(w, "User not found", http.StatusInternalServerError)
 		return
 	}
-log.Println("7")
 	var vault models.Vault
 	if err := config.DB.First(&vault, vaultId).Error; err != nil || vault.UserID != userId {
 		http.Error(w, "Vault not found or forbidden", http.StatusForbidden)
 		return
 	}
-log.Println("8")
-	// Expect a single file field "image"
-	file, handler, err := r.FormFile("images")
+	if sealed(w, &vault, services.AccessModify) {
+		return
+	}
+	// Expect a single file field "images", streamed straight to storage
+	reader, err := r.MultipartReader()
 	if err != nil {
-		http.Error(w, "No file uploaded", http.StatusBadRequest)
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
 		return
 	}
-	defer file.Close()
-log.Println("9")
-	// Read file into memory
-	buf := new(bytes.Buffer)
-	if _, err := io.Copy(buf, file); err != nil {
-		http.Error(w, "Failed to read file", http.StatusInternalServerError)
-		return
-	}
-log.Println("10")
-	// Generate a safe R2 key
-	safeFilename := fmt.Sprintf("%d_cover.jpg", vaultId)
-	key := fmt.Sprintf("vaults/%d/cover/%s", vaultId, safeFilename)
-log.Println("11")
-	// Upload to R2
-	_, err = config.R2Client.PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket: &config.R2Bucket,
-		Key:    &key,
-		Body:   bytes.NewReader(buf.Bytes()),
-	})
+	part, err := nextFilePart(reader, "images")
 	if err != nil {
-		http.Error(w, "Failed to upload to storage: "+err.Error(), http.StatusInternalServerError)
+		http.Error(w, "No file uploaded", http.StatusBadRequest)
+		return
+	}
+	defer part.Close()
+	// Covers are shown as images, so only image types will do
+	contentType, body, err := services.SniffReader(part)
+	if err != nil || !services.IsImageType(contentType) {
+		http.Error(w, "Cover must be an image", http.StatusUnsupportedMediaType)
 		return
 	}
-log.Println("12")
-	// Save cover image model
+	// Upload to storage
+	if services.PrivacyFor(&user, &vault) {
+		clean := services.SanitizingReader(body)
+		defer clean.Close()
+		body = clean
+	}
+	// Each cover gets its own key, so replacing one leaves it in the history
 	coverImage := models.CoverImage{
-		VaultID:  uint(vaultId),
-		Filename: handler.Filename,
-		Key:      key,
+		Filename:    part.FileName(),
+		ContentType: contentType,
 	}
-	if err := config.DB.Create(&coverImage).Error; err != nil {
-		http.Error(w, "Failed to save cover image in DB", http.StatusInternalServerError)
+	err = services.SaveCover(r.Context(), &vault, &coverImage, body, maxCoverSize)
+	if errors.Is(err, storage.ErrTooLarge) {
+		http.Error(w, "Cover image too large", http.StatusRequestEntityTooLarge)
 		return
 	}
-log.Println("14")
-	// Link to vault
-	vault.CoverImageID = &coverImage.ID
-	if err := config.DB.Save(&vault).Error; err != nil {
-		http.Error(w, "Failed to link cover image", http.StatusInternalServerError)
+	if errors.Is(err, services.ErrCannotSanitize) {
+		http.Error(w, "Privacy mode can't remove the metadata of this image", http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to save cover image: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
-	log.Println("15")
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
+	json.NewEncoder(w).Encode(map[string]interface{}{
 		"message": "Cover image uploaded and linked successfully",
-		"key":     key,
+		"key":     coverImage.Key,
+		"coverId": coverImage.ID,
 	})
 }
 
@@ -226,24 +248,24 @@ func GetCoverHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	log.Println("CoverImage:", img.ID, img.Key, img.Filename, "VaultID:", img.VaultID, "UserID:", img.Vault.UserID)
-	// 5. Get object from R2
-	resp, err := config.R2Client.GetObject(context.TODO(), &s3.GetObjectInput{
-		Bucket: &config.R2Bucket,
-		Key:    aws.String(img.Key),
-	})
-	if err != nil {
-		log.Println("Failed to retrieve file: ")
-		http.Error(w, "Failed to retrieve file: "+err.Error(), http.StatusInternalServerError)
-		return
+	// 5. Show covers browsers can't display through a JPEG copy
+	key, filename, contentType := img.Key, img.Filename, img.ContentType
+	if services.NeedsDisplayCopy(img.ContentType) {
+		rendition, err := services.EnsureRendition(r.Context(), img.Key, services.DisplaySize)
+		if err == nil {
+			key, filename, contentType = rendition.Key, jpegFilename(filename), "image/jpeg"
+		} else if !errors.Is(err, services.ErrNotImage) {
+			log.Printf("Failed to convert cover %d for display: %v", img.ID, err)
+		}
 	}
-	defer resp.Body.Close()
 
-	// 6. Set headers and stream file
-	w.Header().Set("Content-Disposition", "inline; filename="+strconv.Quote(img.Filename))
-	if _, err := io.Copy(w, resp.Body); err != nil {
-		http.Error(w, "Failed to stream file: "+err.Error(), http.StatusInternalServerError)
+	// 6. Stream the object, honouring Range and cache validators, or send
+	// the client to the bucket for it
+	if wantsRedirect(r) {
+		redirectToObject(w, r, key, filename, contentType)
 		return
 	}
+	serveObject(w, r, key, filename, contentType, coverCacheControl)
 }
 
 func DeleteVault(w http.ResponseWriter, r *http.Request) {
@@ -281,35 +303,13 @@ func DeleteVault(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var user models.User
-	if err := config.DB.First(&user, userId).Error; err != nil {
-		log.Printf("Failed to fetch user [userId=%d]: %v", userId, err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
-	}
-
-	if vault.CoverImageID != nil {
-		var coverImage models.CoverImage
-		if err := config.DB.First(&coverImage, vault.CoverImageID).Error; err == nil {
-			coverImagePath := filepath.Join("uploads", coverImage.Filename)
-
-			// Attempt to delete file, but only log failure if it doesn't exist
-			if err := os.Remove(coverImagePath); err != nil {
-				if os.IsNotExist(err) {
-					log.Printf("Cover image file not found (probably already deleted): %s", coverImagePath)
-				} else {
-					log.Printf("Failed to delete cover image file: %v", err)
-					// Don’t abort
-				}
-			}
-
-			// Attempt to delete DB record regardless
-			if err := config.DB.Delete(&coverImage).Error; err != nil {
-				log.Printf("Failed to delete cover image record: %v", err)
-				// Don’t abort
-			}
-		} else {
-			log.Printf("Cover image record not found: %v", err)
+	var covers []models.CoverImage
+	if err := config.DB.Where("vault_id = ?", vault.ID).Find(&covers).Error; err != nil {
+		log.Printf("Failed to query cover images: %v", err)
+	} else {
+		for i := range covers {
+			// Only drops the objects once the record is gone
+			services.RemoveCover(&covers[i])
 		}
 	}
 
@@ -318,30 +318,28 @@ func DeleteVault(w http.ResponseWriter, r *http.Request) {
 		log.Printf("Failed to query images: %v", err)
 	} else {
 		for _, image := range images {
-			imagePath := filepath.Join("uploads", image.Filename)
-
-			if err := os.Remove(imagePath); err != nil {
-				if os.IsNotExist(err) {
-					log.Printf("Image file not found (probably already deleted): %s", imagePath)
-				} else {
-					log.Printf("Failed to delete image file %s: %v", image.Filename, err)
-					// Don’t abort
-				}
-			}
-
-			if err := config.DB.Delete(&image).Error; err != nil {
+			// Refunds the image and drops its blob once nothing else uses it
+			if err := services.RemoveUpload(&image, vault.UserID); err != nil {
 				log.Printf("Failed to delete image record for %s: %v", image.Filename, err)
 				// Don’t abort
-			}
-
-			user.TotalStorageUsed -= image.Size
-			if err := config.DB.Save(&user).Error; err != nil {
-				http.Error(w, "Failed to update user storage", http.StatusInternalServerError)
-				return
+				continue
 			}
 		}
 	}
 
+	if err := config.DB.Where("vault_id = ?", vault.ID).Delete(&models.VaultRecipient{}).Error; err != nil {
+		log.Printf("Failed to delete recipients of vault %d: %v", vault.ID, err)
+	}
+	if err := config.DB.Where("vault_id = ?", vault.ID).Delete(&models.VaultStatusChange{}).Error; err != nil {
+		log.Printf("Failed to delete status history of vault %d: %v", vault.ID, err)
+	}
+	if err := config.DB.Where("vault_id = ?", vault.ID).Delete(&models.VaultCycle{}).Error; err != nil {
+		log.Printf("Failed to delete cycles of vault %d: %v", vault.ID, err)
+	}
+	if err := config.DB.Where("vault_id = ?", vault.ID).Delete(&models.CapsuleReminder{}).Error; err != nil {
+		log.Printf("Failed to delete reminders of vault %d: %v", vault.ID, err)
+	}
+
 	if err := config.DB.Delete(&vault).Error; err != nil {
 		log.Printf("Failed to delete vault record [vaultId=%d]: %v", vault.ID, err)
 		http.Error(w, "Failed to delete vault", http.StatusInternalServerError)
@@ -402,11 +400,24 @@ func TitleAndDescChange(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	userId, _, err := utils.GetUserFromToken(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
 	var vault models.Vault
 	if err := config.DB.First(&vault, id).Error; err != nil {
 		http.Error(w, "Vault not found", http.StatusNotFound)
 		return
 	}
+	if vault.UserID != userId {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if sealed(w, &vault, services.AccessModify) {
+		return
+	}
 
 	var input struct {
 		Title       string `json:"Title"`
@@ -429,6 +440,8 @@ func TitleAndDescChange(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(vault)
 }
 
+// ChangeCapsuleStatus moves a vault through the capsule states, as the
+// state machine in services allows, recording who did it.
 func ChangeCapsuleStatus(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPatch {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -442,9 +455,15 @@ func ChangeCapsuleStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	userId, _, err := utils.GetUserFromToken(r)
+	if err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
 	var vault models.Vault
-	if err := config.DB.First(&vault, id).Error; err != nil {
-		http.Error(w, "Vault not found", http.StatusNotFound)
+	if err := config.DB.First(&vault, id).Error; err != nil || vault.UserID != userId {
+		http.Error(w, "Vault not found or forbidden", http.StatusForbidden)
 		return
 	}
 
@@ -457,12 +476,51 @@ func ChangeCapsuleStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	vault.Status = input.Status
-
-	if err := config.DB.Save(&vault).Error; err != nil {
+	if err := services.ChangeStatus(&vault, input.Status, &userId); err != nil {
+		if status := transitionStatus(err); status != 0 {
+			http.Error(w, err.Error(), status)
+			return
+		}
 		http.Error(w, "Failed to update vault", http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(vault)
-}
\ No newline at end of file
+}
+
+// StatusHistoryHandler lists every status change of a vault, oldest first.
+func StatusHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	vault, ok := ownedVault(w, r, "/vault/statusHistory/")
+	if !ok {
+		return
+	}
+
+	changes := []models.VaultStatusChange{}
+	if err := config.DB.Where("vault_id = ?", vault.ID).Order("created_at, id").Find(&changes).Error; err != nil {
+		http.Error(w, "Failed to retrieve status history", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(changes)
+}
+
+// transitionStatus is the status for a refused status change, or 0 for
+// other errors.
+func transitionStatus(err error) int {
+	switch {
+	case errors.Is(err, services.ErrUnknownStatus):
+		return http.StatusBadRequest
+	case errors.Is(err, services.ErrUnlockDateRequired):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, services.ErrStillBuried):
+		return http.StatusLocked
+	case errors.Is(err, services.ErrInvalidTransition):
+		return http.StatusConflict
+	}
+	return 0
+}
@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"photovault/services"
+	"photovault/utils"
+)
+
+var (
+	errVideoTooLarge = errors.New("video is larger than your plan allows")
+	errVideoTooLong  = errors.New("video is longer than your plan allows")
+)
+
+// checkVideo holds a stored video to the plan's per-video limits. Videos
+// whose header can't be read are refused, since their length is unknown.
+func checkVideo(ctx context.Context, key string, size int64, limit utils.VideoLimit) error {
+	if size > limit.MaxSize {
+		return errVideoTooLarge
+	}
+	info, err := services.ProbeVideo(ctx, key)
+	if errors.Is(err, services.ErrNotVideo) {
+		return services.ErrUnsupportedType
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read video: %w", err)
+	}
+	if info.Duration > limit.MaxDuration {
+		return errVideoTooLong
+	}
+	return nil
+}
+
+// videoLimitStatus is the status for an upload refused by checkVideo, or 0
+// for other errors.
+func videoLimitStatus(err error) int {
+	switch {
+	case errors.Is(err, errVideoTooLarge), errors.Is(err, errVideoTooLong):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, services.ErrUnsupportedType):
+		return http.StatusUnsupportedMediaType
+	}
+	return 0
+}
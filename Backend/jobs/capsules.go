@@ -19,7 +19,7 @@ func StartCapsuleCron() {
 		var capsules []models.Vault
 		result := config.DB.
 			Where("unlock_date <= ?", now).
-			Where("status = ?", "buried").
+			Where("status = ?", services.StatusBuried).
 			Find(&capsules)
 
 		if result.Error != nil {
@@ -28,21 +28,76 @@ func StartCapsuleCron() {
 		}
 
 		for _, capsule := range capsules {
-			// Mark as opened
-			// capsule.IsOpened = true
-			//config.DB.Save(&capsule)
-
-			// You could trigger a notification, send an email, etc.
-			//Services.SendEmail()
+			// Only the run that moves it to unlocked sends the email, so it
+			// goes out once
+			if err := services.ChangeStatus(&capsule, services.StatusUnlocked, nil); err != nil {
+				fmt.Println("Failed to unlock capsule", capsule.ID, err)
+				continue
+			}
 			var cap models.Vault
 			if err := config.DB.Preload("User").First(&cap, capsule.ID).Error; err != nil {
-				return 
+				continue
 			}
-			fmt.Println(cap.User.Email)
 			fmt.Println("Opened capsule ID:", capsule.ID)
-			services.SendOpenEmail(cap.User.Email,capsule.ID)
+			if cap.Recurrence == "" {
+				services.SendOpenEmail(cap.User.Email,capsule.ID)
+			} else {
+				openCycle(&cap, now)
+			}
+			services.NotifyRecipients(&capsule)
+		}
+	})
+
+	// Buries recurring capsules again once they have been open a while
+	c.AddFunc("* * * * *", func() {
+		services.ResealCapsules(time.Now())
+	})
+
+	// Reminds owners before their capsules unlock
+	c.AddFunc("*/15 * * * *", func() {
+		services.SendCapsuleReminders(time.Now())
+	})
+
+	// Retries openings of recurring capsules that failed to be recorded
+	c.AddFunc("@hourly", func() {
+		now := time.Now()
+		vaults, err := services.UnopenedCycles(now)
+		if err != nil {
+			fmt.Println("Error fetching unopened recurring capsules:", err)
+			return
+		}
+		for i := range vaults {
+			openCycle(&vaults[i], now)
+		}
+	})
+
+	// Retries recipient links that failed to send
+	c.AddFunc("@hourly", func() {
+		vaults, err := services.PendingRecipientVaults()
+		if err != nil {
+			fmt.Println("Error fetching capsules with pending recipients:", err)
+			return
+		}
+		for i := range vaults {
+			services.NotifyRecipients(&vaults[i])
 		}
 	})
 
 	c.Start()
 }
+
+// openCycle records the opening of a recurring capsule that has unlocked
+// and sends its owner the recap of it.
+func openCycle(capsule *models.Vault, now time.Time) {
+	cycle, next, err := services.OpenCycle(capsule, now)
+	if err != nil {
+		// Tried again by the hourly job
+		fmt.Println("Failed to open cycle of capsule", capsule.ID, err)
+		return
+	}
+	var added int64
+	config.DB.Model(&models.VaultCycleUpload{}).Where("cycle_id = ?", cycle.ID).Count(&added)
+	if err := services.SendRecapEmail(capsule.User.Email, capsule.Title, capsule.ID, cycle.Number, int(added), next); err != nil {
+		fmt.Println("Failed to send recap of capsule", capsule.ID, err)
+	}
+}
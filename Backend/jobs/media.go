@@ -0,0 +1,16 @@
+package jobs
+
+import (
+	"photovault/services"
+
+	"github.com/robfig/cron/v3"
+)
+
+func StartMediaCron() {
+	c := cron.New()
+
+	// Runs every ten minutes
+	c.AddFunc("*/10 * * * *", services.BackfillAnalysis)
+
+	c.Start()
+}
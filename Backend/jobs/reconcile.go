@@ -0,0 +1,224 @@
+package jobs
+
+import (
+	"context"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"photovault/config"
+	"photovault/models"
+	"photovault/services"
+	"photovault/storage"
+)
+
+// reconcileGracePeriod keeps the job away from uploads that are still in
+// flight: objects and pending rows younger than this are left alone.
+const reconcileGracePeriod = time.Hour
+
+var trackedObjectKey = regexp.MustCompile(`^(vaults/\d+/(uploads|cover)|blobs/[0-9a-f]{2}|renditions)/`)
+
+// ReconcileReport summarises the differences between the bucket and the
+// Upload/CoverImage/Rendition tables.
+type ReconcileReport struct {
+	DryRun bool
+
+	OrphanObjects    []string // objects with no row
+	OrphanBytes      int64
+	MissingUploads   []uint // Upload rows whose object is gone
+	MissingCovers    []uint // CoverImage rows whose object is gone
+	StalePendingRows []uint // Upload rows that were never finalized
+	StaleRenditions  []uint // Rendition rows whose object or source is gone
+	ObjectsScanned   int
+	RowsScanned      int
+}
+
+// ReconcileStorage compares the vaults/{id}/uploads, vaults/{id}/cover,
+// blobs/ and renditions/ prefixes with the database. With dryRun set it
+// only reports; otherwise orphan objects are queued for deletion and
+// dangling rows are removed.
+func ReconcileStorage(ctx context.Context, dryRun bool) (*ReconcileReport, error) {
+	report := &ReconcileReport{DryRun: dryRun}
+	cutoff := time.Now().Add(-reconcileGracePeriod)
+
+	var objects []storage.Object
+	for _, prefix := range []string{"vaults/", "blobs/", "renditions/"} {
+		listed, err := config.Storage.List(ctx, prefix)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, listed...)
+	}
+	inBucket := make(map[string]bool, len(objects))
+	for _, o := range objects {
+		if trackedObjectKey.MatchString(o.Key) {
+			inBucket[o.Key] = true
+		}
+	}
+	report.ObjectsScanned = len(inBucket)
+
+	var uploads []models.Upload
+	if err := config.DB.Select("id", "vault_id", "key", "size", "content_hash", "upload_time", "pending", "edits").Find(&uploads).Error; err != nil {
+		return nil, err
+	}
+	var covers []models.CoverImage
+	if err := config.DB.Select("id", "vault_id", "key").Find(&covers).Error; err != nil {
+		return nil, err
+	}
+	var renditions []models.Rendition
+	if err := config.DB.Select("id", "source_key", "key", "created_at").Find(&renditions).Error; err != nil {
+		return nil, err
+	}
+	var queued []string
+	if err := config.DB.Model(&models.PendingDeletion{}).Pluck("key", &queued).Error; err != nil {
+		return nil, err
+	}
+	report.RowsScanned = len(uploads) + len(covers) + len(renditions)
+
+	known := make(map[string]bool, len(uploads)+len(covers)+len(queued))
+	for _, k := range queued {
+		known[k] = true
+	}
+
+	var missingUploads []models.Upload
+	var staleKeys []string
+	for _, u := range uploads {
+		if u.Pending || strings.HasPrefix(u.Key, "pending-") {
+			if u.UploadTime.Before(cutoff) {
+				report.StalePendingRows = append(report.StalePendingRows, u.ID)
+				if inBucket[u.Key] {
+					// A presigned PUT that was never finalized
+					staleKeys = append(staleKeys, u.Key)
+				}
+			}
+			known[u.Key] = true
+			continue
+		}
+		known[u.Key] = true
+		if !inBucket[u.Key] && u.UploadTime.Before(cutoff) {
+			report.MissingUploads = append(report.MissingUploads, u.ID)
+			missingUploads = append(missingUploads, u)
+		}
+	}
+	for _, c := range covers {
+		known[c.Key] = true
+		if !inBucket[c.Key] {
+			report.MissingCovers = append(report.MissingCovers, c.ID)
+		}
+	}
+
+	// A rendition is only worth keeping while its source is; rows whose
+	// object vanished are dropped and rendered again on the next request
+	sources := make(map[string]bool, len(uploads)+len(covers))
+	for i, u := range uploads {
+		sources[u.Key] = true
+		if u.Edits != nil {
+			// Edited renditions hang off the upload's own source key
+			sources[services.RenditionSource(&uploads[i])] = true
+		}
+	}
+	for _, c := range covers {
+		sources[c.Key] = true
+	}
+	for _, rd := range renditions {
+		if !sources[rd.SourceKey] || (!inBucket[rd.Key] && rd.CreatedAt.Before(cutoff)) {
+			report.StaleRenditions = append(report.StaleRenditions, rd.ID)
+			continue
+		}
+		known[rd.Key] = true
+	}
+
+	for _, o := range objects {
+		if !inBucket[o.Key] || known[o.Key] || o.LastModified.After(cutoff) {
+			continue
+		}
+		report.OrphanObjects = append(report.OrphanObjects, o.Key)
+		report.OrphanBytes += o.Size
+	}
+
+	if dryRun {
+		return report, nil
+	}
+
+	services.DeleteObjects(report.OrphanObjects...)
+
+	for _, u := range missingUploads {
+		removeUploadRow(u)
+	}
+	if len(report.MissingCovers) > 0 {
+		config.DB.Model(&models.Vault{}).Where("cover_image_id IN ?", report.MissingCovers).Update("cover_image_id", nil)
+		config.DB.Delete(&models.CoverImage{}, report.MissingCovers)
+	}
+	if len(report.StalePendingRows) > 0 {
+		// Storage is only charged on finalize, so nothing to refund
+		config.DB.Delete(&models.Upload{}, report.StalePendingRows)
+		services.DeleteObjects(staleKeys...)
+	}
+	if len(report.StaleRenditions) > 0 {
+		config.DB.Delete(&models.Rendition{}, report.StaleRenditions)
+	}
+
+	return report, nil
+}
+
+// removeUploadRow deletes an upload whose object is gone and gives its size
+// back to the vault and its owner.
+func removeUploadRow(u models.Upload) {
+	var vault models.Vault
+	err := config.DB.Select("id", "user_id").First(&vault, u.VaultID).Error
+	if err == nil {
+		err = services.RemoveUpload(&u, vault.UserID)
+	}
+	if err != nil {
+		log.Printf("Failed to remove upload %d with missing object: %v", u.ID, err)
+	}
+}
+
+// LogReconcileReport prints a report in a form that is easy to grep.
+func LogReconcileReport(r *ReconcileReport) {
+	mode := "delete"
+	if r.DryRun {
+		mode = "dry-run"
+	}
+	log.Printf("[reconcile] mode=%s objects=%d rows=%d orphan_objects=%d orphan_bytes=%d missing_uploads=%d missing_covers=%d stale_pending=%d stale_renditions=%d",
+		mode, r.ObjectsScanned, r.RowsScanned, len(r.OrphanObjects), r.OrphanBytes,
+		len(r.MissingUploads), len(r.MissingCovers), len(r.StalePendingRows), len(r.StaleRenditions))
+	for _, k := range r.OrphanObjects {
+		log.Printf("[reconcile] orphan object %s", k)
+	}
+	for _, id := range r.MissingUploads {
+		log.Printf("[reconcile] upload %d has no object", id)
+	}
+	for _, id := range r.MissingCovers {
+		log.Printf("[reconcile] cover image %d has no object", id)
+	}
+	for _, id := range r.StalePendingRows {
+		log.Printf("[reconcile] upload %d is stuck on a pending key", id)
+	}
+	for _, id := range r.StaleRenditions {
+		log.Printf("[reconcile] rendition %d has no object or source", id)
+	}
+}
+
+// StartReconcileCron runs the reconciliation once a day. It only reports
+// unless RECONCILE_MODE=delete.
+func StartReconcileCron() {
+	c := cron.New()
+
+	// Runs daily at 03:30
+	c.AddFunc("30 3 * * *", func() {
+		dryRun := os.Getenv("RECONCILE_MODE") != "delete"
+
+		report, err := ReconcileStorage(context.Background(), dryRun)
+		if err != nil {
+			log.Println("Error reconciling storage:", err)
+			return
+		}
+		LogReconcileReport(report)
+	})
+
+	c.Start()
+}
@@ -0,0 +1,201 @@
+package jobs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"photovault/config"
+	"photovault/models"
+	"photovault/storage"
+)
+
+// reconcileFixture swaps config.DB and config.Storage for an SQLite file and
+// a LocalStore in a temp dir, restoring them when the test ends.
+func reconcileFixture(t *testing.T) (root string) {
+	t.Helper()
+	dir := t.TempDir()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(dir, "test.db")+"?_busy_timeout=5000"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&models.User{}, &models.Vault{}, &models.Upload{},
+		&models.CoverImage{}, &models.Rendition{}, &models.PendingDeletion{}); err != nil {
+		t.Fatal(err)
+	}
+	root = filepath.Join(dir, "bucket")
+	store, err := storage.NewLocalStore(root, "http://localhost", []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prevDB, prevStorage := config.DB, config.Storage
+	config.DB, config.Storage = db, store
+	t.Cleanup(func() {
+		// Let queued deletions finish before the temp dir goes away
+		waitFor(t, func() bool {
+			var n int64
+			db.Model(&models.PendingDeletion{}).Count(&n)
+			return n == 0
+		})
+		config.DB, config.Storage = prevDB, prevStorage
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return root
+}
+
+// putObject stores key and backdates it by age.
+func putObject(t *testing.T, root, key string, age time.Duration) {
+	t.Helper()
+	body := "object " + key
+	if err := config.Storage.Put(context.Background(), key, strings.NewReader(body), int64(len(body)), "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(-age)
+	if err := os.Chtimes(filepath.Join(root, filepath.FromSlash(key)), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for queued deletions")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReconcileStorage(t *testing.T) {
+	root := reconcileFixture(t)
+	ctx := context.Background()
+	old, fresh := 2*time.Hour, time.Minute
+
+	user := models.User{Email: "owner@example.com", PasswordHash: "x"}
+	config.DB.Create(&user)
+	vault := models.Vault{UserID: user.ID, Title: "Summer"}
+	config.DB.Create(&vault)
+
+	kept := models.Upload{VaultID: vault.ID, Filename: "kept.jpg", Size: 1, Key: "blobs/ab/kept"}
+	config.DB.Create(&kept)
+	putObject(t, root, kept.Key, old)
+
+	// Orphans inside the grace period may be uploads still in flight
+	putObject(t, root, "blobs/cd/orphan-old", old)
+	putObject(t, root, "blobs/cd/orphan-fresh", fresh)
+	// Untracked prefixes are never touched
+	putObject(t, root, "vaults/1/exports/archive.zip", old)
+
+	stalePending := models.Upload{VaultID: vault.ID, Filename: "stale.jpg", Size: 1,
+		Key: "vaults/1/uploads/pending-stale", Pending: true, UploadTime: time.Now().Add(-old)}
+	config.DB.Create(&stalePending)
+	putObject(t, root, stalePending.Key, old)
+	freshPending := models.Upload{VaultID: vault.ID, Filename: "fresh.jpg", Size: 1,
+		Key: "vaults/1/uploads/pending-fresh", Pending: true, UploadTime: time.Now().Add(-fresh)}
+	config.DB.Create(&freshPending)
+	putObject(t, root, freshPending.Key, fresh)
+
+	keptRendition := models.Rendition{SourceKey: kept.Key, Size: 512, Key: "renditions/kept-512", Width: 1, Height: 1, Bytes: 1}
+	config.DB.Create(&keptRendition)
+	putObject(t, root, keptRendition.Key, old)
+	sourceless := models.Rendition{SourceKey: "blobs/ef/gone", Size: 512, Key: "renditions/gone-512", Width: 1, Height: 1, Bytes: 1}
+	config.DB.Create(&sourceless)
+	putObject(t, root, sourceless.Key, old)
+	// Missing its object but recent enough to still be rendering
+	rendering := models.Rendition{SourceKey: kept.Key, Size: 1024, Key: "renditions/kept-1024", Width: 1, Height: 1, Bytes: 1}
+	config.DB.Create(&rendering)
+
+	exists := func(key string) bool {
+		_, err := config.Storage.Head(ctx, key)
+		return err == nil
+	}
+	check := func(report *ReconcileReport) {
+		t.Helper()
+		if want := []string{"blobs/cd/orphan-old", sourceless.Key}; !slices.Equal(sorted(report.OrphanObjects), want) {
+			t.Errorf("OrphanObjects = %q, want %q", report.OrphanObjects, want)
+		}
+		if want := []uint{stalePending.ID}; !slices.Equal(report.StalePendingRows, want) {
+			t.Errorf("StalePendingRows = %v, want %v", report.StalePendingRows, want)
+		}
+		if want := []uint{sourceless.ID}; !slices.Equal(report.StaleRenditions, want) {
+			t.Errorf("StaleRenditions = %v, want %v", report.StaleRenditions, want)
+		}
+		if len(report.MissingUploads) != 0 || len(report.MissingCovers) != 0 {
+			t.Errorf("MissingUploads = %v, MissingCovers = %v, want none", report.MissingUploads, report.MissingCovers)
+		}
+	}
+
+	report, err := ReconcileStorage(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.DryRun {
+		t.Error("DryRun = false, want true")
+	}
+	check(report)
+	var rows int64
+	config.DB.Model(&models.Upload{}).Count(&rows)
+	if rows != 3 {
+		t.Errorf("dry run left %d uploads, want 3", rows)
+	}
+	config.DB.Model(&models.Rendition{}).Count(&rows)
+	if rows != 3 {
+		t.Errorf("dry run left %d renditions, want 3", rows)
+	}
+	for _, key := range []string{"blobs/cd/orphan-old", stalePending.Key, sourceless.Key} {
+		if !exists(key) {
+			t.Errorf("dry run deleted %s", key)
+		}
+	}
+
+	report, err = ReconcileStorage(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(report)
+	waitFor(t, func() bool {
+		var n int64
+		config.DB.Model(&models.PendingDeletion{}).Count(&n)
+		return n == 0
+	})
+
+	for _, key := range []string{"blobs/cd/orphan-old", stalePending.Key, sourceless.Key} {
+		if exists(key) {
+			t.Errorf("%s was not deleted", key)
+		}
+	}
+	for _, key := range []string{kept.Key, "blobs/cd/orphan-fresh", "vaults/1/exports/archive.zip", freshPending.Key, keptRendition.Key} {
+		if !exists(key) {
+			t.Errorf("%s was deleted", key)
+		}
+	}
+	var uploadIDs []uint
+	config.DB.Model(&models.Upload{}).Order("id").Pluck("id", &uploadIDs)
+	if want := []uint{kept.ID, freshPending.ID}; !slices.Equal(uploadIDs, want) {
+		t.Errorf("uploads left = %v, want %v", uploadIDs, want)
+	}
+	var renditionIDs []uint
+	config.DB.Model(&models.Rendition{}).Order("id").Pluck("id", &renditionIDs)
+	if want := []uint{keptRendition.ID, rendering.ID}; !slices.Equal(renditionIDs, want) {
+		t.Errorf("renditions left = %v, want %v", renditionIDs, want)
+	}
+}
+
+func sorted(s []string) []string {
+	s = slices.Clone(s)
+	slices.Sort(s)
+	return s
+}
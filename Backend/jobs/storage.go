@@ -0,0 +1,19 @@
+package jobs
+
+import (
+	"photovault/services"
+
+	"github.com/robfig/cron/v3"
+)
+
+func StartStorageCleanupCron() {
+	c := cron.New()
+
+	// Runs every five minutes
+	c.AddFunc("*/5 * * * *", services.RetryPendingDeletions)
+
+	// Runs hourly
+	c.AddFunc("0 * * * *", services.ExpireTusUploads)
+
+	c.Start()
+}
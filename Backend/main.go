@@ -2,9 +2,10 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
 	"net/http"
-	"os"
 
 	"photovault/config"
 	"photovault/routes"
@@ -13,29 +14,46 @@ import (
 )
 
 func main() {
-	config.ConnectToDB()
-	config.ConnectToR2()
-	
-	if err := os.MkdirAll("uploads", os.ModePerm); err != nil {
-		log.Fatal(err)
-	}
+	reconcile := flag.String("reconcile", "", "run storage reconciliation once and exit (report or delete)")
+	flag.Parse()
 
+	// The database and storage settings may come from .env
 	err := godotenv.Load()
 	if err != nil {
 		log.Println("No .env file found; using OS env vars only")
 	}
 
+	config.ConnectToDB()
+	config.ConnectToStorage()
+
 	secret := config.GetEnv("secret_token", "")
 	if secret == "" {
 		log.Println("Token not set. Please define secret_token in environment variables.")
 	}
 	config.JwtSecret = []byte(secret)
+
+	if *reconcile != "" {
+		report, err := jobs.ReconcileStorage(context.Background(), *reconcile != "delete")
+		if err != nil {
+			log.Fatal("Reconciliation failed: ", err)
+		}
+		jobs.LogReconcileReport(report)
+		return
+	}
+
 	jobs.StartCapsuleCron()
+	jobs.StartStorageCleanupCron()
+	jobs.StartReconcileCron()
+	jobs.StartMediaCron()
 	mux := routes.SetupRoutes()
 	// if err := tests.RunUploadTest(); err != nil {
     //     fmt.Println("Error:", err)
     //     return
     // }
+	// if err := tests.RunUploadBenchmark(); err != nil {
+	//     fmt.Println("Error:", err)
+	//     return
+	// }
 	//fmt.Println("🚀 Server running at http://localhost:8080")
 	log.Fatal(http.ListenAndServe(":8080", mux))
 
@@ -5,6 +5,12 @@ import (
 )
 
 func WithCORS(next http.HandlerFunc) http.HandlerFunc {
+	return WithCORSOptions(next, nil)
+}
+
+// WithCORSOptions is WithCORS with OPTIONS requests answered by options,
+// after the CORS headers are set, instead of with a bare 200.
+func WithCORSOptions(next, options http.HandlerFunc) http.HandlerFunc {
 	// Allowed origins
 	allowedOrigins := map[string]bool{
 		"https://www.myphotocapsule.com": true,
@@ -16,10 +22,15 @@ func WithCORS(next http.HandlerFunc) http.HandlerFunc {
 			w.Header().Set("Access-Control-Allow-Origin", origin)
 		}
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS, PATCH")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, DELETE, OPTIONS, PATCH")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Tus-Resumable, Upload-Length, Upload-Offset, Upload-Metadata, Range, If-Range, If-None-Match, If-Modified-Since")
+		w.Header().Set("Access-Control-Expose-Headers", "Location, Tus-Resumable, Tus-Version, Upload-Length, Upload-Offset, Upload-Expires, Tus-Extension, Tus-Max-Size, ETag, Accept-Ranges, Content-Range")
 
 		if r.Method == http.MethodOptions {
+			if options != nil {
+				options(w, r)
+				return
+			}
 			w.WriteHeader(http.StatusOK)
 			return
 		}
@@ -2,6 +2,8 @@ package models
 
 import (
 	"time"
+
+	"photovault/storage"
 )
 
 type User struct {
@@ -18,6 +20,18 @@ type User struct {
 	IsVerified        bool      `gorm:"default:false"`
 	VerificationToken string    `gorm:"size:64"`
 	TokenExpiresAt    time.Time
+
+	// PrivacyMode strips location and identifying metadata from uploads
+	PrivacyMode bool `gorm:"not null;default:false"`
+
+	// CapsuleReminders emails the owner before their buried capsules unlock
+	CapsuleReminders bool `gorm:"not null;default:true"`
+	// ReminderDays is when reminders go out, as comma-separated days before
+	// unlocking; empty uses CAPSULE_REMINDER_DAYS
+	ReminderDays string `gorm:"size:64"`
+	// TimeZone is the IANA zone unlock times are entered and shown in;
+	// empty is UTC
+	TimeZone string `gorm:"size:64"`
 }
 
 type Vault struct {
@@ -31,6 +45,21 @@ type Vault struct {
 	UnlockDate  *time.Time
 	CreatedAt   time.Time
 	Status      string
+	// PrivacyMode overrides the owner's setting when set
+	PrivacyMode *bool
+	// TimeZone overrides the owner's time zone for this vault's unlock time
+	// when set
+	TimeZone *string `gorm:"size:64"`
+	// Recurrence is an RRULE subset such as FREQ=YEARLY;INTERVAL=1 that
+	// opens the capsule again on every occurrence; empty for one-off capsules
+	Recurrence string `gorm:"size:200"`
+	// RecurrenceStart is the first occurrence, which later ones follow
+	RecurrenceStart *time.Time
+	// ResealAt is when a recurring capsule that has opened is buried again
+	// until its next occurrence
+	ResealAt *time.Time
+	// ResealAttempts counts failed reseals since the capsule last opened
+	ResealAttempts int `gorm:"not null;default:0"`
 
 	User            User      `gorm:"foreignKey:UserID"`
 	Uploads []Upload `gorm:"foreignKey:VaultID"`
@@ -42,10 +71,40 @@ type Upload struct {
 	Vault      Vault      `gorm:"foreignKey:VaultID"`
 	Filename   string     `gorm:"not null"`
 	Size        int64     `gorm:"not null"`
-	Key       string      `gorm:"uniqueIndex"`
+	Key       string      `gorm:"index:idx_uploads_blob_key"` // shared with other uploads of the same content
+	ContentHash string    `gorm:"size:64;index"` // hex SHA-256 of the stored bytes
+	ContentType string    `gorm:"size:100"` // sniffed from the bytes, not the filename
 	UploadTime time.Time  `gorm:"autoCreateTime"`
 	DeletedAt  *time.Time `gorm:"default:null"`
 	OrderIndex int  	  `gorm:"not null;default:0"`
+	// Pending uploads have a row but no confirmed object yet, e.g. while a
+	// client is still PUTting to a presigned URL.
+	Pending    bool       `gorm:"not null;default:false"`
+	// Edits are applied whenever the upload is shown; the object itself is
+	// never changed. Nil means it is shown as uploaded.
+	Edits *ImageEdits `gorm:"serializer:json"`
+}
+
+// ImageEdits is the edit list of an upload, applied in order: orientation,
+// rotation, then crop.
+type ImageEdits struct {
+	// AutoOrient follows the EXIF orientation, as the original is shown.
+	// Set false for files whose camera wrote it wrong. HEIF files are always
+	// turned by their own rotation.
+	AutoOrient *bool `json:"autoOrient,omitempty"`
+	// Rotate is a clockwise turn of 0, 90, 180 or 270 degrees
+	Rotate int `json:"rotate"`
+	// Crop is taken after rotating
+	Crop *CropRect `json:"crop,omitempty"`
+}
+
+// CropRect is a rectangle of an image in fractions of its upright width and
+// height, so clients can send what they drew over any preview size.
+type CropRect struct {
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
 }
 
 type CoverImage struct {
@@ -55,6 +114,14 @@ type CoverImage struct {
 	Filename        string    `gorm:"not null"`
 	UploadTime      time.Time `gorm:"autoCreateTime"`
 	Key       string      `gorm:"uniqueIndex"`
+	ContentType string    `gorm:"size:100"`
+	BlurHash      string  `gorm:"size:64"`
+	DominantColor string  `gorm:"size:7"` // "#rrggbb"
+	// SourceUploadID is the upload a cover was cropped from, if any
+	SourceUploadID *uint
+	// ReplacedAt is set once another cover takes this one's place; the
+	// vault keeps a few replaced covers to switch back to
+	ReplacedAt *time.Time `gorm:"index"`
 }
 
 type RefreshToken struct {
@@ -64,4 +131,144 @@ type RefreshToken struct {
     TokenHash   string `gorm:"not null;uniqueIndex"`
     ExpiresAt   time.Time `gorm:"not null"`
     IsRevoked   bool   `gorm:"default:false"`
-}
\ No newline at end of file
+}
+// VaultStatusChange records a capsule moving from one state to another.
+type VaultStatusChange struct {
+	ID         uint      `gorm:"primaryKey"`
+	VaultID    uint      `gorm:"not null;index"`
+	FromStatus string    `gorm:"size:20;not null"`
+	ToStatus   string    `gorm:"size:20;not null"`
+	ActorID    *uint     // the user who made the change, nil for the scheduler
+	CreatedAt  time.Time `gorm:"index"`
+}
+
+// VaultRecipient is someone a capsule is shared with when it unlocks. They
+// are emailed a link whose token lets them view the opened capsule without
+// an account; only the token's hash is kept.
+type VaultRecipient struct {
+	ID             uint       `gorm:"primaryKey"`
+	VaultID        uint       `gorm:"not null;uniqueIndex:idx_vault_recipients_email"`
+	Email          string     `gorm:"size:254;not null;uniqueIndex:idx_vault_recipients_email"`
+	Message        string     // shown to the recipient with the capsule
+	TokenHash      *string    `gorm:"size:64;uniqueIndex"` // hex SHA-256, set once the link is sent
+	TokenExpiresAt *time.Time // nil for links that don't expire
+	NotifiedAt     *time.Time
+	RevokedAt      *time.Time
+	// ClaimedByID is the account the recipient signed up with and claimed
+	// the capsule into; claimed links no longer expire
+	ClaimedByID *uint `gorm:"index"`
+	CreatedAt   time.Time
+}
+
+// PendingDeletion is a stored object that still has to be removed from the
+// bucket. Rows are deleted once the object is gone.
+type PendingDeletion struct {
+	ID            uint      `gorm:"primaryKey"`
+	Key           string    `gorm:"uniqueIndex;not null"`
+	Attempts      int       `gorm:"not null;default:0"`
+	LastError     string
+	NextAttemptAt time.Time `gorm:"index"`
+	CreatedAt     time.Time
+}
+
+// TusUpload tracks a resumable (tus) upload while its parts arrive. The
+// Upload row is only created once Offset reaches Length.
+type TusUpload struct {
+	ID          string         `gorm:"primaryKey;size:64"`
+	VaultID     uint           `gorm:"not null;index"`
+	UserID      uint           `gorm:"not null;index"`
+	Filename    string         `gorm:"not null"`
+	ContentType string
+	Key         string         `gorm:"not null"`
+	MultipartID string         `gorm:"not null"`
+	Length      int64          `gorm:"not null"`
+	Offset      int64          `gorm:"column:upload_offset;not null;default:0"`
+	Parts       []storage.Part `gorm:"serializer:json"`
+	// Assembled is set once the parts have been joined into Key, so a
+	// retried final PATCH doesn't complete the multipart upload twice
+	Assembled bool `gorm:"not null;default:false"`
+	UploadID  *uint
+	ExpiresAt   time.Time      `gorm:"index"`
+	CreatedAt   time.Time
+}
+
+// Blob is a stored object addressed by the SHA-256 of its content. Uploads
+// with identical bytes share one blob; RefCount counts the uploads pointing
+// at it and the object is deleted when it drops to zero.
+type Blob struct {
+	Hash      string `gorm:"primaryKey;size:64"`
+	Key       string `gorm:"uniqueIndex;not null"`
+	Size      int64  `gorm:"not null"`
+	RefCount  int    `gorm:"not null;default:0"`
+	CreatedAt time.Time
+}
+
+// UserBlob counts how many of a user's uploads reference a blob, so the
+// blob's size is charged to the user only once.
+type UserBlob struct {
+	UserID   uint   `gorm:"primaryKey"`
+	BlobHash string `gorm:"primaryKey;size:64"`
+	RefCount int    `gorm:"not null;default:0"`
+}
+
+// Rendition is a resized JPEG of a stored image. It belongs to the source
+// object rather than an upload, so uploads sharing a blob share renditions.
+type Rendition struct {
+	ID        uint   `gorm:"primaryKey"`
+	SourceKey string `gorm:"not null;uniqueIndex:idx_renditions_source_size"`
+	Size      int    `gorm:"not null;uniqueIndex:idx_renditions_source_size"` // longest edge it was fitted into
+	Key       string `gorm:"not null;uniqueIndex"`
+	Width     int    `gorm:"not null"`
+	Height    int    `gorm:"not null"`
+	Bytes     int64  `gorm:"not null"`
+	CreatedAt time.Time
+}
+
+// UploadMetadata is what was read from an upload's EXIF and XMP when it was
+// stored. CapturedAt is the camera's wall-clock time kept as UTC, since most
+// cameras don't record their offset.
+type UploadMetadata struct {
+	UploadID    uint       `gorm:"primaryKey"`
+	CapturedAt  *time.Time `gorm:"index"`
+	CameraMake  string
+	CameraModel string
+	Orientation int `gorm:"not null;default:1"` // EXIF orientation, 1 is upright
+	Width       int // as displayed, after orientation
+	Height      int
+	Latitude    *float64
+	Longitude   *float64
+	DurationMs  int64 // videos only
+	// PerceptualHash is the image's dHash as a signed bit pattern, nil until
+	// computed and for videos
+	PerceptualHash *int64
+	BlurHash       string `gorm:"size:64"`
+	DominantColor  string `gorm:"size:7"` // "#rrggbb"
+	CreatedAt   time.Time
+}
+
+// CapsuleReminder records a reminder, due a number of days before a capsule
+// unlocks, so it goes out once per unlock date.
+type CapsuleReminder struct {
+	ID         uint      `gorm:"primaryKey"`
+	VaultID    uint      `gorm:"not null;uniqueIndex:idx_capsule_reminders_once"`
+	UnlockDate time.Time `gorm:"not null;uniqueIndex:idx_capsule_reminders_once"`
+	DaysBefore int       `gorm:"not null;uniqueIndex:idx_capsule_reminders_once"`
+	SentAt     *time.Time // nil for reminders skipped because a closer one was due
+	CreatedAt  time.Time
+}
+
+// VaultCycle is one opening of a recurring capsule.
+type VaultCycle struct {
+	ID         uint      `gorm:"primaryKey"`
+	VaultID    uint      `gorm:"not null;uniqueIndex:idx_vault_cycles_number"`
+	Number     int       `gorm:"not null;uniqueIndex:idx_vault_cycles_number"` // 1 for the first opening
+	UnlockDate time.Time `gorm:"not null"` // the occurrence that opened it
+	OpenedAt   time.Time `gorm:"not null"`
+}
+
+// VaultCycleUpload snapshots an upload into the cycle it was added in, the
+// first opening after it was uploaded.
+type VaultCycleUpload struct {
+	CycleID  uint `gorm:"primaryKey"`
+	UploadID uint `gorm:"primaryKey;index"`
+}
@@ -15,20 +15,36 @@ func SetupRoutes() *http.ServeMux {
 	mux.HandleFunc("/logout", middleware.WithCORS(handlers.LogoutHandler))
 	mux.HandleFunc("/verify", middleware.WithCORS(handlers.VerifyEmailHandler))
 
+	// Recipients open shared capsules through the token in their link
+	mux.HandleFunc("/shared/", middleware.WithCORS(handlers.SharedCapsuleHandler))
+
 	mux.HandleFunc("/user", middleware.WithCORS(handlers.UserHandler))
+	mux.HandleFunc("/user/privacy", middleware.WithCORS(middleware.AuthMiddleware(handlers.UserPrivacyHandler)))
+	mux.HandleFunc("/user/notifications", middleware.WithCORS(middleware.AuthMiddleware(handlers.NotificationSettingsHandler)))
+	mux.HandleFunc("/user/timezone", middleware.WithCORS(middleware.AuthMiddleware(handlers.UserTimeZoneHandler)))
 
 	mux.HandleFunc("/auth/refresh", middleware.WithCORS(handlers.RefreshHandler))
 	mux.HandleFunc("/image/", middleware.WithCORS(middleware.AuthMiddleware(handlers.GetImageHandler)))
 	mux.HandleFunc("/image/cover/", middleware.WithCORS(middleware.AuthMiddleware(handlers.GetCoverHandler)))
 
 	// Authenticated routes with CORS
-	mux.HandleFunc("/upload/", middleware.WithCORS(middleware.AuthMiddleware(handlers.UploadHandler)))
+	mux.HandleFunc("/upload/", middleware.WithCORSOptions(middleware.AuthMiddleware(handlers.UploadHandler), handlers.TusOptionsHandler))
+	mux.HandleFunc("/upload/presign/", middleware.WithCORS(middleware.AuthMiddleware(handlers.PresignUploadHandler)))
+	mux.HandleFunc("/upload/finalize/", middleware.WithCORS(middleware.AuthMiddleware(handlers.FinalizeUploadHandler)))
 	mux.HandleFunc("/cover/upload/", middleware.WithCORS(middleware.AuthMiddleware(handlers.CoverUploadHandler)))
 	mux.HandleFunc("/cover/display/", middleware.WithCORS(middleware.AuthMiddleware(handlers.CoverUploadHandler)))
+	mux.HandleFunc("/cover/from-upload/", middleware.WithCORS(middleware.AuthMiddleware(handlers.CoverFromUploadHandler)))
+	mux.HandleFunc("/cover/history/", middleware.WithCORS(middleware.AuthMiddleware(handlers.CoverHistoryHandler)))
+	mux.HandleFunc("/cover/restore/", middleware.WithCORS(middleware.AuthMiddleware(handlers.RestoreCoverHandler)))
 
 	mux.HandleFunc("/images/trash/recover/", middleware.WithCORS(middleware.AuthMiddleware(handlers.TrashRecover)))
 	mux.HandleFunc("/images/trash/delete/", middleware.WithCORS(middleware.AuthMiddleware(handlers.TrashDelete)))
 	mux.HandleFunc("/images/trash/", middleware.WithCORS(middleware.AuthMiddleware(handlers.TrashHandler)))
+	mux.HandleFunc("/images/similar/trash/", middleware.WithCORS(middleware.AuthMiddleware(handlers.TrashSimilarHandler)))
+	mux.HandleFunc("/images/similar/", middleware.WithCORS(middleware.AuthMiddleware(handlers.SimilarHandler)))
+	mux.HandleFunc("/images/timeline/", middleware.WithCORS(middleware.AuthMiddleware(handlers.TimelineHandler)))
+	mux.HandleFunc("/images/edit/reset/", middleware.WithCORS(middleware.AuthMiddleware(handlers.ResetEditsHandler)))
+	mux.HandleFunc("/images/edit/", middleware.WithCORS(middleware.AuthMiddleware(handlers.EditImageHandler)))
 	mux.HandleFunc("/images/", middleware.WithCORS(middleware.AuthMiddleware(handlers.ImagesHandler)))
 
 	mux.HandleFunc("/api/addvaults", middleware.WithCORS(middleware.AuthMiddleware(handlers.AddVault)))
@@ -36,7 +52,15 @@ func SetupRoutes() *http.ServeMux {
 	mux.HandleFunc("/vault/delete/", middleware.WithCORS(middleware.AuthMiddleware(handlers.DeleteVault)))
 	mux.HandleFunc("/vault/changeTitleAndDesc/", middleware.WithCORS(middleware.AuthMiddleware(handlers.TitleAndDescChange)))
 	mux.HandleFunc("/vault/", middleware.WithCORS(middleware.AuthMiddleware(handlers.GetVaultByID)))
+	mux.HandleFunc("/vault/privacy/", middleware.WithCORS(middleware.AuthMiddleware(handlers.VaultPrivacyHandler)))
 	mux.HandleFunc("/vault/changeStatus/", middleware.WithCORS(middleware.AuthMiddleware(handlers.ChangeCapsuleStatus)))
+	mux.HandleFunc("/vault/statusHistory/", middleware.WithCORS(middleware.AuthMiddleware(handlers.StatusHistoryHandler)))
+	mux.HandleFunc("/vault/recurrence/", middleware.WithCORS(middleware.AuthMiddleware(handlers.RecurrenceHandler)))
+	mux.HandleFunc("/vault/cycles/", middleware.WithCORS(middleware.AuthMiddleware(handlers.CyclesHandler)))
+	mux.HandleFunc("/vault/recipients/", middleware.WithCORS(middleware.AuthMiddleware(handlers.RecipientsHandler)))
+	mux.HandleFunc("/vault/recipients/revoke/", middleware.WithCORS(middleware.AuthMiddleware(handlers.RevokeRecipientHandler)))
+	mux.HandleFunc("/vault/recipients/resend/", middleware.WithCORS(middleware.AuthMiddleware(handlers.ResendRecipientHandler)))
+	mux.HandleFunc("/received/", middleware.WithCORS(middleware.AuthMiddleware(handlers.ReceivedHandler)))
 
 	mux.HandleFunc("/api/update-order", middleware.WithCORS(middleware.AuthMiddleware(handlers.UpdateOrder)))
 	mux.HandleFunc("/api/upload/trash/", middleware.WithCORS(middleware.AuthMiddleware(handlers.TrashUpload)))
@@ -45,6 +69,7 @@ func SetupRoutes() *http.ServeMux {
 	mux.HandleFunc("/time/get/", middleware.WithCORS(middleware.AuthMiddleware(handlers.GetVaultReleaseTimeHandler)))
 
 	mux.HandleFunc("/storage/upload/", middleware.WithCORS(handlers.UploadFile))
+	mux.HandleFunc("/storage/local/", middleware.WithCORS(handlers.LocalObjectHandler))
 
 	mux.HandleFunc("/health", middleware.WithCORS(handlers.HealthHandler))
 
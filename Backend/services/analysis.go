@@ -0,0 +1,155 @@
+package services
+
+import (
+	"context"
+	"image"
+	"image/jpeg"
+	"log"
+	"time"
+
+	"gorm.io/gorm/clause"
+	"photovault/config"
+	"photovault/models"
+)
+
+// backfillBatch is how many uploads each backfill run analyzes.
+const backfillBatch = 200
+
+// thumbnail decodes the smallest rendition of an object, which is far
+// cheaper than the original and all the analysis needs. For videos it is a
+// poster frame.
+func thumbnail(ctx context.Context, key string) (image.Image, error) {
+	rendition, err := EnsureRendition(ctx, key, RenditionSizes[0])
+	if err != nil {
+		return nil, err
+	}
+	return readRendition(ctx, rendition)
+}
+
+func readRendition(ctx context.Context, rendition *models.Rendition) (image.Image, error) {
+	body, _, err := config.Storage.Get(ctx, rendition.Key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return jpeg.Decode(body)
+}
+
+// AnalyzeUpload computes an upload's placeholder and, for images, the
+// perceptual hash near duplicates are found by. The placeholder is of the
+// upload as shown, edits and all, while the hash is of the file itself.
+func AnalyzeUpload(ctx context.Context, upload models.Upload) error {
+	img, err := thumbnail(ctx, upload.Key)
+	if err != nil {
+		return err
+	}
+	shown := img
+	if upload.Edits != nil {
+		rendition, err := EnsureUploadRendition(ctx, &upload, RenditionSizes[0])
+		if err != nil {
+			return err
+		}
+		if shown, err = readRendition(ctx, rendition); err != nil {
+			return err
+		}
+	}
+	blurHash, color, err := Placeholder(shown)
+	if err != nil {
+		return err
+	}
+
+	meta := models.UploadMetadata{
+		UploadID:      upload.ID,
+		Orientation:   1,
+		BlurHash:      blurHash,
+		DominantColor: color,
+	}
+	if !IsVideoType(upload.ContentType) {
+		// Stored as the signed bit pattern, since Postgres has no unsigned
+		// 64-bit integer
+		hash := int64(DHash(img))
+		meta.PerceptualHash = &hash
+	}
+	return config.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "upload_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"perceptual_hash", "blur_hash", "dominant_color"}),
+	}).Create(&meta).Error
+}
+
+// AnalyzeCover computes a cover image's placeholder.
+func AnalyzeCover(ctx context.Context, cover *models.CoverImage) error {
+	img, err := thumbnail(ctx, cover.Key)
+	if err != nil {
+		return err
+	}
+	cover.BlurHash, cover.DominantColor, err = Placeholder(img)
+	if err != nil {
+		return err
+	}
+	return config.DB.Model(cover).Updates(map[string]interface{}{
+		"blur_hash":      cover.BlurHash,
+		"dominant_color": cover.DominantColor,
+	}).Error
+}
+
+// ProcessCover analyzes a newly stored cover image in the background.
+func ProcessCover(cover models.CoverImage) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer cancel()
+		if err := AnalyzeCover(ctx, &cover); err != nil {
+			log.Printf("Failed to analyze cover image %d: %v", cover.ID, err)
+		}
+	}()
+}
+
+// BackfillAnalysis analyzes uploads and covers from before analysis was
+// added, and uploads whose results were lost when their metadata was read
+// again. Only files that already have a thumbnail are picked, so files that
+// can't be decoded aren't retried on every run.
+func BackfillAnalysis() {
+	ctx := context.Background()
+
+	var uploads []models.Upload
+	err := config.DB.Model(&models.Upload{}).
+		Joins("JOIN renditions ON renditions.source_key = uploads.key AND renditions.size = ?", RenditionSizes[0]).
+		Joins("LEFT JOIN upload_metadata ON upload_metadata.upload_id = uploads.id").
+		Where("uploads.pending = ?", false).
+		Where("COALESCE(upload_metadata.blur_hash, '') = '' OR (upload_metadata.perceptual_hash IS NULL AND uploads.content_type NOT LIKE ?)", "video/%").
+		Order("uploads.id").
+		Limit(backfillBatch).
+		Find(&uploads).Error
+	if err != nil {
+		log.Printf("Failed to list uploads to analyze: %v", err)
+		return
+	}
+	failed := 0
+	for _, u := range uploads {
+		if err := AnalyzeUpload(ctx, u); err != nil {
+			log.Printf("Failed to analyze upload %d: %v", u.ID, err)
+			failed++
+		}
+	}
+
+	var covers []models.CoverImage
+	err = config.DB.Model(&models.CoverImage{}).
+		Joins("JOIN renditions ON renditions.source_key = cover_images.key AND renditions.size = ?", RenditionSizes[0]).
+		Where("COALESCE(cover_images.blur_hash, '') = ''").
+		Order("cover_images.id").
+		Limit(backfillBatch).
+		Find(&covers).Error
+	if err != nil {
+		log.Printf("Failed to list cover images to analyze: %v", err)
+		return
+	}
+	for i := range covers {
+		if err := AnalyzeCover(ctx, &covers[i]); err != nil {
+			log.Printf("Failed to analyze cover image %d: %v", covers[i].ID, err)
+			failed++
+		}
+	}
+
+	if n := len(uploads) + len(covers); n > 0 {
+		log.Printf("Analyzed %d uploads and covers, %d failed", n-failed, failed)
+	}
+}
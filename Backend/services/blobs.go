@@ -0,0 +1,185 @@
+package services
+
+import (
+	"context"
+	"fmt"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"photovault/config"
+	"photovault/models"
+	"photovault/storage"
+)
+
+// BlobKey is where the object for a piece of content lives in storage.
+func BlobKey(hash string) string {
+	return "blobs/" + hash[:2] + "/" + hash
+}
+
+// IsBlobUpload reports whether an upload points at a shared blob rather than
+// an object of its own from before deduplication.
+func IsBlobUpload(u *models.Upload) bool {
+	return len(u.ContentHash) == 64 && u.Key == BlobKey(u.ContentHash)
+}
+
+// CommitUpload points an upload at the blob for its content, copying the
+// staged object into place if nobody has stored that content yet. The
+// upload's Size and ContentHash must already be set. The vault is charged the
+// full size but the owner only pays for content they don't already have; if
+// that charge is over limit, storage.ErrTooLarge is returned and nothing is
+// changed. The caller deletes stagedKey once the transaction commits.
+func CommitUpload(ctx context.Context, tx *gorm.DB, vault *models.Vault, upload *models.Upload, stagedKey string, limit int64) (int64, error) {
+	blob := models.Blob{
+		Hash: upload.ContentHash,
+		Key:  BlobKey(upload.ContentHash),
+		Size: upload.Size,
+	}
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&blob).Error; err != nil {
+		return 0, err
+	}
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&blob, "hash = ?", blob.Hash).Error; err != nil {
+		return 0, err
+	}
+
+	owned := models.UserBlob{UserID: vault.UserID, BlobHash: blob.Hash}
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&owned).Error; err != nil {
+		return 0, err
+	}
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		First(&owned, "user_id = ? AND blob_hash = ?", vault.UserID, blob.Hash).Error; err != nil {
+		return 0, err
+	}
+
+	var charged int64
+	if owned.RefCount == 0 {
+		charged = blob.Size
+	}
+	if limit >= 0 && charged > limit {
+		return 0, storage.ErrTooLarge
+	}
+
+	if blob.RefCount == 0 {
+		if err := config.Storage.Copy(ctx, stagedKey, blob.Key, upload.ContentType); err != nil {
+			return 0, fmt.Errorf("failed to store blob: %w", err)
+		}
+		// The key may still be queued from when this content was last removed
+		if err := tx.Where("key = ?", blob.Key).Delete(&models.PendingDeletion{}).Error; err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Model(&blob).UpdateColumn("ref_count", gorm.Expr("ref_count + 1")).Error; err != nil {
+		return 0, err
+	}
+	if err := tx.Model(&models.UserBlob{}).
+		Where("user_id = ? AND blob_hash = ?", vault.UserID, blob.Hash).
+		UpdateColumn("ref_count", gorm.Expr("ref_count + 1")).Error; err != nil {
+		return 0, err
+	}
+
+	if err := tx.Model(&models.User{}).Where("id = ?", vault.UserID).
+		UpdateColumn("total_storage_used", gorm.Expr("total_storage_used + ?", charged)).Error; err != nil {
+		return 0, err
+	}
+	if err := tx.Model(vault).UpdateColumn("total_storage_used", gorm.Expr("total_storage_used + ?", upload.Size)).Error; err != nil {
+		return 0, err
+	}
+
+	upload.Key = blob.Key
+	return charged, tx.Model(upload).Update("key", upload.Key).Error
+}
+
+// ReleaseUpload drops an upload's reference to its blob inside tx and refunds
+// what it was charged. It returns the keys that are no longer referenced; the
+// caller passes them to DeleteObjects once the transaction commits. The
+// upload row itself is left to the caller.
+func ReleaseUpload(tx *gorm.DB, upload *models.Upload, userID uint) ([]string, error) {
+	if upload.Pending {
+		// Never charged and never pointed at a blob
+		return []string{upload.Key}, nil
+	}
+
+	if err := tx.Model(&models.Vault{}).Where("id = ?", upload.VaultID).
+		UpdateColumn("total_storage_used", gorm.Expr("GREATEST(total_storage_used - ?, 0)", upload.Size)).Error; err != nil {
+		return nil, err
+	}
+
+	if !IsBlobUpload(upload) {
+		// Uploaded before deduplication: the object is this upload's alone
+		return []string{upload.Key}, refundUser(tx, userID, upload.Size)
+	}
+
+	var blob models.Blob
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&blob, "hash = ?", upload.ContentHash).Error; err != nil {
+		return nil, err
+	}
+
+	var owned models.UserBlob
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		First(&owned, "user_id = ? AND blob_hash = ?", userID, blob.Hash).Error
+	if err != nil {
+		return nil, err
+	}
+	if owned.RefCount <= 1 {
+		if err := tx.Delete(&owned).Error; err != nil {
+			return nil, err
+		}
+		if err := refundUser(tx, userID, blob.Size); err != nil {
+			return nil, err
+		}
+	} else if err := tx.Model(&owned).UpdateColumn("ref_count", gorm.Expr("ref_count - 1")).Error; err != nil {
+		return nil, err
+	}
+
+	if blob.RefCount <= 1 {
+		if err := tx.Delete(&blob).Error; err != nil {
+			return nil, err
+		}
+		return []string{blob.Key}, nil
+	}
+	return nil, tx.Model(&blob).UpdateColumn("ref_count", gorm.Expr("ref_count - 1")).Error
+}
+
+// BlobInUse reports whether key belongs to a blob that still has references,
+// so a stale deletion doesn't remove content that was uploaded again.
+func BlobInUse(key string) bool {
+	var count int64
+	config.DB.Model(&models.Blob{}).Where("key = ? AND ref_count > 0", key).Count(&count)
+	return count > 0
+}
+
+func refundUser(tx *gorm.DB, userID uint, size int64) error {
+	return tx.Model(&models.User{}).Where("id = ?", userID).
+		UpdateColumn("total_storage_used", gorm.Expr("GREATEST(total_storage_used - ?, 0)", size)).Error
+}
+
+// RemoveUpload permanently deletes an upload row, refunding its storage and
+// queueing its object and renditions for deletion if nothing else references
+// it.
+func RemoveUpload(upload *models.Upload, userID uint) error {
+	var unused []string
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		keys, err := ReleaseUpload(tx, upload, userID)
+		if err != nil {
+			return err
+		}
+		unused = keys
+		if err := tx.Where("upload_id = ?", upload.ID).Delete(&models.UploadMetadata{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("upload_id = ?", upload.ID).Delete(&models.VaultCycleUpload{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(upload).Error
+	})
+	if err != nil {
+		return err
+	}
+	if upload.Edits != nil {
+		// Edited renditions belong to the upload alone
+		DeleteRenditions(RenditionSource(upload))
+	}
+	DeleteRenditions(unused...)
+	DeleteObjects(unused...)
+	return nil
+}
@@ -0,0 +1,169 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"photovault/config"
+	"photovault/models"
+)
+
+// The states a capsule moves through. A vault is filled while open, sealed
+// while buried, and opened by the scheduler once its unlock date passes.
+// Open and unlocked vaults can be archived and brought back.
+const (
+	StatusOpen     = "open"
+	StatusBuried   = "buried"
+	StatusUnlocked = "unlocked"
+	StatusArchived = "archived"
+)
+
+// transitions lists where each state can move to. Unlocked capsules can be
+// buried again with a new unlock date.
+var transitions = map[string][]string{
+	StatusOpen:     {StatusBuried, StatusArchived},
+	StatusBuried:   {StatusUnlocked},
+	StatusUnlocked: {StatusBuried, StatusArchived},
+	StatusArchived: {StatusOpen, StatusUnlocked},
+}
+
+var (
+	// ErrUnknownStatus is returned for a status that isn't one of the states.
+	ErrUnknownStatus = errors.New("unknown capsule status")
+	// ErrInvalidTransition is returned for a move the state machine doesn't
+	// allow, including one to the state the capsule is already in.
+	ErrInvalidTransition = errors.New("capsule can't move to that status")
+	// ErrUnlockDateRequired is returned when burying a capsule without an
+	// unlock date in the future.
+	ErrUnlockDateRequired = errors.New("capsule needs an unlock date in the future")
+	// ErrStillBuried is returned for anything that would open a buried
+	// capsule before its unlock date.
+	ErrStillBuried = errors.New("capsule is buried until its unlock date")
+)
+
+// TransitionError is a refused change of a capsule's status. Err is one of
+// the errors above.
+type TransitionError struct {
+	From string
+	To   string
+	Err  error
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("%s -> %s: %v", e.From, e.To, e.Err)
+}
+
+func (e *TransitionError) Unwrap() error { return e.Err }
+
+// CapsuleStatus is the state of a vault, counting vaults from before states
+// were checked as open.
+func CapsuleStatus(vault *models.Vault) string {
+	if vault.Status == "" {
+		return StatusOpen
+	}
+	return vault.Status
+}
+
+// IsBuried reports whether a vault is sealed.
+func IsBuried(vault *models.Vault) bool {
+	return CapsuleStatus(vault) == StatusBuried
+}
+
+// CheckTransition reports whether a vault may move to status at now.
+// Leaving the archive is checked by ChangeStatus, which knows where the
+// vault was archived from.
+func CheckTransition(vault *models.Vault, to string, now time.Time) error {
+	from := CapsuleStatus(vault)
+	if _, ok := transitions[to]; !ok {
+		return &TransitionError{From: from, To: to, Err: ErrUnknownStatus}
+	}
+	allowed := false
+	for _, s := range transitions[from] {
+		allowed = allowed || s == to
+	}
+	if !allowed {
+		if from == StatusBuried {
+			return &TransitionError{From: from, To: to, Err: ErrStillBuried}
+		}
+		return &TransitionError{From: from, To: to, Err: ErrInvalidTransition}
+	}
+
+	switch to {
+	case StatusBuried:
+		if vault.UnlockDate == nil || !vault.UnlockDate.After(now) {
+			return &TransitionError{From: from, To: to, Err: ErrUnlockDateRequired}
+		}
+	case StatusUnlocked:
+		if from == StatusBuried && (vault.UnlockDate == nil || now.Before(*vault.UnlockDate)) {
+			return &TransitionError{From: from, To: to, Err: ErrStillBuried}
+		}
+	}
+	return nil
+}
+
+// CheckUnlockDate reports whether a vault's unlock date may be changed to
+// date. A buried capsule's date can be pushed back but not brought forward,
+// which would open it early.
+func CheckUnlockDate(vault *models.Vault, date time.Time) error {
+	if IsBuried(vault) && vault.UnlockDate != nil && date.Before(*vault.UnlockDate) {
+		return &TransitionError{From: StatusBuried, To: StatusBuried, Err: ErrStillBuried}
+	}
+	return nil
+}
+
+// ChangeStatus moves a vault to status and records the change. actorID is
+// the user making it, or nil for the scheduler. The vault is only changed
+// if nobody else changed it first.
+func ChangeStatus(vault *models.Vault, to string, actorID *uint) error {
+	now := time.Now()
+	if err := CheckTransition(vault, to, now); err != nil {
+		return err
+	}
+	from := CapsuleStatus(vault)
+
+	if from == StatusArchived {
+		// Archived capsules go back to the state they were archived from
+		var archived models.VaultStatusChange
+		err := config.DB.Where("vault_id = ? AND to_status = ?", vault.ID, StatusArchived).
+			Order("created_at DESC, id DESC").First(&archived).Error
+		previous := StatusOpen
+		if err == nil {
+			previous = archived.FromStatus
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		if to != previous {
+			return &TransitionError{From: from, To: to, Err: ErrInvalidTransition}
+		}
+	}
+
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		query := tx.Model(&models.Vault{}).Where("id = ?", vault.ID)
+		if vault.Status == "" {
+			query = query.Where("status = '' OR status IS NULL")
+		} else {
+			query = query.Where("status = ?", vault.Status)
+		}
+		result := query.Update("status", to)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return &TransitionError{From: from, To: to, Err: ErrInvalidTransition}
+		}
+		return tx.Create(&models.VaultStatusChange{
+			VaultID:    vault.ID,
+			FromStatus: from,
+			ToStatus:   to,
+			ActorID:    actorID,
+			CreatedAt:  now,
+		}).Error
+	})
+	if err != nil {
+		return err
+	}
+	vault.Status = to
+	return nil
+}
@@ -0,0 +1,53 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"photovault/models"
+)
+
+func TestCheckTransition(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	future, past := now.Add(time.Hour), now.Add(-time.Hour)
+
+	tests := []struct {
+		name   string
+		status string
+		unlock *time.Time
+		to     string
+		err    error
+	}{
+		{"bury", StatusOpen, &future, StatusBuried, nil},
+		{"bury a vault from before states", "", &future, StatusBuried, nil},
+		{"bury without a date", StatusOpen, nil, StatusBuried, ErrUnlockDateRequired},
+		{"bury with a past date", StatusOpen, &past, StatusBuried, ErrUnlockDateRequired},
+		{"bury with the date now", StatusOpen, &now, StatusBuried, ErrUnlockDateRequired},
+		{"unlock when due", StatusBuried, &past, StatusUnlocked, nil},
+		{"unlock right on time", StatusBuried, &now, StatusUnlocked, nil},
+		{"unlock early", StatusBuried, &future, StatusUnlocked, ErrStillBuried},
+		{"dig up", StatusBuried, &future, StatusOpen, ErrStillBuried},
+		{"archive buried", StatusBuried, &future, StatusArchived, ErrStillBuried},
+		{"rebury", StatusUnlocked, &future, StatusBuried, nil},
+		{"archive", StatusUnlocked, &past, StatusArchived, nil},
+		{"archive open", StatusOpen, nil, StatusArchived, nil},
+		{"restore", StatusArchived, nil, StatusOpen, nil},
+		{"restore unlocked", StatusArchived, &past, StatusUnlocked, nil},
+		{"bury archived", StatusArchived, &future, StatusBuried, ErrInvalidTransition},
+		{"open to open", StatusOpen, nil, StatusOpen, ErrInvalidTransition},
+		{"unlock open", StatusOpen, &past, StatusUnlocked, ErrInvalidTransition},
+		{"unknown", StatusOpen, nil, "deleted", ErrUnknownStatus},
+	}
+	for _, tt := range tests {
+		vault := &models.Vault{Status: tt.status, UnlockDate: tt.unlock}
+		err := CheckTransition(vault, tt.to, now)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: CheckTransition = %v, want %v", tt.name, err, tt.err)
+		}
+		var te *TransitionError
+		if err != nil && !errors.As(err, &te) {
+			t.Errorf("%s: %v is not a TransitionError", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"photovault/config"
+	"photovault/storage"
+)
+
+// sniffSize is how much of a file is looked at to tell its type, the same
+// as net/http uses.
+const sniffSize = 512
+
+// ErrUnsupportedType is returned for files that aren't an allowed image or
+// video.
+var ErrUnsupportedType = errors.New("file type not allowed")
+
+// allowedTypes are the types uploads may have, with the extension stored
+// objects get. Anything a browser would render as a document, HTML and SVG
+// included, is left out so nothing stored can run script from our origin.
+var allowedTypes = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"image/heic":      ".heic",
+	"image/heif":      ".heif",
+	"image/avif":      ".avif",
+	"video/mp4":       ".mp4",
+	"video/quicktime": ".mov",
+}
+
+// IsAllowedType reports whether contentType may be uploaded and served.
+func IsAllowedType(contentType string) bool {
+	_, ok := allowedTypes[contentType]
+	return ok
+}
+
+// IsImageType reports whether contentType is an allowed image type.
+func IsImageType(contentType string) bool {
+	return IsAllowedType(contentType) && strings.HasPrefix(contentType, "image/")
+}
+
+// NeedsDisplayCopy reports whether originals of contentType get a JPEG
+// display copy, because most browsers can't show them.
+func NeedsDisplayCopy(contentType string) bool {
+	switch contentType {
+	case "image/heic", "image/heif", "image/avif":
+		return true
+	}
+	return false
+}
+
+// TypeExtension is the file extension for an allowed type.
+func TypeExtension(contentType string) string {
+	return allowedTypes[contentType]
+}
+
+// SniffContentType tells a file's type from its first bytes, ignoring its
+// name and whatever type the client claimed.
+func SniffContentType(head []byte) string {
+	if t := sniffISOBMFF(head); t != "" {
+		return t
+	}
+	t, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	return t
+}
+
+// sniffISOBMFF reads the brands of an ftyp box, which net/http only knows
+// for plain MP4. HEIC, AVIF and QuickTime share the container.
+func sniffISOBMFF(head []byte) string {
+	if len(head) < 16 || string(head[4:8]) != "ftyp" {
+		return ""
+	}
+	size := int(head[0])<<24 | int(head[1])<<16 | int(head[2])<<8 | int(head[3])
+	if size < 16 || size > len(head) {
+		size = len(head)
+	}
+	brands := map[string]bool{string(head[8:12]): true}
+	for i := 16; i+4 <= size; i += 4 {
+		brands[string(head[i:i+4])] = true
+	}
+
+	has := func(names ...string) bool {
+		for _, n := range names {
+			if brands[n] {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case has("avif", "avis"):
+		return "image/avif"
+	case has("heic", "heix", "heim", "heis", "hevc", "hevx"):
+		return "image/heic"
+	case has("mif1", "msf1"):
+		return "image/heif"
+	case has("qt  "):
+		return "video/quicktime"
+	case has("isom", "iso2", "iso4", "iso5", "iso6", "mp41", "mp42", "avc1", "M4V ", "dash"):
+		return "video/mp4"
+	}
+	return ""
+}
+
+// SniffReader reads the start of r to tell its type and returns a reader
+// that still yields all of r. It fails with ErrUnsupportedType unless the
+// type is allowed.
+func SniffReader(r io.Reader) (string, io.Reader, error) {
+	head := make([]byte, sniffSize)
+	n, err := io.ReadFull(r, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", nil, err
+	}
+	head = head[:n]
+
+	contentType := SniffContentType(head)
+	if !IsAllowedType(contentType) {
+		return contentType, nil, ErrUnsupportedType
+	}
+	return contentType, io.MultiReader(bytes.NewReader(head), r), nil
+}
+
+// SniffObject tells the type of a stored object from its first bytes.
+func SniffObject(ctx context.Context, key string) (string, error) {
+	body, _, err := config.Storage.GetRange(ctx, key, storage.GetOptions{Range: "bytes=0-511"})
+	if errors.Is(err, storage.ErrInvalidRange) {
+		// Only an empty object has no first byte
+		return "", ErrUnsupportedType
+	}
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	head, err := io.ReadAll(io.LimitReader(body, sniffSize))
+	if err != nil {
+		return "", err
+	}
+	contentType := SniffContentType(head)
+	if !IsAllowedType(contentType) {
+		return contentType, ErrUnsupportedType
+	}
+	return contentType, nil
+}
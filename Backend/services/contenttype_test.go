@@ -0,0 +1,73 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// ftyp builds an ftyp box with a major brand and compatible brands.
+func ftyp(major string, compatible ...string) []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(16+4*len(compatible)))
+	b = append(b, "ftyp"+major+"\x00\x00\x00\x00"...)
+	for _, c := range compatible {
+		b = append(b, c...)
+	}
+	return b
+}
+
+func TestSniffContentType(t *testing.T) {
+	tests := []struct {
+		name string
+		head []byte
+		want string
+	}{
+		{"jpeg", []byte("\xFF\xD8\xFF\xE0\x00\x10JFIF\x00"), "image/jpeg"},
+		{"png", append(pngSignature, "\x00\x00\x00\x0DIHDR"...), "image/png"},
+		{"gif", []byte("GIF89a\x01\x00\x01\x00"), "image/gif"},
+		{"webp", []byte("RIFF\x24\x00\x00\x00WEBPVP8 "), "image/webp"},
+		{"heic", ftyp("heic", "mif1", "heic"), "image/heic"},
+		{"heic by compatible brand", ftyp("mif1", "mif1", "heic"), "image/heic"},
+		{"heif", ftyp("mif1", "mif1"), "image/heif"},
+		{"avif", ftyp("avif", "mif1", "miaf"), "image/avif"},
+		{"quicktime", ftyp("qt  ", "qt  "), "video/quicktime"},
+		{"mp4", ftyp("isom", "isom", "iso2", "mp41"), "video/mp4"},
+		{"m4v", ftyp("M4V ", "M4V ", "mp42"), "video/mp4"},
+		{"ftyp size past the head", append(binary.BigEndian.AppendUint32(nil, 4096), "ftypheic\x00\x00\x00\x00"...), "image/heic"},
+		{"unknown brand", ftyp("crx ", "crx "), "application/octet-stream"},
+		{"html", []byte("<!DOCTYPE html><script>alert(1)</script>"), "text/html"},
+		{"svg", []byte(`<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg"/>`), "text/xml"},
+		{"empty", nil, "text/plain"},
+	}
+	for _, tt := range tests {
+		if got := SniffContentType(tt.head); got != tt.want {
+			t.Errorf("%s: SniffContentType = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSniffReader(t *testing.T) {
+	for _, tt := range []struct {
+		head []byte
+		want string
+	}{
+		{ftyp("heic", "mif1", "heic"), "image/heic"},
+		{ftyp("avif", "mif1", "miaf"), "image/avif"},
+	} {
+		file := append(tt.head, bytes.Repeat([]byte{0xAB}, 1000)...)
+		contentType, r, err := SniffReader(bytes.NewReader(file))
+		if err != nil || contentType != tt.want {
+			t.Fatalf("SniffReader = %q, %v, want %q", contentType, err, tt.want)
+		}
+		if got, _ := io.ReadAll(r); !bytes.Equal(got, file) {
+			t.Errorf("SniffReader lost bytes: read %d of %d", len(got), len(file))
+		}
+	}
+
+	if _, _, err := SniffReader(strings.NewReader("<html><body>hi</body></html>")); !errors.Is(err, ErrUnsupportedType) {
+		t.Errorf("SniffReader(html) = %v, want ErrUnsupportedType", err)
+	}
+}
@@ -0,0 +1,197 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"log"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"gorm.io/gorm"
+	"photovault/config"
+	"photovault/models"
+	"photovault/storage"
+)
+
+// coverHistoryLimit is how many replaced covers a vault keeps to switch
+// back to. Older ones are deleted along with their objects.
+const coverHistoryLimit = 5
+
+// coverMaxEdge is the longest edge of a cover rendered from an upload.
+const coverMaxEdge = 2048
+
+// ErrInvalidCrop is returned for crops outside the image or of no size, and
+// for malformed aspect ratios.
+var ErrInvalidCrop = errors.New("invalid crop")
+
+// CoverKey is where a cover image is stored. Every cover gets its own key,
+// so replacing a cover never overwrites one still in the history.
+func CoverKey(vaultID, coverID uint, ext string) string {
+	return fmt.Sprintf("vaults/%d/cover/%d_cover%s", vaultID, coverID, ext)
+}
+
+// ParseAspect reads an aspect ratio written "16:9", or "" for none.
+func ParseAspect(s string) (float64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	w, h, ok := strings.Cut(s, ":")
+	if !ok {
+		return 0, ErrInvalidCrop
+	}
+	wn, err1 := strconv.ParseFloat(w, 64)
+	hn, err2 := strconv.ParseFloat(h, 64)
+	if err1 != nil || err2 != nil || wn <= 0 || hn <= 0 || math.IsInf(wn/hn, 0) {
+		return 0, ErrInvalidCrop
+	}
+	return wn / hn, nil
+}
+
+// RenderCover cuts crop out of src, or the whole image without one, trims
+// the result to aspect around its centre if one is given, and fits it
+// within coverMaxEdge.
+func RenderCover(src image.Image, crop *models.CropRect, aspect float64) (image.Image, error) {
+	rect, err := cropRect(src.Bounds(), crop)
+	if err != nil {
+		return nil, err
+	}
+
+	if aspect > 0 {
+		w, h := rect.Dx(), rect.Dy()
+		if float64(w)/float64(h) > aspect {
+			trim := w - int(math.Round(float64(h)*aspect))
+			rect.Min.X += trim / 2
+			rect.Max.X -= trim - trim/2
+		} else {
+			trim := h - int(math.Round(float64(w)/aspect))
+			rect.Min.Y += trim / 2
+			rect.Max.Y -= trim - trim/2
+		}
+	}
+	if rect.Dx() < 1 || rect.Dy() < 1 {
+		return nil, ErrInvalidCrop
+	}
+
+	return imaging.Fit(imaging.Crop(src, rect), coverMaxEdge, coverMaxEdge, imaging.Lanczos), nil
+}
+
+// CoverFromUpload renders a cover for a vault from one of its owner's
+// uploads and makes it the vault's cover. crop applies to the upload as it
+// is shown, with its edits. Videos give their poster frame. The result is a
+// fresh JPEG, so none of the upload's metadata comes along.
+func CoverFromUpload(ctx context.Context, vault *models.Vault, upload *models.Upload, crop *models.CropRect, aspect float64) (*models.CoverImage, error) {
+	select {
+	case renditionSlots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	src, err := decodeUpload(ctx, upload)
+	if err != nil {
+		<-renditionSlots
+		return nil, err
+	}
+	img, err := RenderCover(src, crop, aspect)
+	if err != nil {
+		<-renditionSlots
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: renditionQuality})
+	<-renditionSlots
+	if err != nil {
+		return nil, err
+	}
+
+	cover := models.CoverImage{
+		Filename:       strings.TrimSuffix(upload.Filename, path.Ext(upload.Filename)) + "_cover.jpg",
+		ContentType:    "image/jpeg",
+		SourceUploadID: &upload.ID,
+	}
+	if err := SaveCover(ctx, vault, &cover, &buf, int64(buf.Len())); err != nil {
+		return nil, err
+	}
+	return &cover, nil
+}
+
+// SaveCover stores body as a new cover of vault, up to maxSize bytes, and
+// makes it the current one. cover needs its Filename and ContentType set.
+func SaveCover(ctx context.Context, vault *models.Vault, cover *models.CoverImage, body io.Reader, maxSize int64) error {
+	// The key is made from the row's ID, so the row goes in first under a
+	// placeholder key
+	cover.VaultID = vault.ID
+	cover.Key = fmt.Sprintf("pending-cover-%d", time.Now().UnixNano())
+	if err := config.DB.Create(cover).Error; err != nil {
+		return err
+	}
+	cover.Key = CoverKey(vault.ID, cover.ID, TypeExtension(cover.ContentType))
+	if _, _, err := storage.PutHashed(ctx, config.Storage, cover.Key, body, maxSize, cover.ContentType); err != nil {
+		config.DB.Delete(cover)
+		return err
+	}
+	if err := config.DB.Model(cover).Update("key", cover.Key).Error; err != nil {
+		config.DB.Delete(cover)
+		DeleteObjects(cover.Key)
+		return err
+	}
+
+	if err := SetCover(vault, cover); err != nil {
+		return err
+	}
+	ProcessCover(*cover)
+	return nil
+}
+
+// SetCover makes cover the vault's current cover. The one it replaces joins
+// the history, and history beyond coverHistoryLimit is removed.
+func SetCover(vault *models.Vault, cover *models.CoverImage) error {
+	now := time.Now()
+	err := config.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.CoverImage{}).
+			Where("vault_id = ? AND id <> ? AND replaced_at IS NULL", vault.ID, cover.ID).
+			Update("replaced_at", now).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(cover).Update("replaced_at", nil).Error; err != nil {
+			return err
+		}
+		return tx.Model(vault).Update("cover_image_id", cover.ID).Error
+	})
+	if err != nil {
+		return err
+	}
+	cover.ReplacedAt = nil
+	vault.CoverImageID = &cover.ID
+
+	var stale []models.CoverImage
+	err = config.DB.Where("vault_id = ? AND replaced_at IS NOT NULL", vault.ID).
+		Order("replaced_at DESC, id DESC").
+		Offset(coverHistoryLimit).
+		Find(&stale).Error
+	if err != nil {
+		log.Printf("Failed to list old covers of vault %d: %v", vault.ID, err)
+		return nil
+	}
+	for i := range stale {
+		RemoveCover(&stale[i])
+	}
+	return nil
+}
+
+// RemoveCover deletes a cover image, its renditions and its object.
+func RemoveCover(cover *models.CoverImage) {
+	if err := config.DB.Delete(cover).Error; err != nil {
+		log.Printf("Failed to delete cover image %d: %v", cover.ID, err)
+		return
+	}
+	DeleteRenditions(cover.Key)
+	DeleteObjects(cover.Key)
+}
@@ -0,0 +1,210 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"log"
+	"math"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"photovault/config"
+	"photovault/models"
+)
+
+// ErrInvalidEdits is returned for an edit list with a rotation other than a
+// quarter turn or a crop outside the image.
+var ErrInvalidEdits = errors.New("invalid edits")
+
+// ErrNotEditable is returned for uploads that can't be edited, which are
+// videos and files that can't be decoded.
+var ErrNotEditable = errors.New("upload can't be edited")
+
+// NormalizeEdits checks an edit list and brings it to one form, so the same
+// edits always make the same renditions. A list that changes nothing comes
+// back nil.
+func NormalizeEdits(edits *models.ImageEdits) (*models.ImageEdits, error) {
+	if edits == nil {
+		return nil, nil
+	}
+	out := *edits
+	out.Rotate = (edits.Rotate%360 + 360) % 360
+	if out.Rotate%90 != 0 {
+		return nil, ErrInvalidEdits
+	}
+	if out.AutoOrient != nil && *out.AutoOrient {
+		out.AutoOrient = nil
+	}
+	if c := out.Crop; c != nil {
+		if !validCrop(c) {
+			return nil, ErrInvalidEdits
+		}
+		if c.X == 0 && c.Y == 0 && c.Width >= 1 && c.Height >= 1 {
+			out.Crop = nil
+		}
+	}
+	if out.AutoOrient == nil && out.Rotate == 0 && out.Crop == nil {
+		return nil, nil
+	}
+	return &out, nil
+}
+
+// RenditionSource is the source key an upload's renditions are stored
+// under. Unedited uploads share the renditions of their object; edited ones
+// get a key of their own that changes with the edits and the object, so an
+// edit or a replaced object never serves stale renditions.
+func RenditionSource(upload *models.Upload) string {
+	if upload.Edits == nil {
+		return upload.Key
+	}
+	edits, _ := json.Marshal(upload.Edits)
+	sum := sha256.Sum256(append([]byte(upload.Key+"\x00"), edits...))
+	return fmt.Sprintf("edits/%d/%x", upload.ID, sum[:8])
+}
+
+// ApplyEdits turns and crops an image, already oriented or not as the edits
+// ask, the way they say.
+func ApplyEdits(img image.Image, edits *models.ImageEdits) (image.Image, error) {
+	// imaging turns counter-clockwise
+	switch edits.Rotate {
+	case 90:
+		img = imaging.Rotate270(img)
+	case 180:
+		img = imaging.Rotate180(img)
+	case 270:
+		img = imaging.Rotate90(img)
+	}
+	if edits.Crop != nil {
+		rect, err := cropRect(img.Bounds(), edits.Crop)
+		if err != nil {
+			return nil, err
+		}
+		img = imaging.Crop(img, rect)
+	}
+	return img, nil
+}
+
+// decodeUpload reads an upload as it is shown, with its edits applied.
+func decodeUpload(ctx context.Context, upload *models.Upload) (image.Image, error) {
+	if upload.Edits == nil {
+		return decodeObject(ctx, upload.Key)
+	}
+	autoOrient := upload.Edits.AutoOrient == nil || *upload.Edits.AutoOrient
+	img, err := decodeOriented(ctx, upload.Key, autoOrient)
+	if err != nil {
+		return nil, err
+	}
+	return ApplyEdits(img, upload.Edits)
+}
+
+// EnsureUploadRendition returns the rendition of an upload at size as it is
+// shown, with its edits applied, generating it first if need be.
+func EnsureUploadRendition(ctx context.Context, upload *models.Upload, size int) (*models.Rendition, error) {
+	if upload.Edits == nil {
+		return EnsureRendition(ctx, upload.Key, size)
+	}
+	source := RenditionSource(upload)
+	var rendition models.Rendition
+	if err := config.DB.Where("source_key = ? AND size = ?", source, size).First(&rendition).Error; err == nil {
+		return &rendition, nil
+	}
+	made, err := renderUpload(ctx, upload, []int{size})
+	if err != nil {
+		return nil, err
+	}
+	return &made[0], nil
+}
+
+// renderUpload stores the renditions of an upload as it is shown.
+func renderUpload(ctx context.Context, upload *models.Upload, sizes []int) ([]models.Rendition, error) {
+	return renderSizes(ctx, RenditionSource(upload), sizes, func() (image.Image, error) {
+		return decodeUpload(ctx, upload)
+	})
+}
+
+// uploadSizes are the renditions made for an upload up front. Edited
+// uploads and those in formats browsers can't show get a display copy, and
+// videos a full-size poster frame.
+func uploadSizes(upload *models.Upload) []int {
+	if upload.Edits != nil || NeedsDisplayCopy(upload.ContentType) || IsVideoType(upload.ContentType) {
+		return append([]int{DisplaySize}, RenditionSizes...)
+	}
+	return RenditionSizes
+}
+
+// SetEdits replaces an upload's edit list, nil putting it back as uploaded,
+// and renders the new version in the background. The renditions of the
+// edits it replaces are deleted; the original object is left alone.
+func SetEdits(ctx context.Context, upload *models.Upload, edits *models.ImageEdits) error {
+	if IsVideoType(upload.ContentType) {
+		return ErrNotEditable
+	}
+	edits, err := NormalizeEdits(edits)
+	if err != nil {
+		return err
+	}
+	if edits != nil && edits.Crop != nil {
+		// Catch crops that round to nothing on this image before saving them
+		probe := *upload
+		probe.Edits = edits
+		if _, err := EnsureUploadRendition(ctx, &probe, RenditionSizes[0]); errors.Is(err, ErrInvalidCrop) {
+			return ErrInvalidEdits
+		} else if errors.Is(err, ErrNotImage) {
+			return ErrNotEditable
+		}
+	}
+
+	old := RenditionSource(upload)
+	if err := config.DB.Model(upload).Select("Edits").Updates(&models.Upload{Edits: edits}).Error; err != nil {
+		return err
+	}
+	upload.Edits = edits
+	if old != upload.Key && old != RenditionSource(upload) {
+		DeleteRenditions(old)
+	}
+
+	go func(upload models.Upload) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer cancel()
+		if _, err := renderUpload(ctx, &upload, uploadSizes(&upload)); err != nil && !errors.Is(err, ErrNotImage) {
+			log.Printf("Failed to generate renditions of edited upload %d: %v", upload.ID, err)
+		}
+		if err := AnalyzeUpload(ctx, upload); err != nil && !errors.Is(err, ErrNotImage) {
+			log.Printf("Failed to analyze upload %d: %v", upload.ID, err)
+		}
+	}(*upload)
+	return nil
+}
+
+// validCrop reports whether a crop lies within the image and has a size.
+func validCrop(c *models.CropRect) bool {
+	const slack = 1e-6
+	return c.X >= 0 && c.Y >= 0 && c.Width > 0 && c.Height > 0 &&
+		c.X+c.Width <= 1+slack && c.Y+c.Height <= 1+slack
+}
+
+// cropRect is the pixel rectangle of a crop within bounds, or all of bounds
+// without one.
+func cropRect(b image.Rectangle, crop *models.CropRect) (image.Rectangle, error) {
+	if crop == nil {
+		return b, nil
+	}
+	if !validCrop(crop) {
+		return image.Rectangle{}, ErrInvalidCrop
+	}
+	w, h := float64(b.Dx()), float64(b.Dy())
+	rect := image.Rect(
+		b.Min.X+int(math.Round(crop.X*w)),
+		b.Min.Y+int(math.Round(crop.Y*h)),
+		b.Min.X+int(math.Round((crop.X+crop.Width)*w)),
+		b.Min.Y+int(math.Round((crop.Y+crop.Height)*h)),
+	).Intersect(b)
+	if rect.Empty() {
+		return image.Rectangle{}, ErrInvalidCrop
+	}
+	return rect, nil
+}
@@ -0,0 +1,55 @@
+package services
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"photovault/models"
+)
+
+func TestNormalizeEdits(t *testing.T) {
+	yes, no := true, false
+	tests := []struct {
+		name string
+		in   *models.ImageEdits
+		want *models.ImageEdits
+		err  error
+	}{
+		{"none", nil, nil, nil},
+		{"empty", &models.ImageEdits{}, nil, nil},
+		{"full turn", &models.ImageEdits{Rotate: 360}, nil, nil},
+		{"auto orient is the default", &models.ImageEdits{AutoOrient: &yes}, nil, nil},
+		{"whole image crop", &models.ImageEdits{Crop: &models.CropRect{Width: 1, Height: 1}}, nil, nil},
+		{"rotate", &models.ImageEdits{Rotate: 90}, &models.ImageEdits{Rotate: 90}, nil},
+		{"rotate past a turn", &models.ImageEdits{Rotate: 450}, &models.ImageEdits{Rotate: 90}, nil},
+		{"rotate counter-clockwise", &models.ImageEdits{Rotate: -90}, &models.ImageEdits{Rotate: 270}, nil},
+		{"no auto orient", &models.ImageEdits{AutoOrient: &no}, &models.ImageEdits{AutoOrient: &no}, nil},
+		{
+			"crop",
+			&models.ImageEdits{AutoOrient: &yes, Crop: &models.CropRect{X: 0.25, Y: 0, Width: 0.5, Height: 1}},
+			&models.ImageEdits{Crop: &models.CropRect{X: 0.25, Y: 0, Width: 0.5, Height: 1}},
+			nil,
+		},
+		{
+			"crop to the edge within rounding",
+			&models.ImageEdits{Crop: &models.CropRect{X: 0.3, Y: 0.1, Width: 0.7000001, Height: 0.9}},
+			&models.ImageEdits{Crop: &models.CropRect{X: 0.3, Y: 0.1, Width: 0.7000001, Height: 0.9}},
+			nil,
+		},
+		{"odd angle", &models.ImageEdits{Rotate: 45}, nil, ErrInvalidEdits},
+		{"crop past the edge", &models.ImageEdits{Crop: &models.CropRect{X: 0.5, Width: 0.6, Height: 1}}, nil, ErrInvalidEdits},
+		{"negative crop", &models.ImageEdits{Crop: &models.CropRect{X: -0.1, Width: 0.5, Height: 0.5}}, nil, ErrInvalidEdits},
+		{"empty crop", &models.ImageEdits{Crop: &models.CropRect{X: 0.1, Y: 0.1}}, nil, ErrInvalidEdits},
+	}
+	for _, tt := range tests {
+		got, err := NormalizeEdits(tt.in)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: NormalizeEdits error = %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: NormalizeEdits = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -1,10 +1,11 @@
 package services
 
 import (
+	"html"
 	"log"
 	"fmt"
+	"time"
 	"photovault/config"
-	"photovault/models"
 	"github.com/resend/resend-go/v2"
 )
 
@@ -83,19 +84,6 @@ func SendOpenEmail(email string, capsuleID uint) {
         return
     }
 
-	var vault models.Vault
-	if err := config.DB.First(&vault, capsuleID).Error; err != nil {
-		log.Println("Vault not found")
-		return
-	}
-
-	vault.Status = "open"
-
-	if err := config.DB.Save(&vault).Error; err != nil {
-		log.Println("Failed to update vault")
-		return
-	}
-
     client := resend.NewClient(apiKey)
 
     // Link to open the capsule
@@ -137,3 +125,180 @@ func SendOpenEmail(email string, capsuleID uint) {
 
     log.Printf("Capsule email sent to %s: %+v", email, sent)
 }
+
+// SendRecipientEmail tells someone a capsule was shared with them, with the
+// owner's message and a link that opens it without an account.
+func SendRecipientEmail(email, from, message, token string) error {
+	apiKey := config.GetEnv("resend_api", "")
+	if apiKey == "" {
+		return fmt.Errorf("resend_api is not set")
+	}
+
+	client := resend.NewClient(apiKey)
+
+	capsuleURL := fmt.Sprintf("https://www.myphotocapsule.com/shared/%s", token)
+
+	note := ""
+	if message != "" {
+		note = fmt.Sprintf(`
+        <blockquote style="font-size: 16px; color: #444; border-left: 4px solid #4CAF50; margin: 20px 0; padding: 10px 16px; white-space: pre-wrap;">%s</blockquote>`,
+			html.EscapeString(message))
+	}
+
+	body := fmt.Sprintf(`
+    <div style="font-family: Arial, sans-serif; max-width: 600px; margin: auto; padding: 20px; border: 1px solid #e0e0e0; border-radius: 8px; background-color: #fafafa;">
+        <h2 style="color: #333; text-align: center;">A Capsule Was Left for You</h2>
+        <p style="font-size: 16px; color: #555; text-align: center;">
+            %s shared a time capsule with you, and it has just opened. Click the button below to view it:
+        </p>%s
+        <div style="text-align: center; margin: 30px 0;">
+            <a href="%s"
+               style="display: inline-block; padding: 14px 28px; background-color: #4CAF50; color: white; font-size: 16px; font-weight: bold; text-decoration: none; border-radius: 6px;">
+               Open Capsule
+            </a>
+        </div>
+        <p style="font-size: 14px; color: #777; text-align: center;">
+            Sign up with this link to keep the capsule in your own account.
+        </p>
+    </div>
+    `, html.EscapeString(from), note, capsuleURL)
+
+	params := &resend.SendEmailRequest{
+		From:    "no-reply@myphotocapsule.com",
+		To:      []string{email},
+		Subject: from + " shared a capsule with you",
+		Html:    body,
+	}
+
+	sent, err := client.Emails.Send(params)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Recipient email sent to %s: %+v", email, sent)
+	return nil
+}
+
+// SendReminderEmail reminds an owner that one of their buried capsules
+// unlocks soon, counting down the days left. unlockDate is shown in its own
+// zone.
+func SendReminderEmail(email, title string, capsuleID uint, unlockDate time.Time, daysLeft int) error {
+	apiKey := config.GetEnv("resend_api", "")
+	if apiKey == "" {
+		return fmt.Errorf("resend_api is not set")
+	}
+
+	client := resend.NewClient(apiKey)
+
+	capsuleURL := fmt.Sprintf("https://www.myphotocapsule.com/view/%d", capsuleID)
+
+	countdown := fmt.Sprintf("%d days", daysLeft)
+	if daysLeft == 1 {
+		countdown = "1 day"
+	}
+
+	body := fmt.Sprintf(`
+    <div style="font-family: Arial, sans-serif; max-width: 600px; margin: auto; padding: 20px; border: 1px solid #e0e0e0; border-radius: 8px; background-color: #fafafa;">
+        <h2 style="color: #333; text-align: center;">%s Left</h2>
+        <p style="font-size: 16px; color: #555; text-align: center;">
+            Your capsule <strong>%s</strong> unlocks on %s. We'll email you again the moment it opens.
+        </p>
+        <div style="text-align: center; margin: 30px 0;">
+            <a href="%s"
+               style="display: inline-block; padding: 14px 28px; background-color: #4CAF50; color: white; font-size: 16px; font-weight: bold; text-decoration: none; border-radius: 6px;">
+               View Capsule
+            </a>
+        </div>
+        <p style="font-size: 14px; color: #777; text-align: center;">
+            You can turn these reminders off in your notification settings.
+        </p>
+    </div>
+    `, countdown, html.EscapeString(title), unlockDate.Format("January 2, 2006 at 15:04 MST"), capsuleURL)
+
+	params := &resend.SendEmailRequest{
+		From:    "no-reply@myphotocapsule.com",
+		To:      []string{email},
+		Subject: fmt.Sprintf("%s until your capsule opens", countdown),
+		Html:    body,
+	}
+
+	sent, err := client.Emails.Send(params)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Reminder email sent to %s: %+v", email, sent)
+	return nil
+}
+
+// SendRecapEmail tells an owner a recurring capsule has opened for another
+// cycle, with how much was added since it last opened and, unless the
+// series has ended, when it opens next. next is shown in its own zone.
+func SendRecapEmail(email, title string, capsuleID uint, cycle, added int, next *time.Time) error {
+	apiKey := config.GetEnv("resend_api", "")
+	if apiKey == "" {
+		return fmt.Errorf("resend_api is not set")
+	}
+
+	client := resend.NewClient(apiKey)
+
+	capsuleURL := fmt.Sprintf("https://www.myphotocapsule.com/view/%d", capsuleID)
+
+	memories := fmt.Sprintf("%d new memories were", added)
+	if added == 1 {
+		memories = "1 new memory was"
+	}
+	upcoming := "This was its last opening."
+	if next != nil {
+		upcoming = fmt.Sprintf("Add to it while it's open; it will be sealed again and open next on %s.",
+			next.Format("January 2, 2006 at 15:04 MST"))
+	}
+
+	body := fmt.Sprintf(`
+    <div style="font-family: Arial, sans-serif; max-width: 600px; margin: auto; padding: 20px; border: 1px solid #e0e0e0; border-radius: 8px; background-color: #fafafa;">
+        <h2 style="color: #333; text-align: center;">Your Capsule Opened Again!</h2>
+        <p style="font-size: 16px; color: #555; text-align: center;">
+            <strong>%s</strong> has opened for the %s time. %s added since it last opened.
+        </p>
+        <div style="text-align: center; margin: 30px 0;">
+            <a href="%s"
+               style="display: inline-block; padding: 14px 28px; background-color: #4CAF50; color: white; font-size: 16px; font-weight: bold; text-decoration: none; border-radius: 6px;">
+               Open Capsule
+            </a>
+        </div>
+        <p style="font-size: 14px; color: #777; text-align: center;">
+            %s
+        </p>
+    </div>
+    `, html.EscapeString(title), ordinal(cycle), memories, capsuleURL, upcoming)
+
+	params := &resend.SendEmailRequest{
+		From:    "no-reply@myphotocapsule.com",
+		To:      []string{email},
+		Subject: fmt.Sprintf("Your capsule opened for the %s time", ordinal(cycle)),
+		Html:    body,
+	}
+
+	sent, err := client.Emails.Send(params)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Recap email sent to %s: %+v", email, sent)
+	return nil
+}
+
+func ordinal(n int) string {
+	suffix := "th"
+	if n%100 < 11 || n%100 > 13 {
+		switch n % 10 {
+		case 1:
+			suffix = "st"
+		case 2:
+			suffix = "nd"
+		case 3:
+			suffix = "rd"
+		}
+	}
+	return fmt.Sprintf("%d%s", n, suffix)
+}
@@ -0,0 +1,273 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gen2brain/heic"
+	"github.com/rwcarlsen/goexif/exif"
+	"gorm.io/gorm/clause"
+	"photovault/config"
+	"photovault/models"
+)
+
+// metadataHeadSize is how much of an object is read for its metadata. EXIF
+// and XMP sit in the first few segments of a JPEG, well inside this.
+const metadataHeadSize = 1 << 20
+
+// exifTimeLayout is how EXIF writes dates.
+const exifTimeLayout = "2006:01:02 15:04:05"
+
+// ExtractMetadata reads the EXIF and XMP of a stored upload, or the movie
+// header of a video, and saves what it finds, replacing anything recorded
+// before. Files with no metadata still get a row, with whatever dimensions
+// can be decoded. With private set the camera and location are left out.
+func ExtractMetadata(ctx context.Context, upload models.Upload, private bool) (*models.UploadMetadata, error) {
+	var meta *models.UploadMetadata
+	if IsVideoType(upload.ContentType) {
+		var err error
+		if meta, err = videoMetadata(ctx, upload.Key); err != nil {
+			return nil, err
+		}
+	} else {
+		body, _, err := config.Storage.Get(ctx, upload.Key)
+		if err != nil {
+			return nil, err
+		}
+		head, err := io.ReadAll(io.LimitReader(body, metadataHeadSize))
+		body.Close()
+		if err != nil {
+			return nil, err
+		}
+		meta = ParseMetadata(head)
+	}
+
+	meta.UploadID = upload.ID
+	if private {
+		reduceMetadata(meta)
+	}
+	err := config.DB.Clauses(clause.OnConflict{UpdateAll: true}).Create(meta).Error
+	return meta, err
+}
+
+// ParseMetadata pulls capture time, camera, orientation, dimensions and GPS
+// out of the start of an image file. EXIF wins over XMP where both are set.
+func ParseMetadata(head []byte) *models.UploadMetadata {
+	meta := &models.UploadMetadata{Orientation: 1}
+
+	source := head
+	if bytes.HasPrefix(head, pngSignature) {
+		source = pngChunk(head, "eXIf")
+	} else if sniffISOBMFF(head) != "" {
+		// HEIF keeps EXIF as an item, its TIFF block behind an "Exif" header.
+		// The item type of its entry in iinf can look the same.
+		source = nil
+		for rest := head; ; {
+			i := bytes.Index(rest, []byte("Exif\x00\x00"))
+			if i < 0 {
+				break
+			}
+			rest = rest[i+6:]
+			if bytes.HasPrefix(rest, []byte("MM\x00*")) || bytes.HasPrefix(rest, []byte("II*\x00")) {
+				source = rest
+				break
+			}
+		}
+	}
+	if x, err := exif.Decode(bytes.NewReader(source)); err == nil {
+		if t, ok := exifTime(x, exif.DateTimeOriginal); ok {
+			meta.CapturedAt = &t
+		} else if t, ok := exifTime(x, exif.DateTime); ok {
+			meta.CapturedAt = &t
+		}
+		meta.CameraMake = exifString(x, exif.Make)
+		meta.CameraModel = exifString(x, exif.Model)
+		if tag, err := x.Get(exif.Orientation); err == nil {
+			if o, err := tag.Int(0); err == nil && o >= 1 && o <= 8 {
+				meta.Orientation = o
+			}
+		}
+		meta.Width = exifInt(x, exif.PixelXDimension)
+		meta.Height = exifInt(x, exif.PixelYDimension)
+		if lat, long, err := x.LatLong(); err == nil && validLatLong(lat, long) {
+			meta.Latitude, meta.Longitude = &lat, &long
+		}
+	}
+
+	if packet := xmpPacket(head); packet != nil {
+		applyXMP(meta, packet)
+	}
+
+	if sniffISOBMFF(head) != "" {
+		// libheif reports the size after the file's own rotation
+		if cfg, err := heic.DecodeConfig(bytes.NewReader(head)); err == nil {
+			meta.Width, meta.Height = cfg.Width, cfg.Height
+			return meta
+		}
+	}
+	// The encoded size is more reliable than what the camera wrote
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(head)); err == nil {
+		meta.Width, meta.Height = cfg.Width, cfg.Height
+	}
+	if meta.Orientation >= 5 {
+		// Rotated a quarter turn, so width and height trade places on screen
+		meta.Width, meta.Height = meta.Height, meta.Width
+	}
+	return meta
+}
+
+func exifString(x *exif.Exif, name exif.FieldName) string {
+	tag, err := x.Get(name)
+	if err != nil {
+		return ""
+	}
+	s, err := tag.StringVal()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(s, "\x00"))
+}
+
+func exifInt(x *exif.Exif, name exif.FieldName) int {
+	tag, err := x.Get(name)
+	if err != nil {
+		return 0
+	}
+	n, err := tag.Int(0)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// exifTime reads an EXIF date as camera wall-clock time. Most cameras don't
+// record their offset, so it is kept as UTC rather than guessed.
+func exifTime(x *exif.Exif, name exif.FieldName) (time.Time, bool) {
+	t, err := time.Parse(exifTimeLayout, exifString(x, name))
+	if err != nil || t.Year() < 1900 {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+func validLatLong(lat, long float64) bool {
+	return lat >= -90 && lat <= 90 && long >= -180 && long <= 180 && (lat != 0 || long != 0)
+}
+
+// pngChunk returns the data of the first chunk of the given kind.
+func pngChunk(file []byte, kind string) []byte {
+	for rest := file[len(pngSignature):]; len(rest) >= 12; {
+		length := int(binary.BigEndian.Uint32(rest[:4]))
+		if length < 0 || length > len(rest)-12 {
+			return nil
+		}
+		if string(rest[4:8]) == kind {
+			return rest[8 : 8+length]
+		}
+		rest = rest[12+length:]
+	}
+	return nil
+}
+
+// xmpPacket finds the XMP packet in a file, which is plain XML embedded
+// wherever the format allows.
+func xmpPacket(head []byte) []byte {
+	start := bytes.Index(head, []byte("<x:xmpmeta"))
+	if start < 0 {
+		return nil
+	}
+	end := bytes.Index(head[start:], []byte("</x:xmpmeta>"))
+	if end < 0 {
+		return nil
+	}
+	return head[start : start+end]
+}
+
+// applyXMP fills in what EXIF left empty.
+func applyXMP(meta *models.UploadMetadata, packet []byte) {
+	if meta.CapturedAt == nil {
+		for _, name := range []string{"exif:DateTimeOriginal", "photoshop:DateCreated", "xmp:CreateDate"} {
+			if t, ok := xmpTime(xmpValue(packet, name)); ok {
+				meta.CapturedAt = &t
+				break
+			}
+		}
+	}
+	if meta.CameraMake == "" {
+		meta.CameraMake = xmpValue(packet, "tiff:Make")
+	}
+	if meta.CameraModel == "" {
+		meta.CameraModel = xmpValue(packet, "tiff:Model")
+	}
+	if meta.Orientation == 1 {
+		if o, err := strconv.Atoi(xmpValue(packet, "tiff:Orientation")); err == nil && o >= 1 && o <= 8 {
+			meta.Orientation = o
+		}
+	}
+	if meta.Latitude == nil {
+		lat, latOK := xmpCoordinate(xmpValue(packet, "exif:GPSLatitude"))
+		long, longOK := xmpCoordinate(xmpValue(packet, "exif:GPSLongitude"))
+		if latOK && longOK && validLatLong(lat, long) {
+			meta.Latitude, meta.Longitude = &lat, &long
+		}
+	}
+}
+
+// xmpValue returns a simple property written either as an attribute,
+// name="value", or as an element, <name>value</name>.
+func xmpValue(packet []byte, name string) string {
+	quoted := regexp.QuoteMeta(name)
+	attr := regexp.MustCompile(quoted + `\s*=\s*"([^"]*)"`)
+	if m := attr.FindSubmatch(packet); m != nil {
+		return strings.TrimSpace(string(m[1]))
+	}
+	elem := regexp.MustCompile(`<` + quoted + `>([^<]*)</` + quoted + `>`)
+	if m := elem.FindSubmatch(packet); m != nil {
+		return strings.TrimSpace(string(m[1]))
+	}
+	return ""
+}
+
+// xmpTime parses an XMP date, keeping its wall-clock time to match EXIF.
+func xmpTime(s string) (time.Time, bool) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02T15:04Z07:00", "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil && t.Year() >= 1900 {
+			return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// xmpCoordinate parses XMP's "DDD,MM.mmmR" or "DDD,MM,SSR" GPS form.
+func xmpCoordinate(s string) (float64, bool) {
+	if len(s) < 2 {
+		return 0, false
+	}
+	ref := s[len(s)-1]
+	parts := strings.Split(s[:len(s)-1], ",")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, false
+	}
+	var value float64
+	for i, div := range []float64{1, 60, 3600}[:len(parts)] {
+		n, err := strconv.ParseFloat(parts[i], 64)
+		if err != nil {
+			return 0, false
+		}
+		value += n / div
+	}
+	switch ref {
+	case 'N', 'E':
+		return value, true
+	case 'S', 'W':
+		return -value, true
+	}
+	return 0, false
+}
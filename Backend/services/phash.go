@@ -0,0 +1,75 @@
+package services
+
+import (
+	"image"
+	"math/bits"
+
+	"github.com/disintegration/imaging"
+)
+
+// DHash is the difference hash of an image: it is shrunk to 9x8 grey pixels
+// and each bit says whether a pixel is brighter than its right neighbour.
+// Resized, recompressed and lightly edited copies land within a few bits of
+// each other.
+func DHash(img image.Image) uint64 {
+	small := imaging.Grayscale(imaging.Resize(img, 9, 8, imaging.Box))
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			left := small.Pix[small.PixOffset(x, y)]
+			right := small.Pix[small.PixOffset(x+1, y)]
+			hash <<= 1
+			if left > right {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// HammingDistance counts the bits two hashes differ in.
+func HammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// ClusterByHash groups uploads whose hashes are within maxDistance bits of
+// each other, directly or through a chain of neighbours, such as the shots
+// of a burst. Uploads with no near duplicate are left out.
+func ClusterByHash(hashes map[uint]uint64, maxDistance int) [][]uint {
+	ids := make([]uint, 0, len(hashes))
+	for id := range hashes {
+		ids = append(ids, id)
+	}
+
+	parent := make(map[uint]uint, len(ids))
+	var find func(uint) uint
+	find = func(id uint) uint {
+		p, ok := parent[id]
+		if !ok || p == id {
+			return id
+		}
+		root := find(p)
+		parent[id] = root
+		return root
+	}
+	for i, a := range ids {
+		for _, b := range ids[i+1:] {
+			if HammingDistance(hashes[a], hashes[b]) <= maxDistance {
+				parent[find(a)] = find(b)
+			}
+		}
+	}
+
+	groups := make(map[uint][]uint)
+	for _, id := range ids {
+		root := find(id)
+		groups[root] = append(groups[root], id)
+	}
+	var clusters [][]uint
+	for _, members := range groups {
+		if len(members) > 1 {
+			clusters = append(clusters, members)
+		}
+	}
+	return clusters
+}
@@ -0,0 +1,55 @@
+package services
+
+import (
+	"fmt"
+	"image"
+
+	"github.com/buckket/go-blurhash"
+	"github.com/disintegration/imaging"
+)
+
+// blurHashX and blurHashY are the BlurHash components across and down, the
+// library's suggested default. More only adds detail nobody sees in a
+// placeholder.
+const (
+	blurHashX = 4
+	blurHashY = 3
+)
+
+// Placeholder computes what a client can draw before an image loads: its
+// BlurHash and its dominant colour as "#rrggbb". A thumbnail gives the same
+// result as the original at a fraction of the work.
+func Placeholder(img image.Image) (string, string, error) {
+	// BlurHash visits every pixel for every component
+	small := imaging.Fit(img, 64, 64, imaging.Box)
+	hash, err := blurhash.Encode(blurHashX, blurHashY, small)
+	if err != nil {
+		return "", "", err
+	}
+	return hash, dominantColor(small), nil
+}
+
+// dominantColor buckets pixels by their top four bits per channel and
+// returns the average of the fullest bucket, which unlike the plain average
+// is a colour that actually appears in the image.
+func dominantColor(img *image.NRGBA) string {
+	type bucket struct{ r, g, b, n int }
+	var buckets [4096]bucket
+	best := 0
+	for i := 0; i+3 < len(img.Pix); i += 4 {
+		r, g, b := int(img.Pix[i]), int(img.Pix[i+1]), int(img.Pix[i+2])
+		k := r>>4<<8 | g>>4<<4 | b>>4
+		buckets[k].r += r
+		buckets[k].g += g
+		buckets[k].b += b
+		buckets[k].n++
+		if buckets[k].n > buckets[best].n {
+			best = k
+		}
+	}
+	c := buckets[best]
+	if c.n == 0 {
+		return ""
+	}
+	return fmt.Sprintf("#%02x%02x%02x", c.r/c.n, c.g/c.n, c.b/c.n)
+}
@@ -0,0 +1,183 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+	"photovault/config"
+	"photovault/models"
+	"photovault/storage"
+)
+
+// PrivacyFor reports whether uploads to a vault are sanitized: the vault's
+// own setting if it has one, otherwise its owner's.
+func PrivacyFor(user *models.User, vault *models.Vault) bool {
+	if vault.PrivacyMode != nil {
+		return *vault.PrivacyMode
+	}
+	return user.PrivacyMode
+}
+
+// VaultPrivacy is PrivacyFor when only the vault is at hand.
+func VaultPrivacy(vault *models.Vault) (bool, error) {
+	if vault.PrivacyMode != nil {
+		return *vault.PrivacyMode, nil
+	}
+	var user models.User
+	if err := config.DB.Select("id", "privacy_mode").First(&user, vault.UserID).Error; err != nil {
+		return false, err
+	}
+	return user.PrivacyMode, nil
+}
+
+// SanitizeObject writes a sanitized copy of a stored object next to it and
+// returns the copy's key, size and SHA-256. The caller deletes the copy once
+// it has been committed somewhere.
+func SanitizeObject(ctx context.Context, key string) (string, int64, string, error) {
+	body, _, err := config.Storage.Get(ctx, key)
+	if err != nil {
+		return "", 0, "", err
+	}
+	defer body.Close()
+
+	clean := SanitizingReader(body)
+	defer clean.Close()
+
+	cleanKey := fmt.Sprintf("%s.clean-%d", key, time.Now().UnixNano())
+	size, sum, err := storage.PutHashed(ctx, config.Storage, cleanKey, clean, -1, "")
+	if err != nil {
+		return "", 0, "", fmt.Errorf("failed to store sanitized copy: %w", err)
+	}
+	return cleanKey, size, sum, nil
+}
+
+// reduceMetadata forgets what privacy mode strips from the files themselves.
+func reduceMetadata(meta *models.UploadMetadata) {
+	meta.CameraMake = ""
+	meta.CameraModel = ""
+	meta.Latitude = nil
+	meta.Longitude = nil
+}
+
+// ReprocessUpload replaces an upload's object with a sanitized copy, moving
+// it to the blob of the new content, and reduces its stored metadata to
+// match. An upload whose metadata can't be removed is left as it was and
+// fails with ErrCannotSanitize.
+func ReprocessUpload(ctx context.Context, upload *models.Upload, vault *models.Vault) error {
+	if upload.Pending {
+		return nil
+	}
+
+	cleanKey, size, sum, err := SanitizeObject(ctx, upload.Key)
+	if err != nil {
+		return err
+	}
+	defer DeleteObjects(cleanKey)
+
+	if sum == upload.ContentHash && IsBlobUpload(upload) {
+		// Nothing in the file to strip
+		return config.DB.Model(&models.UploadMetadata{}).Where("upload_id = ?", upload.ID).
+			Updates(map[string]interface{}{"camera_make": "", "camera_model": "", "latitude": nil, "longitude": nil}).Error
+	}
+
+	edited := RenditionSource(upload)
+	var unused []string
+	err = config.DB.Transaction(func(tx *gorm.DB) error {
+		keys, err := ReleaseUpload(tx, upload, vault.UserID)
+		if err != nil {
+			return err
+		}
+		unused = keys
+
+		upload.Size, upload.ContentHash = size, sum
+		if err := tx.Model(upload).Updates(map[string]interface{}{"size": size, "content_hash": sum}).Error; err != nil {
+			return err
+		}
+		// The copy is never larger than the original, so skip the quota check
+		_, err = CommitUpload(ctx, tx, vault, upload, cleanKey, -1)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if upload.Edits != nil {
+		// They were made from the old object
+		DeleteRenditions(edited)
+	}
+	DeleteRenditions(unused...)
+	DeleteObjects(unused...)
+	ProcessUpload(*upload, true)
+	return nil
+}
+
+// reprocessCover sanitizes a vault's cover image in place.
+func reprocessCover(ctx context.Context, cover *models.CoverImage) error {
+	cleanKey, _, _, err := SanitizeObject(ctx, cover.Key)
+	if err != nil {
+		return err
+	}
+	defer DeleteObjects(cleanKey)
+
+	body, obj, err := config.Storage.Get(ctx, cleanKey)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	if err := config.Storage.Put(ctx, cover.Key, body, obj.Size, cover.ContentType); err != nil {
+		return err
+	}
+	DeleteRenditions(cover.Key)
+	return nil
+}
+
+// reprocessSlots caps how many vaults are sanitized at once, since turning
+// privacy mode on for an account reprocesses all of its vaults together.
+var reprocessSlots = make(chan struct{}, reprocessWorkers())
+
+func reprocessWorkers() int {
+	n, err := strconv.Atoi(config.GetEnv("REPROCESS_WORKERS", "2"))
+	if err != nil || n < 1 {
+		return 2
+	}
+	return n
+}
+
+// ReprocessVault sanitizes every upload and cover already in a vault, in
+// the background. Vaults wait their turn for one of reprocessSlots.
+func ReprocessVault(vault models.Vault) {
+	go func() {
+		reprocessSlots <- struct{}{}
+		defer func() { <-reprocessSlots }()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+		defer cancel()
+
+		var uploads []models.Upload
+		if err := config.DB.Where("vault_id = ? AND pending = ?", vault.ID, false).Find(&uploads).Error; err != nil {
+			log.Printf("Failed to list uploads of vault %d for reprocessing: %v", vault.ID, err)
+			return
+		}
+		failed := 0
+		for i := range uploads {
+			if err := ReprocessUpload(ctx, &uploads[i], &vault); err != nil {
+				log.Printf("Failed to sanitize upload %d: %v", uploads[i].ID, err)
+				failed++
+			}
+		}
+
+		var covers []models.CoverImage
+		config.DB.Where("vault_id = ?", vault.ID).Find(&covers)
+		for i := range covers {
+			if err := reprocessCover(ctx, &covers[i]); err != nil {
+				log.Printf("Failed to sanitize cover image %d: %v", covers[i].ID, err)
+				failed++
+			}
+		}
+		log.Printf("Sanitized vault %d: %d uploads, %d covers, %d failed", vault.ID, len(uploads), len(covers), failed)
+	}()
+}
@@ -0,0 +1,34 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"photovault/models"
+)
+
+// ProcessUpload reads a newly stored upload in the background: its metadata
+// first, then its renditions, including a display copy for formats browsers
+// can't show and a poster frame for videos, and last its placeholder and
+// the perceptual hash near duplicates are found by. With private set only
+// the metadata privacy mode keeps is recorded. Failures are only logged;
+// missing renditions are filled in by EnsureRendition the next time they
+// are requested.
+func ProcessUpload(upload models.Upload, private bool) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer cancel()
+
+		if _, err := ExtractMetadata(ctx, upload, private); err != nil {
+			log.Printf("Failed to read metadata of upload %d: %v", upload.ID, err)
+		}
+		if _, err := renderUpload(ctx, &upload, uploadSizes(&upload)); err != nil && !errors.Is(err, ErrNotImage) {
+			log.Printf("Failed to generate renditions of %s: %v", upload.Key, err)
+		}
+		if err := AnalyzeUpload(ctx, upload); err != nil && !errors.Is(err, ErrNotImage) {
+			log.Printf("Failed to analyze upload %d: %v", upload.ID, err)
+		}
+	}()
+}
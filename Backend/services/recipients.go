@@ -0,0 +1,184 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"photovault/config"
+	"photovault/models"
+)
+
+var (
+	// ErrRecipientLink is returned for a recipient link that is unknown,
+	// revoked or expired, or whose capsule isn't open.
+	ErrRecipientLink = errors.New("link is invalid or has expired")
+	// ErrNotUnlocked is returned for sending links of a capsule that hasn't
+	// opened.
+	ErrNotUnlocked = errors.New("capsule hasn't unlocked")
+	// ErrRecipientEmail is returned for claiming a link with an account
+	// whose email isn't the one the link was sent to.
+	ErrRecipientEmail = errors.New("link was sent to another email address")
+)
+
+// recipientLinkTTL is how long recipient links work after they are sent,
+// from RECIPIENT_LINK_DAYS. Zero means they don't expire.
+func recipientLinkTTL() time.Duration {
+	days, err := strconv.Atoi(config.GetEnv("RECIPIENT_LINK_DAYS", "30"))
+	if err != nil || days < 0 {
+		return 30 * 24 * time.Hour
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+func hashLinkToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// SendRecipientLink gives a recipient a fresh link to an unlocked capsule
+// and emails it to them. Any link sent before stops working.
+func SendRecipientLink(vault *models.Vault, recipient *models.VaultRecipient) error {
+	if CapsuleStatus(vault) != StatusUnlocked {
+		return ErrNotUnlocked
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return err
+	}
+	token := hex.EncodeToString(raw)
+	hash := hashLinkToken(token)
+	now := time.Now()
+	var expires *time.Time
+	if ttl := recipientLinkTTL(); ttl > 0 && recipient.ClaimedByID == nil {
+		t := now.Add(ttl)
+		expires = &t
+	}
+
+	var owner models.User
+	if err := config.DB.First(&owner, vault.UserID).Error; err != nil {
+		return err
+	}
+	from := owner.DisplayName
+	if from == "" {
+		from = owner.Email
+	}
+	if err := SendRecipientEmail(recipient.Email, from, recipient.Message, token); err != nil {
+		return err
+	}
+
+	recipient.TokenHash, recipient.TokenExpiresAt, recipient.NotifiedAt = &hash, expires, &now
+	return config.DB.Model(recipient).Updates(map[string]interface{}{
+		"token_hash":       hash,
+		"token_expires_at": expires,
+		"notified_at":      now,
+	}).Error
+}
+
+// NotifyRecipients sends links to everyone a newly unlocked capsule is
+// shared with who hasn't had one. Failures are logged and retried on the
+// next unlock check.
+func NotifyRecipients(vault *models.Vault) {
+	var recipients []models.VaultRecipient
+	err := config.DB.Where("vault_id = ? AND notified_at IS NULL AND revoked_at IS NULL", vault.ID).
+		Find(&recipients).Error
+	if err != nil {
+		log.Printf("Failed to load recipients of vault %d: %v", vault.ID, err)
+		return
+	}
+	for i := range recipients {
+		if err := SendRecipientLink(vault, &recipients[i]); err != nil {
+			log.Printf("Failed to send capsule %d to recipient %d: %v", vault.ID, recipients[i].ID, err)
+		}
+	}
+}
+
+// PendingRecipientVaults lists unlocked capsules with recipients still
+// waiting for their link, so a failed send is tried again.
+func PendingRecipientVaults() ([]models.Vault, error) {
+	var vaults []models.Vault
+	err := config.DB.
+		Where("status = ?", StatusUnlocked).
+		Where("id IN (?)", config.DB.Model(&models.VaultRecipient{}).
+			Select("vault_id").
+			Where("notified_at IS NULL AND revoked_at IS NULL")).
+		Find(&vaults).Error
+	return vaults, err
+}
+
+// RecipientByToken finds the recipient a link was sent to, with their
+// vault, as long as the link still works and the capsule is open.
+func RecipientByToken(token string) (*models.VaultRecipient, *models.Vault, error) {
+	if token == "" {
+		return nil, nil, ErrRecipientLink
+	}
+	var recipient models.VaultRecipient
+	if err := config.DB.Where("token_hash = ?", hashLinkToken(token)).First(&recipient).Error; err != nil {
+		return nil, nil, ErrRecipientLink
+	}
+	return recipientAccess(&recipient)
+}
+
+// ClaimedRecipient finds a recipient claimed into a user's account, with
+// their vault, as long as it isn't revoked and the capsule is open.
+func ClaimedRecipient(id, userID uint) (*models.VaultRecipient, *models.Vault, error) {
+	var recipient models.VaultRecipient
+	if err := config.DB.Where("claimed_by_id = ?", userID).First(&recipient, id).Error; err != nil {
+		return nil, nil, ErrRecipientLink
+	}
+	return recipientAccess(&recipient)
+}
+
+func recipientAccess(recipient *models.VaultRecipient) (*models.VaultRecipient, *models.Vault, error) {
+	if recipient.RevokedAt != nil {
+		return nil, nil, ErrRecipientLink
+	}
+	if recipient.ClaimedByID == nil && recipient.TokenExpiresAt != nil && time.Now().After(*recipient.TokenExpiresAt) {
+		return nil, nil, ErrRecipientLink
+	}
+	var vault models.Vault
+	if err := config.DB.First(&vault, recipient.VaultID).Error; err != nil {
+		return nil, nil, ErrRecipientLink
+	}
+	if CapsuleStatus(&vault) != StatusUnlocked {
+		return nil, nil, ErrRecipientLink
+	}
+	return recipient, &vault, nil
+}
+
+// ClaimRecipient ties a recipient's link to the account they signed up
+// with, which must have the address the link was sent to, so a forwarded
+// link can't be kept by someone else. The capsule then shows among the
+// capsules they received and its link no longer expires.
+func ClaimRecipient(recipient *models.VaultRecipient, userID uint) error {
+	if recipient.ClaimedByID != nil && *recipient.ClaimedByID != userID {
+		return ErrRecipientLink
+	}
+	var user models.User
+	if err := config.DB.Select("id", "email").First(&user, userID).Error; err != nil {
+		return err
+	}
+	if !strings.EqualFold(strings.TrimSpace(user.Email), recipient.Email) {
+		return ErrRecipientEmail
+	}
+	recipient.ClaimedByID = &userID
+	recipient.TokenExpiresAt = nil
+	return config.DB.Model(recipient).Updates(map[string]interface{}{
+		"claimed_by_id":    userID,
+		"token_expires_at": nil,
+	}).Error
+}
+
+// RevokeRecipient stops a recipient's link, and their claimed access, from
+// working.
+func RevokeRecipient(recipient *models.VaultRecipient) error {
+	now := time.Now()
+	recipient.RevokedAt = &now
+	return config.DB.Model(recipient).Update("revoked_at", now).Error
+}
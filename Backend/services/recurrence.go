@@ -0,0 +1,315 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+	"photovault/config"
+	"photovault/models"
+)
+
+const (
+	FreqYearly  = "YEARLY"
+	FreqMonthly = "MONTHLY"
+
+	// maxOccurrenceSteps bounds the search for an occurrence, a thousand
+	// years of monthly ones.
+	maxOccurrenceSteps = 12000
+)
+
+// ErrInvalidRecurrence is returned for a recurrence outside the supported
+// RRULE subset.
+var ErrInvalidRecurrence = errors.New("recurrence must be YEARLY or MONTHLY, optionally with INTERVAL and one of COUNT or UNTIL")
+
+// Recurrence is the subset of an RFC 5545 RRULE that recurring capsules
+// support: a yearly or monthly frequency with an optional interval and end.
+// Occurrences keep the first one's day of the month and wall-clock time in
+// the vault's time zone; months or years without that day are skipped, as
+// RRULE does.
+type Recurrence struct {
+	Freq     string
+	Interval int
+	Count    int        // occurrences in all, counting the first; 0 for no limit
+	Until    *time.Time // no occurrences after it; nil for no limit
+}
+
+// ParseRecurrence reads a rule such as "FREQ=YEARLY;INTERVAL=1;COUNT=10",
+// with or without an "RRULE:" prefix. "yearly" and "monthly" are short for
+// the plain rules.
+func ParseRecurrence(s string) (*Recurrence, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	s = strings.TrimPrefix(s, "RRULE:")
+	if s == FreqYearly || s == FreqMonthly {
+		return &Recurrence{Freq: s, Interval: 1}, nil
+	}
+
+	rule := &Recurrence{Interval: 1}
+	seen := map[string]bool{}
+	for _, part := range strings.Split(s, ";") {
+		key, value, ok := strings.Cut(part, "=")
+		if !ok || seen[key] {
+			return nil, ErrInvalidRecurrence
+		}
+		seen[key] = true
+
+		switch key {
+		case "FREQ":
+			if value != FreqYearly && value != FreqMonthly {
+				return nil, ErrInvalidRecurrence
+			}
+			rule.Freq = value
+		case "INTERVAL":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > 100 {
+				return nil, ErrInvalidRecurrence
+			}
+			rule.Interval = n
+		case "COUNT":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return nil, ErrInvalidRecurrence
+			}
+			rule.Count = n
+		case "UNTIL":
+			until, err := time.Parse("20060102T150405Z", value)
+			if err != nil {
+				// A date alone includes the whole day
+				day, err := time.Parse("20060102", value)
+				if err != nil {
+					return nil, ErrInvalidRecurrence
+				}
+				until = day.Add(24*time.Hour - time.Second)
+			}
+			rule.Until = &until
+		default:
+			return nil, ErrInvalidRecurrence
+		}
+	}
+	if rule.Freq == "" || (rule.Count > 0 && rule.Until != nil) {
+		return nil, ErrInvalidRecurrence
+	}
+	return rule, nil
+}
+
+// String is the rule in RRULE form, as stored on the vault.
+func (r *Recurrence) String() string {
+	s := fmt.Sprintf("FREQ=%s;INTERVAL=%d", r.Freq, r.Interval)
+	if r.Count > 0 {
+		s += fmt.Sprintf(";COUNT=%d", r.Count)
+	}
+	if r.Until != nil {
+		s += ";UNTIL=" + r.Until.UTC().Format("20060102T150405Z")
+	}
+	return s
+}
+
+// Next is the first occurrence of a series starting at start that falls
+// after after, on the wall clock of loc. ok is false once the series has
+// ended.
+func (r *Recurrence) Next(start time.Time, loc *time.Location, after time.Time) (next time.Time, ok bool) {
+	wall := start.In(loc)
+	months := r.Interval
+	if r.Freq == FreqYearly {
+		months *= 12
+	}
+
+	n := 0
+	for step := 0; step < maxOccurrenceSteps; step++ {
+		day := time.Date(wall.Year(), wall.Month()+time.Month(step*months), wall.Day(),
+			wall.Hour(), wall.Minute(), wall.Second(), wall.Nanosecond(), time.UTC)
+		if day.Day() != wall.Day() {
+			// The month is too short, or it's a 29 February outside a leap year
+			continue
+		}
+		n++
+		if r.Count > 0 && n > r.Count {
+			return time.Time{}, false
+		}
+		t := LocalTime(day, loc)
+		if r.Until != nil && t.After(*r.Until) {
+			return time.Time{}, false
+		}
+		if t.After(after) {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// recurringOpenWindow is how long a recurring capsule stays open for new
+// contributions before it is buried again, from RECURRING_OPEN_DAYS.
+func recurringOpenWindow() time.Duration {
+	days, err := strconv.Atoi(config.GetEnv("RECURRING_OPEN_DAYS", "7"))
+	if err != nil || days < 1 {
+		return 7 * 24 * time.Hour
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// SetRecurrence makes a vault recur by rule, starting from its unlock date,
+// or stops it recurring when rule is empty.
+func SetRecurrence(vault *models.Vault, rule string) error {
+	if rule == "" {
+		vault.Recurrence, vault.RecurrenceStart, vault.ResealAt = "", nil, nil
+		return config.DB.Model(vault).Updates(map[string]interface{}{
+			"recurrence":       "",
+			"recurrence_start": nil,
+			"reseal_at":        nil,
+		}).Error
+	}
+
+	recurrence, err := ParseRecurrence(rule)
+	if err != nil {
+		return err
+	}
+	if vault.UnlockDate == nil || !vault.UnlockDate.After(time.Now()) {
+		return ErrUnlockDateRequired
+	}
+	vault.Recurrence, vault.RecurrenceStart = recurrence.String(), vault.UnlockDate
+	return config.DB.Model(vault).Updates(map[string]interface{}{
+		"recurrence":       vault.Recurrence,
+		"recurrence_start": *vault.UnlockDate,
+	}).Error
+}
+
+// OpenCycle records the opening of a recurring capsule that has just
+// unlocked, snapshotting the uploads added since it last opened into the
+// new cycle. It also moves the unlock date on to the next occurrence and
+// picks when the capsule is buried again: after the open window, or halfway
+// to the next occurrence if that comes first. A series that has ended leaves
+// the capsule open. All of it happens in one transaction, so a failed
+// opening is left for UnopenedCycles to find. vault needs its User loaded.
+func OpenCycle(vault *models.Vault, now time.Time) (*models.VaultCycle, *time.Time, error) {
+	rule, err := ParseRecurrence(vault.Recurrence)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	start := vault.UnlockDate
+	if vault.RecurrenceStart != nil {
+		start = vault.RecurrenceStart
+	}
+	// Occurrences missed while the scheduler wasn't running are skipped
+	after := now
+	if vault.UnlockDate.After(after) {
+		after = *vault.UnlockDate
+	}
+	updates := map[string]interface{}{"reseal_at": nil}
+	var next, reseal *time.Time
+	if t, ok := rule.Next(*start, VaultTimeZone(vault, &vault.User), after); ok {
+		r := now.Add(recurringOpenWindow())
+		if !r.Before(t) {
+			r = now.Add(t.Sub(now) / 2)
+		}
+		next, reseal = &t, &r
+		updates = map[string]interface{}{"unlock_date": t, "reseal_at": r}
+	}
+
+	var cycle models.VaultCycle
+	err = config.DB.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&models.VaultCycle{}).Where("vault_id = ?", vault.ID).Count(&count).Error; err != nil {
+			return err
+		}
+		cycle = models.VaultCycle{VaultID: vault.ID, Number: int(count) + 1, UnlockDate: *vault.UnlockDate, OpenedAt: now}
+		if err := tx.Create(&cycle).Error; err != nil {
+			return err
+		}
+
+		var ids []uint
+		err := tx.Model(&models.Upload{}).
+			Where("vault_id = ? AND deleted_at IS NULL AND pending = ?", vault.ID, false).
+			Where("id NOT IN (?)", tx.Table("vault_cycle_uploads").
+				Select("vault_cycle_uploads.upload_id").
+				Joins("JOIN vault_cycles ON vault_cycles.id = vault_cycle_uploads.cycle_id").
+				Where("vault_cycles.vault_id = ?", vault.ID)).
+			Pluck("id", &ids).Error
+		if err != nil {
+			return err
+		}
+		if len(ids) > 0 {
+			snapshot := make([]models.VaultCycleUpload, len(ids))
+			for i, id := range ids {
+				snapshot[i] = models.VaultCycleUpload{CycleID: cycle.ID, UploadID: id}
+			}
+			if err := tx.CreateInBatches(snapshot, 500).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Model(vault).Updates(updates).Error
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if next != nil {
+		vault.UnlockDate = next
+	}
+	vault.ResealAt = reseal
+	return &cycle, next, nil
+}
+
+// UnopenedCycles lists recurring capsules that unlocked without their
+// opening being recorded, because OpenCycle failed or never ran, so it can
+// be tried again. Their users are loaded.
+func UnopenedCycles(now time.Time) ([]models.Vault, error) {
+	var vaults []models.Vault
+	err := config.DB.Preload("User").
+		Where("status = ? AND recurrence <> '' AND reseal_at IS NULL AND unlock_date <= ?", StatusUnlocked, now).
+		Where("NOT EXISTS (?)", config.DB.Model(&models.VaultCycle{}).
+			Select("1").
+			Where("vault_cycles.vault_id = vaults.id AND vault_cycles.unlock_date = vaults.unlock_date")).
+		Find(&vaults).Error
+	return vaults, err
+}
+
+// MaxResealAttempts is how many times burying a capsule again is tried
+// before it is left open.
+const MaxResealAttempts = 10
+
+// ResealCapsules buries recurring capsules again once their open window
+// has passed, until their next occurrence. A capsule that keeps failing is
+// given up on after MaxResealAttempts and stays open; its next occurrence is
+// then recorded by UnopenedCycles as usual.
+func ResealCapsules(now time.Time) {
+	var vaults []models.Vault
+	err := config.DB.
+		Where("status = ? AND recurrence <> '' AND reseal_at <= ?", StatusUnlocked, now).
+		Find(&vaults).Error
+	if err != nil {
+		log.Printf("Failed to load capsules to reseal: %v", err)
+		return
+	}
+	for i := range vaults {
+		vault := &vaults[i]
+		if err := ChangeStatus(vault, StatusBuried, nil); err != nil {
+			recordResealFailure(vault, err)
+			continue
+		}
+		if err := config.DB.Model(vault).Updates(map[string]interface{}{"reseal_at": nil, "reseal_attempts": 0}).Error; err != nil {
+			log.Printf("Failed to clear reseal time of capsule %d: %v", vault.ID, err)
+		}
+	}
+}
+
+// recordResealFailure counts a failed reseal, clearing the reseal time
+// once the attempts are used up.
+func recordResealFailure(vault *models.Vault, err error) {
+	vault.ResealAttempts++
+	updates := map[string]interface{}{"reseal_attempts": vault.ResealAttempts}
+	if vault.ResealAttempts >= MaxResealAttempts {
+		updates["reseal_at"] = nil
+		updates["reseal_attempts"] = 0
+		log.Printf("Giving up resealing capsule %d after %d attempts: %v", vault.ID, vault.ResealAttempts, err)
+	} else {
+		log.Printf("Failed to reseal capsule %d (attempt %d): %v", vault.ID, vault.ResealAttempts, err)
+	}
+	if err := config.DB.Model(vault).Updates(updates).Error; err != nil {
+		log.Printf("Failed to record reseal failure of capsule %d: %v", vault.ID, err)
+	}
+}
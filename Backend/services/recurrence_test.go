@@ -0,0 +1,167 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseRecurrence(t *testing.T) {
+	until := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		rule string
+		want string // String of the parsed rule, or "" if it is invalid
+	}{
+		{"yearly", "FREQ=YEARLY;INTERVAL=1"},
+		{" Monthly ", "FREQ=MONTHLY;INTERVAL=1"},
+		{"RRULE:FREQ=MONTHLY;INTERVAL=3", "FREQ=MONTHLY;INTERVAL=3"},
+		{"FREQ=YEARLY;COUNT=10", "FREQ=YEARLY;INTERVAL=1;COUNT=10"},
+		{"FREQ=YEARLY;UNTIL=20300101T000000Z", "FREQ=YEARLY;INTERVAL=1;UNTIL=20300101T000000Z"},
+		// A date alone runs to the end of the day
+		{"FREQ=YEARLY;UNTIL=20291231", "FREQ=YEARLY;INTERVAL=1;UNTIL=20291231T235959Z"},
+		{"", ""},
+		{"weekly", ""},
+		{"FREQ=WEEKLY", ""},
+		{"INTERVAL=2", ""},
+		{"FREQ=YEARLY;INTERVAL=0", ""},
+		{"FREQ=YEARLY;INTERVAL=101", ""},
+		{"FREQ=YEARLY;COUNT=0", ""},
+		{"FREQ=YEARLY;COUNT=2;UNTIL=20300101", ""},
+		{"FREQ=YEARLY;FREQ=MONTHLY", ""},
+		{"FREQ=YEARLY;BYMONTH=3", ""},
+		{"FREQ=YEARLY;UNTIL=tomorrow", ""},
+		{"FREQ=YEARLY;", ""},
+	}
+	for _, tt := range tests {
+		r, err := ParseRecurrence(tt.rule)
+		if tt.want == "" {
+			if !errors.Is(err, ErrInvalidRecurrence) {
+				t.Errorf("ParseRecurrence(%q) = %v, %v, want ErrInvalidRecurrence", tt.rule, r, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseRecurrence(%q) failed: %v", tt.rule, err)
+			continue
+		}
+		if got := r.String(); got != tt.want {
+			t.Errorf("ParseRecurrence(%q) = %s, want %s", tt.rule, got, tt.want)
+		}
+	}
+
+	r, _ := ParseRecurrence("FREQ=YEARLY;UNTIL=20300101T000000Z")
+	if !r.Until.Equal(until) {
+		t.Errorf("UNTIL = %v, want %v", r.Until, until)
+	}
+}
+
+func TestRecurrenceNext(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(loc *time.Location, s string) time.Time {
+		t.Helper()
+		v, err := time.ParseInLocation("2006-01-02 15:04", s, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	tests := []struct {
+		name  string
+		rule  string
+		loc   *time.Location
+		start string
+		want  []string // the series from its start, in loc
+	}{
+		{
+			name:  "31st skips short months",
+			rule:  "FREQ=MONTHLY;COUNT=5",
+			loc:   time.UTC,
+			start: "2026-01-31 10:00",
+			want:  []string{"2026-01-31 10:00", "2026-03-31 10:00", "2026-05-31 10:00", "2026-07-31 10:00", "2026-08-31 10:00"},
+		},
+		{
+			name:  "30th skips February",
+			rule:  "FREQ=MONTHLY;COUNT=3",
+			loc:   time.UTC,
+			start: "2026-01-30 10:00",
+			want:  []string{"2026-01-30 10:00", "2026-03-30 10:00", "2026-04-30 10:00"},
+		},
+		{
+			name:  "29 February waits for a leap year",
+			rule:  "FREQ=YEARLY;COUNT=3",
+			loc:   time.UTC,
+			start: "2028-02-29 08:00",
+			want:  []string{"2028-02-29 08:00", "2032-02-29 08:00", "2036-02-29 08:00"},
+		},
+		{
+			name:  "interval",
+			rule:  "FREQ=MONTHLY;INTERVAL=5;COUNT=3",
+			loc:   time.UTC,
+			start: "2026-10-15 09:00",
+			want:  []string{"2026-10-15 09:00", "2027-03-15 09:00", "2027-08-15 09:00"},
+		},
+		{
+			name:  "until is inclusive",
+			rule:  "FREQ=YEARLY;UNTIL=20280601",
+			loc:   time.UTC,
+			start: "2026-06-01 12:00",
+			want:  []string{"2026-06-01 12:00", "2027-06-01 12:00", "2028-06-01 12:00"},
+		},
+		{
+			// 02:30 doesn't exist on 8 March 2026 in New York
+			name:  "wall clock across spring forward",
+			rule:  "FREQ=MONTHLY;COUNT=3",
+			loc:   newYork,
+			start: "2026-02-08 02:30",
+			want:  []string{"2026-02-08 02:30", "2026-03-08 03:30", "2026-04-08 02:30"},
+		},
+		{
+			name:  "wall clock across fall back",
+			rule:  "FREQ=MONTHLY;COUNT=3",
+			loc:   newYork,
+			start: "2026-09-01 01:30",
+			want:  []string{"2026-09-01 01:30", "2026-10-01 01:30", "2026-11-01 01:30"},
+		},
+	}
+	for _, tt := range tests {
+		r, err := ParseRecurrence(tt.rule)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		start := at(tt.loc, tt.start)
+		after := start.Add(-time.Second)
+		var got []string
+		for len(got) <= len(tt.want) {
+			next, ok := r.Next(start, tt.loc, after)
+			if !ok {
+				break
+			}
+			got = append(got, next.In(tt.loc).Format("2006-01-02 15:04"))
+			after = next
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestRecurrenceNextSkipsMissed(t *testing.T) {
+	r := &Recurrence{Freq: FreqYearly, Interval: 1}
+	start := time.Date(2020, 5, 1, 9, 0, 0, 0, time.UTC)
+	now := time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)
+	next, ok := r.Next(start, time.UTC, now)
+	if want := time.Date(2027, 5, 1, 9, 0, 0, 0, time.UTC); !ok || !next.Equal(want) {
+		t.Errorf("Next = %v, %v, want %v", next, ok, want)
+	}
+}
@@ -0,0 +1,170 @@
+package services
+
+import (
+	"errors"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm/clause"
+	"photovault/config"
+	"photovault/models"
+)
+
+// maxReminderDays is the earliest a reminder can go out before unlocking.
+const maxReminderDays = 365
+
+// ErrInvalidReminderDays is returned for a reminder schedule that isn't a
+// list of whole days between 1 and 365.
+var ErrInvalidReminderDays = errors.New("reminder days must be between 1 and 365")
+
+// ParseReminderDays reads a comma-separated reminder schedule such as
+// "30,7,1", returning its days furthest first without repeats.
+func ParseReminderDays(s string) ([]int, error) {
+	var days []int
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		d, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, ErrInvalidReminderDays
+		}
+		days = append(days, d)
+	}
+	return NormalizeReminderDays(days)
+}
+
+// NormalizeReminderDays checks a reminder schedule and sorts it furthest
+// first, dropping repeats.
+func NormalizeReminderDays(days []int) ([]int, error) {
+	seen := map[int]bool{}
+	out := []int{}
+	for _, d := range days {
+		if d < 1 || d > maxReminderDays {
+			return nil, ErrInvalidReminderDays
+		}
+		if !seen[d] {
+			seen[d] = true
+			out = append(out, d)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(out)))
+	return out, nil
+}
+
+// FormatReminderDays is the stored form of a schedule from
+// NormalizeReminderDays.
+func FormatReminderDays(days []int) string {
+	parts := make([]string, len(days))
+	for i, d := range days {
+		parts[i] = strconv.Itoa(d)
+	}
+	return strings.Join(parts, ",")
+}
+
+// DefaultReminderDays is the schedule of users who haven't chosen one, from
+// CAPSULE_REMINDER_DAYS.
+func DefaultReminderDays() []int {
+	days, err := ParseReminderDays(config.GetEnv("CAPSULE_REMINDER_DAYS", "30,7,1"))
+	if err != nil {
+		log.Printf("Invalid CAPSULE_REMINDER_DAYS, using 30,7,1: %v", err)
+		return []int{30, 7, 1}
+	}
+	return days
+}
+
+// ReminderDays is when a user is reminded before their capsules unlock.
+func ReminderDays(user *models.User) []int {
+	if user.ReminderDays != "" {
+		if days, err := ParseReminderDays(user.ReminderDays); err == nil {
+			return days
+		}
+	}
+	return DefaultReminderDays()
+}
+
+// dueReminders lists the reminders of a schedule that are due at now for a
+// capsule unlocking at unlock, furthest first.
+func dueReminders(days []int, unlock, now time.Time) []int {
+	var due []int
+	for _, d := range days {
+		if !now.Before(unlock.Add(-time.Duration(d) * 24 * time.Hour)) {
+			due = append(due, d)
+		}
+	}
+	return due
+}
+
+// SendCapsuleReminders emails owners whose buried capsules unlock soon. Of
+// the reminders due for a capsule only the closest one goes out; any
+// further ones, due when it was buried or while the scheduler wasn't
+// running, are recorded as skipped. A reminder is recorded before it is
+// sent, so it goes out once, and dropped again if sending fails so the next
+// run retries it.
+func SendCapsuleReminders(now time.Time) {
+	var vaults []models.Vault
+	err := config.DB.Preload("User").
+		Where("status = ?", StatusBuried).
+		Where("unlock_date > ? AND unlock_date <= ?", now, now.Add(maxReminderDays*24*time.Hour)).
+		Find(&vaults).Error
+	if err != nil {
+		log.Printf("Failed to load capsules for reminders: %v", err)
+		return
+	}
+
+	for i := range vaults {
+		vault := &vaults[i]
+		if !vault.User.CapsuleReminders {
+			continue
+		}
+		due := dueReminders(ReminderDays(&vault.User), *vault.UnlockDate, now)
+		if len(due) == 0 {
+			continue
+		}
+
+		var sent []models.CapsuleReminder
+		if err := config.DB.Where("vault_id = ? AND unlock_date = ?", vault.ID, *vault.UnlockDate).Find(&sent).Error; err != nil {
+			log.Printf("Failed to load reminders of capsule %d: %v", vault.ID, err)
+			continue
+		}
+		recorded := map[int]bool{}
+		closest := math.MaxInt
+		for _, r := range sent {
+			recorded[r.DaysBefore] = true
+			if r.DaysBefore < closest {
+				closest = r.DaysBefore
+			}
+		}
+
+		for j, d := range due {
+			if recorded[d] {
+				continue
+			}
+			reminder := models.CapsuleReminder{VaultID: vault.ID, UnlockDate: *vault.UnlockDate, DaysBefore: d}
+			// Only the closest reminder is sent, and only if no closer one was
+			send := j == len(due)-1 && d < closest
+			if send {
+				reminder.SentAt = &now
+			}
+			result := config.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&reminder)
+			if result.Error != nil {
+				log.Printf("Failed to record reminder of capsule %d: %v", vault.ID, result.Error)
+				break
+			}
+			if !send || result.RowsAffected == 0 {
+				continue
+			}
+
+			daysLeft := int(math.Ceil(vault.UnlockDate.Sub(now).Hours() / 24))
+			if err := SendReminderEmail(vault.User.Email, vault.Title, vault.ID, vault.UnlockDate.In(VaultTimeZone(vault, &vault.User)), daysLeft); err != nil {
+				log.Printf("Failed to send reminder of capsule %d: %v", vault.ID, err)
+				config.DB.Delete(&reminder)
+			}
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package services
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseReminderDays(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []int // nil if it is invalid
+	}{
+		{"30,7,1", []int{30, 7, 1}},
+		{"1, 7 ,30", []int{30, 7, 1}},
+		{"7,7,1,7", []int{7, 1}},
+		{"365", []int{365}},
+		{"", []int{}},
+		{" , ", []int{}},
+		{"0", nil},
+		{"366", nil},
+		{"-1", nil},
+		{"7,x", nil},
+		{"1.5", nil},
+	}
+	for _, tt := range tests {
+		got, err := ParseReminderDays(tt.in)
+		if tt.want == nil {
+			if !errors.Is(err, ErrInvalidReminderDays) {
+				t.Errorf("ParseReminderDays(%q) = %v, %v, want ErrInvalidReminderDays", tt.in, got, err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseReminderDays(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestDueReminders(t *testing.T) {
+	unlock := time.Date(2027, 1, 31, 9, 0, 0, 0, time.UTC)
+	days := []int{30, 7, 1}
+	tests := []struct {
+		name string
+		now  time.Time
+		want []int
+	}{
+		{"long before", unlock.AddDate(0, -3, 0), nil},
+		{"just before the first", unlock.Add(-30*24*time.Hour - time.Second), nil},
+		{"exactly at the first", unlock.Add(-30 * 24 * time.Hour), []int{30}},
+		{"between", unlock.Add(-10 * 24 * time.Hour), []int{30}},
+		{"second due", unlock.Add(-7 * 24 * time.Hour), []int{30, 7}},
+		{"all due", unlock.Add(-time.Hour), []int{30, 7, 1}},
+	}
+	for _, tt := range tests {
+		if got := dueReminders(days, unlock, tt.now); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: dueReminders = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if got := dueReminders(nil, unlock, unlock); got != nil {
+		t.Errorf("dueReminders with no schedule = %v, want none", got)
+	}
+}
@@ -0,0 +1,239 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"log"
+	"strconv"
+
+	"github.com/disintegration/imaging"
+	"github.com/gen2brain/heic"
+	_ "golang.org/x/image/webp"
+	"gorm.io/gorm/clause"
+	"photovault/config"
+	"photovault/models"
+)
+
+// RenditionSizes are the longest edges, in pixels, that renditions are
+// fitted into: a grid thumbnail, a screen-sized preview and a large view.
+var RenditionSizes = []int{256, 1024, 2048}
+
+// DisplaySize stands in for a size to mean the display copy: a JPEG of the
+// whole image, for originals in formats browsers can't show. For videos it
+// is the full-size poster frame.
+const DisplaySize = 0
+
+// renditionQuality is the JPEG quality renditions are encoded at.
+const renditionQuality = 85
+
+// ErrNotImage is returned when the source object can't be decoded as an
+// image, so there is nothing to resize.
+var ErrNotImage = errors.New("source is not a supported image")
+
+// renditionSlots caps how many images are decoded at once; a large photo
+// takes hundreds of megabytes once decoded.
+var renditionSlots = make(chan struct{}, renditionWorkers())
+
+func renditionWorkers() int {
+	n, err := strconv.Atoi(config.GetEnv("RENDITION_WORKERS", "2"))
+	if err != nil || n < 1 {
+		return 2
+	}
+	return n
+}
+
+// RenditionKey is where the rendition of sourceKey at size is stored. They
+// live under their own prefix so they can never collide with an upload key.
+func RenditionKey(sourceKey string, size int) string {
+	if size == DisplaySize {
+		return fmt.Sprintf("renditions/%s/display.jpg", sourceKey)
+	}
+	return fmt.Sprintf("renditions/%s/%d.jpg", sourceKey, size)
+}
+
+// IsRenditionSize reports whether size is one of RenditionSizes.
+func IsRenditionSize(size int) bool {
+	for _, s := range RenditionSizes {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
+
+// EnsureRendition returns the rendition of sourceKey at size, generating it
+// first if it doesn't exist yet.
+func EnsureRendition(ctx context.Context, sourceKey string, size int) (*models.Rendition, error) {
+	var rendition models.Rendition
+	err := config.DB.Where("source_key = ? AND size = ?", sourceKey, size).First(&rendition).Error
+	if err == nil {
+		return &rendition, nil
+	}
+
+	made, err := renderSizes(ctx, sourceKey, []int{size}, func() (image.Image, error) {
+		return decodeObject(ctx, sourceKey)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &made[0], nil
+}
+
+// renderSizes decodes the source once, with decode, and stores a rendition
+// for each size that doesn't have one yet. It returns the renditions for all
+// sizes asked for, existing or new.
+func renderSizes(ctx context.Context, sourceKey string, sizes []int, decode func() (image.Image, error)) ([]models.Rendition, error) {
+	var existing []models.Rendition
+	if err := config.DB.Where("source_key = ? AND size IN ?", sourceKey, sizes).Find(&existing).Error; err != nil {
+		return nil, err
+	}
+	have := make(map[int]models.Rendition, len(existing))
+	for _, r := range existing {
+		have[r.Size] = r
+	}
+	if len(have) == len(sizes) {
+		return existing, nil
+	}
+
+	select {
+	case renditionSlots <- struct{}{}:
+		defer func() { <-renditionSlots }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	src, err := decode()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]models.Rendition, 0, len(sizes))
+	for _, size := range sizes {
+		if r, ok := have[size]; ok {
+			result = append(result, r)
+			continue
+		}
+		r, err := storeRendition(ctx, sourceKey, src, size)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, *r)
+	}
+	return result, nil
+}
+
+// decodeObject reads a stored image, applying its EXIF orientation so
+// renditions come out upright. HEIF files go to libheif, which applies their
+// rotation itself, AVIF files to libheif or ffmpeg, and videos give their
+// poster frame.
+func decodeObject(ctx context.Context, key string) (image.Image, error) {
+	return decodeOriented(ctx, key, true)
+}
+
+// decodeOriented is decodeObject with the EXIF orientation optional.
+func decodeOriented(ctx context.Context, key string, autoOrient bool) (image.Image, error) {
+	body, _, err := config.Storage.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	r := bufio.NewReaderSize(body, sniffSize)
+	head, _ := r.Peek(sniffSize)
+	var img image.Image
+	switch contentType := SniffContentType(head); {
+	case IsVideoType(contentType):
+		body.Close()
+		img, err = posterFrame(ctx, key)
+	case contentType == "image/heic", contentType == "image/heif":
+		img, err = heic.Decode(r)
+	case contentType == "image/avif":
+		img, err = decodeAVIF(ctx, key, r)
+	default:
+		img, err = imaging.Decode(r, imaging.AutoOrientation(autoOrient))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotImage, err)
+	}
+	return img, nil
+}
+
+// decodeAVIF decodes an AVIF image with libheif when the system one has an
+// AV1 decoder, and with ffmpeg otherwise; the bundled libheif has none.
+// Both apply the file's own rotation.
+func decodeAVIF(ctx context.Context, key string, r io.Reader) (image.Image, error) {
+	img, err := heic.Decode(r)
+	if err == nil {
+		return img, nil
+	}
+	img, ferr := ffmpegFrame(ctx, key, "0")
+	if ferr != nil {
+		return nil, fmt.Errorf("libheif: %v; %v", err, ferr)
+	}
+	return img, nil
+}
+
+func storeRendition(ctx context.Context, sourceKey string, src image.Image, size int) (*models.Rendition, error) {
+	// Fit never upscales, so small images keep their own size
+	img := src
+	if size != DisplaySize {
+		img = imaging.Fit(src, size, size, imaging.Lanczos)
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: renditionQuality}); err != nil {
+		return nil, err
+	}
+
+	rendition := models.Rendition{
+		SourceKey: sourceKey,
+		Size:      size,
+		Key:       RenditionKey(sourceKey, size),
+		Width:     img.Bounds().Dx(),
+		Height:    img.Bounds().Dy(),
+		Bytes:     int64(buf.Len()),
+	}
+	if err := config.Storage.Put(ctx, rendition.Key, &buf, rendition.Bytes, "image/jpeg"); err != nil {
+		return nil, fmt.Errorf("failed to store rendition: %w", err)
+	}
+	// Another request may have rendered the same size meanwhile; the object
+	// is identical either way
+	err := config.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&rendition).Error
+	if err != nil {
+		return nil, err
+	}
+	return &rendition, nil
+}
+
+// DeleteRenditions removes the renditions of objects that are being deleted.
+func DeleteRenditions(sourceKeys ...string) {
+	if len(sourceKeys) == 0 {
+		return
+	}
+	var renditions []models.Rendition
+	if err := config.DB.Where("source_key IN ?", sourceKeys).Find(&renditions).Error; err != nil {
+		log.Printf("Failed to look up renditions: %v", err)
+		return
+	}
+	if len(renditions) == 0 {
+		return
+	}
+
+	keys := make([]string, 0, len(renditions))
+	ids := make([]uint, 0, len(renditions))
+	for _, r := range renditions {
+		keys = append(keys, r.Key)
+		ids = append(ids, r.ID)
+	}
+	if err := config.DB.Delete(&models.Rendition{}, ids).Error; err != nil {
+		log.Printf("Failed to delete renditions: %v", err)
+		return
+	}
+	DeleteObjects(keys...)
+}
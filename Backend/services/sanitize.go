@@ -0,0 +1,519 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+)
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// maxSanitizeBuffer bounds what is read into memory to be rewritten: a WebP
+// file, or the meta or moov box of an ISOBMFF one.
+const maxSanitizeBuffer = 64 << 20
+
+// ErrCannotSanitize is returned for a file whose metadata Sanitize can't
+// remove, because of its format or because it is malformed or too large to
+// rewrite. Such files are refused rather than kept with their metadata.
+var ErrCannotSanitize = errors.New("the file's metadata can't be removed")
+
+// Sanitize copies an image or video from src to dst without its location
+// and identifying metadata: EXIF (GPS, serial numbers, owner, maker notes),
+// XMP, IPTC, comments and movie user data are dropped. The orientation and
+// capture time of images survive in a minimal EXIF block so the photo still
+// displays upright and keeps its place on the timeline. JPEG, PNG, GIF,
+// WebP, HEIF, MP4 and QuickTime are supported; anything else fails with
+// ErrCannotSanitize.
+func Sanitize(dst io.Writer, src io.Reader) error {
+	r := bufio.NewReaderSize(src, 64<<10)
+	head, _ := r.Peek(512)
+	switch {
+	case bytes.HasPrefix(head, []byte{0xFF, 0xD8}):
+		return sanitizeJPEG(dst, r)
+	case bytes.HasPrefix(head, pngSignature):
+		return sanitizePNG(dst, r)
+	case bytes.HasPrefix(head, []byte("GIF87a")), bytes.HasPrefix(head, []byte("GIF89a")):
+		return sanitizeGIF(dst, r)
+	case len(head) >= 12 && string(head[:4]) == "RIFF" && string(head[8:12]) == "WEBP":
+		return sanitizeWebP(dst, r)
+	case sniffISOBMFF(head) != "":
+		return sanitizeBMFF(dst, r, strings.HasPrefix(sniffISOBMFF(head), "image/"))
+	}
+	return fmt.Errorf("%w: unsupported format", ErrCannotSanitize)
+}
+
+// SanitizingReader returns the sanitized form of src as a stream. Close it
+// if it isn't read to the end.
+func SanitizingReader(src io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(Sanitize(pw, src))
+	}()
+	return pr
+}
+
+// errBadJPEG is returned for a JPEG whose segments can't be read up to the
+// first scan.
+var errBadJPEG = fmt.Errorf("%w: malformed JPEG", ErrCannotSanitize)
+
+// sanitizeJPEG rewrites the segments in front of the image data and then
+// copies the scans up to the end-of-image marker. Anything after it, such as
+// the extra images of an MPO, is dropped since it carries its own EXIF.
+func sanitizeJPEG(dst io.Writer, r *bufio.Reader) error {
+	if err := writeJPEGHeader(dst, r); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			// The file ends before its image data
+			return errBadJPEG
+		}
+		return err
+	}
+	return copyJPEGScans(dst, r)
+}
+
+// writeJPEGHeader writes the kept segments up to and including the start of
+// the first scan.
+func writeJPEGHeader(dst io.Writer, r *bufio.Reader) error {
+	var raw bytes.Buffer // every segment, for reading the kept fields
+	var kept [][]byte
+	for {
+		marker, err := readJPEGMarker(r)
+		if err != nil {
+			return err
+		}
+		if marker == 0xD8 {
+			continue
+		}
+		if marker == 0xDA {
+			break
+		}
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			kept = append(kept, []byte{0xFF, marker})
+			continue
+		}
+
+		var length [2]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return err
+		}
+		n := int(binary.BigEndian.Uint16(length[:]))
+		if n < 2 {
+			return errBadJPEG
+		}
+		segment := make([]byte, 4+n-2)
+		segment[0], segment[1], segment[2], segment[3] = 0xFF, marker, length[0], length[1]
+		if _, err := io.ReadFull(r, segment[4:]); err != nil {
+			return err
+		}
+		raw.Write(segment)
+		if keepJPEGSegment(marker, segment[4:]) {
+			kept = append(kept, segment)
+		}
+	}
+
+	if _, err := dst.Write([]byte{0xFF, 0xD8}); err != nil {
+		return err
+	}
+	// JFIF wants its APP0 first, EXIF wants to be right after it
+	if len(kept) > 0 && kept[0][1] == 0xE0 {
+		if _, err := dst.Write(kept[0]); err != nil {
+			return err
+		}
+		kept = kept[1:]
+	}
+	if tiff := minimalEXIF(append([]byte{0xFF, 0xD8}, raw.Bytes()...)); tiff != nil {
+		payload := append([]byte("Exif\x00\x00"), tiff...)
+		header := []byte{0xFF, 0xE1, 0, 0}
+		binary.BigEndian.PutUint16(header[2:], uint16(len(payload)+2))
+		if _, err := dst.Write(append(header, payload...)); err != nil {
+			return err
+		}
+	}
+	for _, segment := range kept {
+		if _, err := dst.Write(segment); err != nil {
+			return err
+		}
+	}
+	_, err := dst.Write([]byte{0xFF, 0xDA})
+	return err
+}
+
+func readJPEGMarker(r *bufio.Reader) (byte, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if b != 0xFF {
+		return 0, fmt.Errorf("%w: expected a marker, got %#x", errBadJPEG, b)
+	}
+	for b == 0xFF {
+		// Markers may be padded with any number of 0xFF fill bytes
+		if b, err = r.ReadByte(); err != nil {
+			return 0, err
+		}
+	}
+	return b, nil
+}
+
+// keepJPEGSegment keeps what is needed to decode and colour the image: the
+// JFIF header, ICC profile, Adobe colour transform and all non-APP segments.
+func keepJPEGSegment(marker byte, payload []byte) bool {
+	switch {
+	case marker == 0xE0:
+		return bytes.HasPrefix(payload, []byte("JFIF\x00")) || bytes.HasPrefix(payload, []byte("JFXX\x00"))
+	case marker == 0xE2:
+		return bytes.HasPrefix(payload, []byte("ICC_PROFILE\x00"))
+	case marker == 0xEE:
+		return bytes.HasPrefix(payload, []byte("Adobe"))
+	case marker >= 0xE1 && marker <= 0xEF, marker == 0xFE:
+		return false
+	}
+	return true
+}
+
+// copyJPEGScans copies entropy-coded data through the end-of-image marker.
+// 0xFF never appears unescaped inside a scan, so the first 0xFF 0xD9 is the
+// end of the image.
+func copyJPEGScans(dst io.Writer, r *bufio.Reader) error {
+	for {
+		chunk, err := r.ReadSlice(0xFF)
+		if _, werr := dst.Write(chunk); werr != nil {
+			return werr
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF {
+			// Truncated file; keep what there is
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		next, err := r.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if next == 0xFF {
+			r.UnreadByte()
+			continue
+		}
+		if _, err := dst.Write([]byte{next}); err != nil {
+			return err
+		}
+		if next == 0xD9 {
+			return nil
+		}
+	}
+}
+
+// sanitizePNG drops the eXIf and text chunks, which is where PNG keeps EXIF,
+// XMP and free-form comments.
+func sanitizePNG(dst io.Writer, r *bufio.Reader) error {
+	if _, err := io.CopyN(dst, r, int64(len(pngSignature))); err != nil {
+		return err
+	}
+
+	var raw bytes.Buffer
+	wroteEXIF := false
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		length := int64(binary.BigEndian.Uint32(header[:4]))
+		kind := string(header[4:])
+
+		switch kind {
+		case "eXIf", "tEXt", "zTXt", "iTXt":
+			data := make([]byte, length)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return err
+			}
+			if _, err := r.Discard(4); err != nil {
+				return err
+			}
+			if kind == "eXIf" {
+				// EXIF has to come first for the parser to find it
+				data = append(data, raw.Bytes()...)
+				raw.Reset()
+			}
+			raw.Write(data)
+			continue
+		case "IDAT":
+			if !wroteEXIF {
+				wroteEXIF = true
+				if tiff := minimalEXIF(raw.Bytes()); tiff != nil {
+					if err := writePNGChunk(dst, "eXIf", tiff); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		if _, err := dst.Write(header[:]); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(dst, r, length+4); err != nil {
+			return err
+		}
+		if kind == "IEND" {
+			return nil
+		}
+	}
+}
+
+func writePNGChunk(dst io.Writer, kind string, data []byte) error {
+	chunk := make([]byte, 8, 12+len(data))
+	binary.BigEndian.PutUint32(chunk[:4], uint32(len(data)))
+	copy(chunk[4:], kind)
+	chunk = append(chunk, data...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+	_, err := dst.Write(chunk)
+	return err
+}
+
+// sanitizeGIF drops comment extensions and the application extensions
+// other than looping and colour profiles, which is where GIF keeps XMP.
+func sanitizeGIF(dst io.Writer, r *bufio.Reader) error {
+	var header [13]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return err
+	}
+	if _, err := dst.Write(header[:]); err != nil {
+		return err
+	}
+	if err := copyGIFColorTable(dst, r, header[10]); err != nil {
+		return err
+	}
+
+	for {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			// Truncated file; keep what there is
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch b {
+		case 0x21:
+			label, err := r.ReadByte()
+			if err != nil {
+				return err
+			}
+			var ext bytes.Buffer
+			ext.Write([]byte{b, label})
+			if err := copyGIFSubBlocks(&ext, r); err != nil {
+				return err
+			}
+			if keepGIFExtension(label, ext.Bytes()[2:]) {
+				if _, err := dst.Write(ext.Bytes()); err != nil {
+					return err
+				}
+			}
+		case 0x2C:
+			var descriptor [10]byte
+			descriptor[0] = b
+			if _, err := io.ReadFull(r, descriptor[1:]); err != nil {
+				return err
+			}
+			if _, err := dst.Write(descriptor[:]); err != nil {
+				return err
+			}
+			if err := copyGIFColorTable(dst, r, descriptor[9]); err != nil {
+				return err
+			}
+			// The LZW minimum code size, then the image data
+			if _, err := io.CopyN(dst, r, 1); err != nil {
+				return err
+			}
+			if err := copyGIFSubBlocks(dst, r); err != nil {
+				return err
+			}
+		case 0x3B:
+			_, err := dst.Write([]byte{b})
+			return err
+		default:
+			return fmt.Errorf("%w: unexpected GIF block %#x", ErrCannotSanitize, b)
+		}
+	}
+}
+
+// copyGIFColorTable copies the colour table that the packed fields of a
+// screen or image descriptor announce, if any.
+func copyGIFColorTable(dst io.Writer, r *bufio.Reader, packed byte) error {
+	if packed&0x80 == 0 {
+		return nil
+	}
+	_, err := io.CopyN(dst, r, 3<<(packed&0x07+1))
+	return err
+}
+
+// copyGIFSubBlocks copies data sub-blocks through the empty one that ends
+// them.
+func copyGIFSubBlocks(dst io.Writer, r *bufio.Reader) error {
+	for {
+		n, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if _, err := dst.Write([]byte{n}); err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		if _, err := io.CopyN(dst, r, int64(n)); err != nil {
+			return err
+		}
+	}
+}
+
+// keepGIFExtension keeps graphic control and plain text extensions, and
+// the application extensions for looping and ICC profiles.
+func keepGIFExtension(label byte, blocks []byte) bool {
+	switch label {
+	case 0xFE:
+		return false
+	case 0xFF:
+		if len(blocks) < 12 || blocks[0] != 11 {
+			return false
+		}
+		switch string(blocks[1:12]) {
+		case "NETSCAPE2.0", "ANIMEXTS1.0", "ICCRGBG1012":
+			return true
+		}
+		return false
+	}
+	return true
+}
+
+// sanitizeWebP drops the EXIF and XMP chunks of a WebP and puts back a
+// minimal EXIF chunk. The file is rewritten in memory, since the RIFF
+// header holds its size.
+func sanitizeWebP(dst io.Writer, r *bufio.Reader) error {
+	data, err := io.ReadAll(io.LimitReader(r, maxSanitizeBuffer+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > maxSanitizeBuffer {
+		return fmt.Errorf("%w: WebP too large to rewrite", ErrCannotSanitize)
+	}
+
+	type chunk struct {
+		kind string
+		data []byte
+	}
+	var chunks []chunk
+	var original []byte
+	vp8x := -1
+	for p := 12; p+8 <= len(data); {
+		n := int(binary.LittleEndian.Uint32(data[p+4:]))
+		if n > len(data)-p-8 {
+			return fmt.Errorf("%w: malformed WebP chunk", ErrCannotSanitize)
+		}
+		c := chunk{string(data[p : p+4]), data[p+8 : p+8+n]}
+		p += 8 + n + n&1
+
+		switch c.kind {
+		case "EXIF":
+			original = c.data
+		case "XMP ":
+		case "VP8X":
+			if len(c.data) < 1 {
+				return fmt.Errorf("%w: malformed WebP chunk", ErrCannotSanitize)
+			}
+			// The flags say which optional chunks follow
+			c.data = append([]byte{c.data[0] &^ 0x0C}, c.data[1:]...)
+			vp8x = len(chunks)
+			chunks = append(chunks, c)
+		default:
+			chunks = append(chunks, c)
+		}
+	}
+	// Only the extended format has room for EXIF, at the end of the file
+	if tiff := minimalEXIF(original); tiff != nil && vp8x >= 0 {
+		chunks[vp8x].data[0] |= 0x08
+		chunks = append(chunks, chunk{"EXIF", tiff})
+	}
+
+	out := []byte("RIFF\x00\x00\x00\x00WEBP")
+	for _, c := range chunks {
+		out = append(out, c.kind...)
+		out = binary.LittleEndian.AppendUint32(out, uint32(len(c.data)))
+		out = append(out, c.data...)
+		if len(c.data)%2 == 1 {
+			out = append(out, 0)
+		}
+	}
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	_, err = dst.Write(out)
+	return err
+}
+
+// minimalEXIF builds a TIFF block holding only the orientation and capture
+// time read from the original metadata, or nil if neither is worth keeping.
+func minimalEXIF(original []byte) []byte {
+	meta := ParseMetadata(original)
+	if meta.Orientation == 1 && meta.CapturedAt == nil {
+		return nil
+	}
+
+	const (
+		tagOrientation      = 0x0112
+		tagExifIFD          = 0x8769
+		tagDateTimeOriginal = 0x9003
+		typeASCII           = 2
+		typeShort           = 3
+		typeLong            = 4
+	)
+	type entry struct {
+		tag, kind uint16
+		value     uint32
+	}
+
+	var ifd0 []entry
+	if meta.Orientation != 1 {
+		// A SHORT sits in the high half of the big-endian value field
+		ifd0 = append(ifd0, entry{tagOrientation, typeShort, uint32(meta.Orientation) << 16})
+	}
+	if meta.CapturedAt != nil {
+		// The Exif IFD follows IFD0, and the date string follows that
+		exifIFD := uint32(8 + 2 + 12*(len(ifd0)+1) + 4)
+		ifd0 = append(ifd0, entry{tagExifIFD, typeLong, exifIFD})
+	}
+
+	var b bytes.Buffer
+	b.WriteString("MM\x00\x2A")
+	binary.Write(&b, binary.BigEndian, uint32(8))
+	writeIFD := func(entries []entry, count uint32) {
+		binary.Write(&b, binary.BigEndian, uint16(len(entries)))
+		for _, e := range entries {
+			binary.Write(&b, binary.BigEndian, e.tag)
+			binary.Write(&b, binary.BigEndian, e.kind)
+			binary.Write(&b, binary.BigEndian, count)
+			binary.Write(&b, binary.BigEndian, e.value)
+		}
+		binary.Write(&b, binary.BigEndian, uint32(0))
+	}
+	writeIFD(ifd0, 1)
+	if meta.CapturedAt != nil {
+		date := meta.CapturedAt.Format(exifTimeLayout) + "\x00"
+		dateAt := uint32(b.Len() + 2 + 12 + 4)
+		writeIFD([]entry{{tagDateTimeOriginal, typeASCII, dateAt}}, uint32(len(date)))
+		b.WriteString(date)
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,564 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// errBadBMFF is returned for an ISOBMFF file whose boxes don't add up.
+var errBadBMFF = fmt.Errorf("%w: malformed ISOBMFF box", ErrCannotSanitize)
+
+// xmpUUID is the extended type of the uuid box that holds XMP in MP4 and
+// QuickTime files.
+var xmpUUID = []byte{0xBE, 0x7A, 0xCF, 0xCB, 0x97, 0xA9, 0x42, 0xE8, 0x9C, 0x71, 0x99, 0x94, 0x91, 0xE3, 0xAF, 0xAC}
+
+// movieContainers are the boxes of a movie searched for metadata.
+var movieContainers = map[string]bool{"moov": true, "trak": true, "mdia": true, "minf": true}
+
+// bmffRewrite replaces length bytes at offset in the file with what rewrite
+// makes of them, which is as long.
+type bmffRewrite struct {
+	offset, length int64
+	rewrite        func([]byte) []byte
+}
+
+// sanitizeBMFF strips metadata from HEIF images and MP4 and QuickTime
+// movies without moving anything, since several boxes hold offsets into
+// the file. Metadata boxes become free space of the same size, and the EXIF
+// and XMP items of an image are overwritten where they lie. The meta box of
+// an image and the moov box are rewritten in memory; the rest is streamed.
+func sanitizeBMFF(dst io.Writer, r *bufio.Reader, image bool) error {
+	var pos int64
+	var pending []bmffRewrite
+	for {
+		header, size, err := readBMFFHeader(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		kind := string(header[4:8])
+		start := pos
+		pos += int64(len(header))
+
+		if kind == "moov" || (kind == "meta" && image) {
+			if size < 0 || size > maxSanitizeBuffer {
+				return fmt.Errorf("%w: %s box too large to rewrite", ErrCannotSanitize, kind)
+			}
+			box := make([]byte, size)
+			copy(box, header)
+			if _, err := io.ReadFull(r, box[len(header):]); err != nil {
+				return err
+			}
+			pos = start + size
+
+			if kind == "moov" {
+				if err := blankMovieMetadata(box[len(header):]); err != nil {
+					return err
+				}
+			} else {
+				rewrites, err := heifMetadataRewrites(box[len(header):], start+int64(len(header)))
+				if err != nil {
+					return err
+				}
+				for _, w := range rewrites {
+					if w.offset < start {
+						return fmt.Errorf("%w: metadata stored ahead of the meta box", ErrCannotSanitize)
+					}
+				}
+				pending = append(pending, rewrites...)
+				sort.Slice(pending, func(i, j int) bool { return pending[i].offset < pending[j].offset })
+				for i := 1; i < len(pending); i++ {
+					if pending[i].offset < pending[i-1].offset+pending[i-1].length {
+						return errBadBMFF
+					}
+				}
+			}
+			inside, err := takeRewrites(&pending, start, pos)
+			if err != nil {
+				return err
+			}
+			for _, w := range inside {
+				at := box[w.offset-start : w.offset-start+w.length]
+				copy(at, w.rewrite(at))
+			}
+			if _, err := dst.Write(box); err != nil {
+				return err
+			}
+			continue
+		}
+
+		payload := int64(-1)
+		if size >= 0 {
+			payload = size - int64(len(header))
+		}
+		blank := kind == "udta" || kind == "meta"
+		if kind == "uuid" {
+			if payload >= 0 && payload < 16 {
+				return errBadBMFF
+			}
+			ext := make([]byte, 16)
+			if _, err := io.ReadFull(r, ext); err != nil {
+				return err
+			}
+			blank = bytes.Equal(ext, xmpUUID)
+			if blank {
+				clear(ext)
+			}
+			header = append(header, ext...)
+			pos += 16
+			if payload >= 0 {
+				payload -= 16
+			}
+		}
+
+		if blank {
+			copy(header[4:8], "free")
+			if _, err := dst.Write(header); err != nil {
+				return err
+			}
+			var n int64
+			if payload < 0 {
+				n, err = io.Copy(io.Discard, r)
+			} else {
+				n, err = io.CopyN(io.Discard, r, payload)
+			}
+			if err != nil && err != io.EOF {
+				return err
+			}
+			pos += n
+			if err := writeZeros(dst, n); err != nil {
+				return err
+			}
+			// Anything to overwrite in the box went with it
+			if _, err := takeRewrites(&pending, start, pos); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if _, err := dst.Write(header); err != nil {
+			return err
+		}
+		n, err := copyBMFF(dst, r, pos, payload, &pending)
+		pos += n
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readBMFFHeader reads the header of a box and returns it with the size of
+// the whole box, or -1 for a box that runs to the end of the file.
+func readBMFFHeader(r *bufio.Reader) ([]byte, int64, error) {
+	header := make([]byte, 8, 32)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			// Trailing bytes too short to be a box
+			return nil, 0, io.EOF
+		}
+		return nil, 0, err
+	}
+
+	size := int64(binary.BigEndian.Uint32(header))
+	switch size {
+	case 0:
+		return header, -1, nil
+	case 1:
+		header = header[:16]
+		if _, err := io.ReadFull(r, header[8:]); err != nil {
+			return nil, 0, err
+		}
+		size = int64(binary.BigEndian.Uint64(header[8:]))
+	}
+	if size < int64(len(header)) {
+		return nil, 0, errBadBMFF
+	}
+	return header, size, nil
+}
+
+// copyBMFF copies n bytes, or the rest of the file if n is negative, that
+// start at pos in the file, applying the pending rewrites that fall in
+// them. It returns how many bytes it read.
+func copyBMFF(dst io.Writer, r *bufio.Reader, pos, n int64, pending *[]bmffRewrite) (int64, error) {
+	start := pos
+	for len(*pending) > 0 && (n < 0 || (*pending)[0].offset < start+n) {
+		w := (*pending)[0]
+		if w.offset < pos || (n >= 0 && w.offset+w.length > start+n) {
+			return pos - start, errBadBMFF
+		}
+		copied, err := io.CopyN(dst, r, w.offset-pos)
+		pos += copied
+		if err == io.EOF {
+			return pos - start, nil
+		}
+		if err != nil {
+			return pos - start, err
+		}
+
+		data := make([]byte, w.length)
+		read, err := io.ReadFull(r, data)
+		pos += int64(read)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// Truncated inside the metadata; what there is of it goes
+			return pos - start, writeZeros(dst, int64(read))
+		}
+		if err != nil {
+			return pos - start, err
+		}
+		if _, err := dst.Write(w.rewrite(data)); err != nil {
+			return pos - start, err
+		}
+		*pending = (*pending)[1:]
+	}
+
+	var copied int64
+	var err error
+	if n < 0 {
+		copied, err = io.Copy(dst, r)
+	} else {
+		copied, err = io.CopyN(dst, r, start+n-pos)
+	}
+	pos += copied
+	if err == io.EOF {
+		// Truncated file; keep what there is
+		err = nil
+	}
+	return pos - start, err
+}
+
+// takeRewrites removes the pending rewrites that fall between start and
+// end from the front of the list and returns them. One that only partly
+// does means the boxes overlap.
+func takeRewrites(pending *[]bmffRewrite, start, end int64) ([]bmffRewrite, error) {
+	i := 0
+	for i < len(*pending) && (*pending)[i].offset < end {
+		w := (*pending)[i]
+		if w.offset < start || w.offset+w.length > end {
+			return nil, errBadBMFF
+		}
+		i++
+	}
+	taken := (*pending)[:i]
+	*pending = (*pending)[i:]
+	return taken, nil
+}
+
+func writeZeros(dst io.Writer, n int64) error {
+	zeros := make([]byte, 32<<10)
+	for n > 0 {
+		chunk := zeros
+		if n < int64(len(chunk)) {
+			chunk = chunk[:n]
+		}
+		if _, err := dst.Write(chunk); err != nil {
+			return err
+		}
+		n -= int64(len(chunk))
+	}
+	return nil
+}
+
+// bmffChild reads the header of the box at p in boxes, returning the length
+// of its header, where it ends and its type.
+func bmffChild(boxes []byte, p int) (int, int, string, error) {
+	if len(boxes)-p < 8 {
+		return 0, 0, "", errBadBMFF
+	}
+	size := uint64(binary.BigEndian.Uint32(boxes[p:]))
+	headerLen := 8
+	switch size {
+	case 0:
+		size = uint64(len(boxes) - p)
+	case 1:
+		if len(boxes)-p < 16 {
+			return 0, 0, "", errBadBMFF
+		}
+		size = binary.BigEndian.Uint64(boxes[p+8:])
+		headerLen = 16
+	}
+	if size < uint64(headerLen) || size > uint64(len(boxes)-p) {
+		return 0, 0, "", errBadBMFF
+	}
+	return headerLen, p + int(size), string(boxes[p+4 : p+8]), nil
+}
+
+// blankMovieMetadata turns the user data, metadata and XMP boxes among
+// boxes, and inside the tracks they contain, into free space.
+func blankMovieMetadata(boxes []byte) error {
+	for p := 0; p < len(boxes); {
+		if len(boxes)-p < 8 {
+			// QuickTime may end a list with a zero terminator
+			return nil
+		}
+		headerLen, end, kind, err := bmffChild(boxes, p)
+		if err != nil {
+			return err
+		}
+		payload := boxes[p+headerLen : end]
+
+		switch {
+		case kind == "udta", kind == "meta", kind == "XMP_", kind == "uuid" && bytes.HasPrefix(payload, xmpUUID):
+			copy(boxes[p+4:], "free")
+			clear(payload)
+		case movieContainers[kind]:
+			if err := blankMovieMetadata(payload); err != nil {
+				return err
+			}
+		}
+		p = end
+	}
+	return nil
+}
+
+// heifMetadataRewrites finds the EXIF and XMP items of a HEIF image from
+// the payload of its meta box, which starts at offset in the file, and
+// returns how to overwrite them, ordered by offset. An EXIF item keeps what
+// minimalEXIF keeps.
+func heifMetadataRewrites(meta []byte, offset int64) ([]bmffRewrite, error) {
+	// meta is a full box: version and flags come first
+	if len(meta) < 4 {
+		return nil, errBadBMFF
+	}
+	boxes := meta[4:]
+	offset += 4
+
+	var iinf, iloc []byte
+	idatAt, idatLen := int64(-1), int64(0)
+	for p := 0; p < len(boxes); {
+		headerLen, end, kind, err := bmffChild(boxes, p)
+		if err != nil {
+			return nil, err
+		}
+		switch kind {
+		case "iinf":
+			iinf = boxes[p+headerLen : end]
+		case "iloc":
+			iloc = boxes[p+headerLen : end]
+		case "idat":
+			idatAt, idatLen = offset+int64(p+headerLen), int64(end-p-headerLen)
+		}
+		p = end
+	}
+
+	items, err := heifMetadataItems(iinf)
+	if err != nil || len(items) == 0 {
+		return nil, err
+	}
+	locations, err := heifItemLocations(iloc)
+	if err != nil {
+		return nil, err
+	}
+
+	var rewrites []bmffRewrite
+	for id, kind := range items {
+		loc, ok := locations[id]
+		if !ok {
+			continue
+		}
+		var origin, limit int64
+		switch {
+		case loc.method == 0 && loc.dataRef == 0:
+			origin, limit = 0, 1<<62
+		case loc.method == 1 && idatAt >= 0:
+			origin, limit = idatAt, idatLen
+		default:
+			// Stored in another file or made from other items
+			return nil, fmt.Errorf("%w: unsupported HEIF item location", ErrCannotSanitize)
+		}
+
+		for _, e := range loc.extents {
+			at, length := loc.base+e[0], e[1]
+			if length == 0 || length > maxSanitizeBuffer || at+length > limit {
+				return nil, errBadBMFF
+			}
+			rewrite := blankXMPItem
+			if kind == "Exif" {
+				rewrite = blankEXIFItem
+				if len(loc.extents) == 1 {
+					rewrite = minimalEXIFItem
+				}
+			}
+			rewrites = append(rewrites, bmffRewrite{origin + at, length, rewrite})
+		}
+	}
+	sort.Slice(rewrites, func(i, j int) bool { return rewrites[i].offset < rewrites[j].offset })
+	return rewrites, nil
+}
+
+// heifMetadataItems reads an item info box, returning the IDs of its EXIF
+// and XMP items with "Exif" or "XMP" for each.
+func heifMetadataItems(iinf []byte) (map[uint32]string, error) {
+	items := map[uint32]string{}
+	if iinf == nil {
+		return items, nil
+	}
+	f := &bmffFields{data: iinf}
+	version := f.uint(1)
+	f.uint(3)
+	// The entry count, which the boxes that follow make redundant
+	if version == 0 {
+		f.uint(2)
+	} else {
+		f.uint(4)
+	}
+	if f.bad {
+		return nil, errBadBMFF
+	}
+	boxes := f.data
+
+	for p := 0; p < len(boxes); {
+		headerLen, end, kind, err := bmffChild(boxes, p)
+		if err != nil {
+			return nil, err
+		}
+		entry := boxes[p+headerLen : end]
+		p = end
+		// Only version 2 and later entries have an item type
+		if kind != "infe" || len(entry) < 4 || entry[0] < 2 {
+			continue
+		}
+
+		f := &bmffFields{data: entry[4:]}
+		var id uint64
+		if entry[0] == 2 {
+			id = f.uint(2)
+		} else {
+			id = f.uint(4)
+		}
+		f.uint(2) // protection index
+		if f.bad || len(f.data) < 4 {
+			return nil, errBadBMFF
+		}
+		itemType := string(f.data[:4])
+		// The name, then for MIME items the content type, NUL-terminated
+		_, rest, _ := bytes.Cut(f.data[4:], []byte{0})
+		contentType, _, _ := bytes.Cut(rest, []byte{0})
+
+		switch {
+		case itemType == "Exif":
+			items[uint32(id)] = "Exif"
+		case itemType == "mime" && strings.HasPrefix(string(contentType), "application/rdf+xml"):
+			items[uint32(id)] = "XMP"
+		}
+	}
+	return items, nil
+}
+
+// heifItemLocation is where an item's data is, from an item location box.
+type heifItemLocation struct {
+	method  uint64
+	dataRef uint64
+	base    int64
+	extents [][2]int64 // offset and length from base
+}
+
+// heifItemLocations reads an item location box, by item ID.
+func heifItemLocations(iloc []byte) (map[uint32]heifItemLocation, error) {
+	locations := map[uint32]heifItemLocation{}
+	if iloc == nil {
+		return locations, nil
+	}
+	f := &bmffFields{data: iloc}
+	version := f.uint(1)
+	f.uint(3)
+	sizes := f.uint(1)
+	offsetSize, lengthSize := int(sizes>>4), int(sizes&0x0F)
+	sizes = f.uint(1)
+	baseSize, indexSize := int(sizes>>4), 0
+	if version == 1 || version == 2 {
+		indexSize = int(sizes & 0x0F)
+	}
+	idSize := 2
+	if version == 2 {
+		idSize = 4
+	}
+
+	count := f.uint(idSize)
+	for i := uint64(0); i < count && !f.bad; i++ {
+		var loc heifItemLocation
+		id := f.uint(idSize)
+		if version == 1 || version == 2 {
+			loc.method = f.uint(2) & 0x0F
+		}
+		loc.dataRef = f.uint(2)
+		loc.base = f.offset(baseSize)
+		extents := f.uint(2)
+		for j := uint64(0); j < extents && !f.bad; j++ {
+			f.uint(indexSize)
+			loc.extents = append(loc.extents, [2]int64{f.offset(offsetSize), f.offset(lengthSize)})
+		}
+		locations[uint32(id)] = loc
+	}
+	if f.bad {
+		return nil, errBadBMFF
+	}
+	return locations, nil
+}
+
+// bmffFields reads big-endian fields from a box, remembering if it ran out
+// of data.
+type bmffFields struct {
+	data []byte
+	bad  bool
+}
+
+func (f *bmffFields) uint(size int) uint64 {
+	if size > 8 || len(f.data) < size {
+		f.bad, f.data = true, nil
+		return 0
+	}
+	var v uint64
+	for _, b := range f.data[:size] {
+		v = v<<8 | uint64(b)
+	}
+	f.data = f.data[size:]
+	return v
+}
+
+// offset reads an offset or length, which must fit comfortably in an int64.
+func (f *bmffFields) offset(size int) int64 {
+	v := f.uint(size)
+	if v >= 1<<48 {
+		f.bad = true
+	}
+	return int64(v)
+}
+
+// minimalEXIFItem overwrites a HEIF EXIF item with one holding only what
+// minimalEXIF keeps, or with zeros if that doesn't fit. The item starts with
+// the offset of its TIFF block past an "Exif\0\0" header.
+func minimalEXIFItem(item []byte) []byte {
+	out := make([]byte, len(item))
+	if len(item) < 4 {
+		return out
+	}
+	skip := uint64(binary.BigEndian.Uint32(item))
+	if skip > uint64(len(item)-4) {
+		return out
+	}
+	tiff := minimalEXIF(item[4+skip:])
+	if tiff == nil || 10+len(tiff) > len(out) {
+		return out
+	}
+	binary.BigEndian.PutUint32(out, 6)
+	copy(out[4:], "Exif\x00\x00")
+	copy(out[10:], tiff)
+	return out
+}
+
+// blankEXIFItem overwrites an EXIF item split into several extents.
+func blankEXIFItem(item []byte) []byte {
+	return make([]byte, len(item))
+}
+
+// blankXMPItem overwrites an XMP item with spaces.
+func blankXMPItem(item []byte) []byte {
+	return bytes.Repeat([]byte{' '}, len(item))
+}
@@ -0,0 +1,373 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+	"time"
+)
+
+// capturedAt is the capture time testEXIF records.
+var capturedAt = time.Date(2021, 7, 4, 18, 30, 0, 0, time.UTC)
+
+// testEXIF builds a big-endian TIFF block with a camera make, orientation 6,
+// a capture time and a GPS position.
+func testEXIF() []byte {
+	var b bytes.Buffer
+	u16 := func(v uint16) { binary.Write(&b, binary.BigEndian, v) }
+	u32 := func(v uint32) { binary.Write(&b, binary.BigEndian, v) }
+	entry := func(tag, kind uint16, count, value uint32) { u16(tag); u16(kind); u32(count); u32(value) }
+
+	// IFD0 at 8, the Exif IFD at 62, the GPS IFD at 80, values from 134
+	b.WriteString("MM\x00\x2A")
+	u32(8)
+	u16(4)
+	entry(0x010F, 2, 5, 134)   // Make
+	entry(0x0112, 3, 1, 6<<16) // Orientation
+	entry(0x8769, 4, 1, 62)    // Exif IFD
+	entry(0x8825, 4, 1, 80)    // GPS IFD
+	u32(0)
+	u16(1)
+	entry(0x9003, 2, 20, 140) // DateTimeOriginal
+	u32(0)
+	u16(4)
+	entry(0x0001, 2, 2, 'N'<<24) // GPSLatitudeRef
+	entry(0x0002, 5, 3, 160)     // GPSLatitude
+	entry(0x0003, 2, 2, 'E'<<24) // GPSLongitudeRef
+	entry(0x0004, 5, 3, 184)     // GPSLongitude
+	u32(0)
+	b.WriteString("Acme\x00\x00")
+	b.WriteString(capturedAt.Format(exifTimeLayout) + "\x00")
+	for _, v := range []uint32{52, 1, 31, 1, 0, 1, 13, 1, 24, 1, 0, 1} {
+		u32(v)
+	}
+	return b.Bytes()
+}
+
+const testXMP = `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#"><rdf:Description xmlns:exif="http://ns.adobe.com/exif/1.0/" exif:GPSLatitude="52,31.0N" exif:GPSLongitude="13,24.0E"/></rdf:RDF></x:xmpmeta>`
+
+func testImage() image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, 8, 4))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i * 7)
+	}
+	return img
+}
+
+// checkSanitized checks that a sanitized file kept the orientation and
+// capture time of testEXIF and nothing else.
+func checkSanitized(t *testing.T, out []byte) {
+	t.Helper()
+	meta := ParseMetadata(out)
+	if meta.Latitude != nil || meta.Longitude != nil {
+		t.Errorf("position survived: %v, %v", *meta.Latitude, *meta.Longitude)
+	}
+	if meta.CameraMake != "" {
+		t.Errorf("camera make survived: %q", meta.CameraMake)
+	}
+	if meta.Orientation != 6 {
+		t.Errorf("orientation = %d, want 6", meta.Orientation)
+	}
+	if meta.CapturedAt == nil || !meta.CapturedAt.Equal(capturedAt) {
+		t.Errorf("capture time = %v, want %v", meta.CapturedAt, capturedAt)
+	}
+	for _, s := range []string{"Acme", "xmpmeta", "GPSLatitude", "secret"} {
+		if bytes.Contains(out, []byte(s)) {
+			t.Errorf("%q survived", s)
+		}
+	}
+}
+
+func sanitize(t *testing.T, in []byte) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	if err := Sanitize(&out, bytes.NewReader(in)); err != nil {
+		t.Fatalf("Sanitize failed: %v", err)
+	}
+	return out.Bytes()
+}
+
+func TestSanitizeJPEG(t *testing.T) {
+	var enc bytes.Buffer
+	if err := jpeg.Encode(&enc, testImage(), nil); err != nil {
+		t.Fatal(err)
+	}
+	segment := func(marker byte, payload string) []byte {
+		b := []byte{0xFF, marker, 0, 0}
+		binary.BigEndian.PutUint16(b[2:], uint16(len(payload)+2))
+		return append(b, payload...)
+	}
+	in := []byte{0xFF, 0xD8}
+	in = append(in, segment(0xE1, "Exif\x00\x00"+string(testEXIF()))...)
+	in = append(in, segment(0xE1, "http://ns.adobe.com/xap/1.0/\x00"+testXMP)...)
+	in = append(in, segment(0xED, "Photoshop 3.0\x00secret IPTC")...)
+	in = append(in, segment(0xFE, "secret comment")...)
+	in = append(in, enc.Bytes()[2:]...)
+	// Trailing images of an MPO carry their own EXIF
+	in = append(in, segment(0xE1, "Exif\x00\x00secret")...)
+
+	out := sanitize(t, in)
+	checkSanitized(t, out)
+	if _, err := jpeg.Decode(bytes.NewReader(out)); err != nil {
+		t.Errorf("sanitized JPEG doesn't decode: %v", err)
+	}
+}
+
+func TestSanitizePNG(t *testing.T) {
+	var enc bytes.Buffer
+	if err := png.Encode(&enc, testImage()); err != nil {
+		t.Fatal(err)
+	}
+	// After the signature and IHDR
+	at := len(pngSignature) + 25
+	var extra bytes.Buffer
+	writePNGChunk(&extra, "tEXt", []byte("Comment\x00secret"))
+	writePNGChunk(&extra, "iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00"+testXMP))
+	writePNGChunk(&extra, "eXIf", testEXIF())
+	in := append(append(append([]byte{}, enc.Bytes()[:at]...), extra.Bytes()...), enc.Bytes()[at:]...)
+
+	out := sanitize(t, in)
+	checkSanitized(t, out)
+	if _, err := png.Decode(bytes.NewReader(out)); err != nil {
+		t.Errorf("sanitized PNG doesn't decode: %v", err)
+	}
+}
+
+func TestSanitizeGIF(t *testing.T) {
+	frame := image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{color.Black, color.White})
+	var enc bytes.Buffer
+	err := gif.EncodeAll(&enc, &gif.GIF{Image: []*image.Paletted{frame, frame}, Delay: []int{10, 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := 13
+	if flags := enc.Bytes()[10]; flags&0x80 != 0 {
+		at += 3 << (flags&0x07 + 1)
+	}
+	extra := []byte{0x21, 0xFE, 14}
+	extra = append(extra, "secret comment\x00"...)
+	extra = append(extra, 0x21, 0xFF, 11)
+	extra = append(extra, "XMP DataXMP"...)
+	extra = append(extra, byte(len(testXMP)))
+	extra = append(extra, testXMP...)
+	extra = append(extra, 0)
+	in := append(append(append([]byte{}, enc.Bytes()[:at]...), extra...), enc.Bytes()[at:]...)
+	if _, err := gif.DecodeAll(bytes.NewReader(in)); err != nil {
+		t.Fatalf("test GIF doesn't decode: %v", err)
+	}
+
+	out := sanitize(t, in)
+	if bytes.Contains(out, []byte("secret")) || bytes.Contains(out, []byte("XMP")) {
+		t.Error("comment or XMP survived")
+	}
+	if !bytes.Contains(out, []byte("NETSCAPE2.0")) {
+		t.Error("looping extension was dropped")
+	}
+	all, err := gif.DecodeAll(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("sanitized GIF doesn't decode: %v", err)
+	}
+	if len(all.Image) != 2 {
+		t.Errorf("sanitized GIF has %d frames, want 2", len(all.Image))
+	}
+}
+
+// riffChunks lists the chunks of a WebP by type.
+func riffChunks(t *testing.T, b []byte) map[string][]byte {
+	t.Helper()
+	if size := binary.LittleEndian.Uint32(b[4:]); int(size) != len(b)-8 {
+		t.Errorf("RIFF size %d, want %d", size, len(b)-8)
+	}
+	chunks := map[string][]byte{}
+	for p := 12; p+8 <= len(b); {
+		n := int(binary.LittleEndian.Uint32(b[p+4:]))
+		chunks[string(b[p:p+4])] = b[p+8 : p+8+n]
+		p += 8 + n + n%2
+	}
+	return chunks
+}
+
+func TestSanitizeWebP(t *testing.T) {
+	chunk := func(kind string, data []byte) []byte {
+		b := append([]byte(kind), binary.LittleEndian.AppendUint32(nil, uint32(len(data)))...)
+		b = append(b, data...)
+		if len(data)%2 == 1 {
+			b = append(b, 0)
+		}
+		return b
+	}
+	// The flags announce EXIF and XMP; the canvas is 8x4
+	body := []byte("WEBP")
+	body = append(body, chunk("VP8X", []byte{0x0C, 0, 0, 0, 7, 0, 0, 3, 0, 0})...)
+	body = append(body, chunk("VP8 ", []byte("fake bitstream"))...)
+	body = append(body, chunk("EXIF", testEXIF())...)
+	body = append(body, chunk("XMP ", []byte(testXMP+"!"))...)
+	in := append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...)
+	in = append(in, body...)
+
+	out := sanitize(t, in)
+	chunks := riffChunks(t, out)
+	if _, ok := chunks["XMP "]; ok {
+		t.Error("XMP chunk survived")
+	}
+	if flags := chunks["VP8X"][0]; flags != 0x08 {
+		t.Errorf("VP8X flags = %#x, want EXIF only", flags)
+	}
+	if !bytes.Equal(chunks["VP8 "], []byte("fake bitstream")) {
+		t.Error("image data changed")
+	}
+	checkSanitized(t, chunks["EXIF"])
+
+	// Without anything to keep, there is no EXIF chunk at all
+	in = append([]byte("RIFF\x00\x00\x00\x00WEBP"), chunk("VP8X", []byte{0x08, 0, 0, 0, 7, 0, 0, 3, 0, 0})...)
+	in = append(in, chunk("VP8L", []byte("lossless"))...)
+	in = append(in, chunk("EXIF", []byte("MM\x00\x2A\x00\x00\x00\x08\x00\x00"))...)
+	binary.LittleEndian.PutUint32(in[4:], uint32(len(in)-8))
+	chunks = riffChunks(t, sanitize(t, in))
+	if _, ok := chunks["EXIF"]; ok || chunks["VP8X"][0] != 0 {
+		t.Errorf("empty EXIF kept: flags %#x", chunks["VP8X"][0])
+	}
+}
+
+// box builds an ISOBMFF box.
+func box(kind string, payload ...[]byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, 0)
+	b = append(b, kind...)
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	binary.BigEndian.PutUint32(b, uint32(len(b)))
+	return b
+}
+
+// heifWithMetadata builds a HEIF file whose mdat holds an image item, an
+// EXIF item and an XMP item, in that order.
+func heifWithMetadata(exifItem []byte) (file []byte, imageAt int) {
+	infe := func(id uint16, kind string, extra string) []byte {
+		p := []byte{2, 0, 0, 0, byte(id >> 8), byte(id), 0, 0}
+		p = append(p, kind+"\x00"+extra...)
+		return box("infe", p)
+	}
+	imageData := []byte("image data, left alone")
+	xmp := []byte(testXMP)
+	lengths := []int{len(imageData), len(exifItem), len(xmp)}
+
+	// The offsets don't change the size of anything, so build it twice
+	build := func(mdatAt int) []byte {
+		iloc := []byte{0, 0, 0, 0, 0x44, 0x00, 0, 3}
+		at := mdatAt + 8
+		for i, n := range lengths {
+			iloc = append(iloc, 0, byte(i+1), 0, 0, 0, 1)
+			iloc = binary.BigEndian.AppendUint32(iloc, uint32(at))
+			iloc = binary.BigEndian.AppendUint32(iloc, uint32(n))
+			at += n
+		}
+		meta := box("meta", []byte{0, 0, 0, 0},
+			box("hdlr", []byte{0, 0, 0, 0, 0, 0, 0, 0}, []byte("pict"), make([]byte, 13)),
+			box("iinf", []byte{0, 0, 0, 0, 0, 3},
+				infe(1, "hvc1", ""),
+				infe(2, "Exif", ""),
+				infe(3, "mime", "application/rdf+xml\x00")),
+			box("iloc", iloc))
+		f := append(ftyp("heic", "mif1", "heic"), meta...)
+		return append(f, box("mdat", imageData, exifItem, xmp)...)
+	}
+	first := build(0)
+	mdatAt := len(first) - 8 - len(imageData) - len(exifItem) - len(xmp)
+	return build(mdatAt), mdatAt + 8
+}
+
+func TestSanitizeHEIF(t *testing.T) {
+	exifItem := append([]byte{0, 0, 0, 6}, "Exif\x00\x00"...)
+	exifItem = append(exifItem, testEXIF()...)
+	in, imageAt := heifWithMetadata(exifItem)
+	if meta := ParseMetadata(in); meta.Latitude == nil || meta.CapturedAt == nil {
+		t.Fatalf("test HEIF metadata wasn't read: %+v", meta)
+	}
+
+	out := sanitize(t, in)
+	if len(out) != len(in) {
+		t.Fatalf("sanitized HEIF is %d bytes, want %d", len(out), len(in))
+	}
+	if !bytes.Equal(out[:imageAt+22], in[:imageAt+22]) {
+		t.Error("boxes or image data changed")
+	}
+	checkSanitized(t, out)
+
+	// An EXIF item without room for what is kept is cleared
+	in, imageAt = heifWithMetadata(append([]byte{0, 0, 0, 0}, testEXIF()[:8]...))
+	out = sanitize(t, in)
+	if !bytes.Equal(out[imageAt+22:imageAt+34], make([]byte, 12)) {
+		t.Errorf("short EXIF item = %q, want zeros", out[imageAt+22:imageAt+34])
+	}
+
+	// Metadata can't be rewritten once it has been streamed
+	in, _ = heifWithMetadata(exifItem)
+	mdat := bytes.Index(in, []byte("mdat")) - 4
+	meta := bytes.Index(in, []byte("meta")) - 4
+	moved := append(append(append([]byte{}, in[:meta]...), in[mdat:]...), in[meta:mdat]...)
+	if err := Sanitize(&bytes.Buffer{}, bytes.NewReader(moved)); !errors.Is(err, ErrCannotSanitize) {
+		t.Errorf("Sanitize with mdat first = %v, want ErrCannotSanitize", err)
+	}
+}
+
+func TestSanitizeMovie(t *testing.T) {
+	location := box("\xA9xyz", []byte("+52.5200+013.4050/"))
+	xmp := box("uuid", xmpUUID, []byte(testXMP))
+	trak := box("trak",
+		box("tkhd", make([]byte, 84)),
+		box("udta", box("name", []byte("secret track"))),
+		box("mdia", box("mdhd", make([]byte, 24)), box("minf", box("stbl", []byte("sample tables")))))
+	in := append(ftyp("qt  ", "qt  "), box("wide")...)
+	in = append(in, box("mdat", []byte("video frames"))...)
+	in = append(in, box("moov",
+		box("mvhd", make([]byte, 100)),
+		trak,
+		box("udta", location, box("\xA9mak", []byte("Acme"))),
+		box("meta", box("keys", []byte("com.apple.quicktime.location.ISO6709"))))...)
+	in = append(in, xmp...)
+
+	out := sanitize(t, in)
+	if len(out) != len(in) {
+		t.Fatalf("sanitized movie is %d bytes, want %d", len(out), len(in))
+	}
+	for _, s := range []string{"+52.52", "Acme", "secret", "location", "xmpmeta", "udta"} {
+		if bytes.Contains(out, []byte(s)) {
+			t.Errorf("%q survived", s)
+		}
+	}
+	for _, s := range []string{"video frames", "sample tables", "mvhd", "tkhd"} {
+		if !bytes.Contains(out, []byte(s)) {
+			t.Errorf("%q was dropped", s)
+		}
+	}
+}
+
+func TestSanitizeRefuses(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+	}{
+		{"unknown format", []byte("BM\x36\x00\x00\x00 a bitmap")},
+		{"text", []byte("hello")},
+		{"JPEG cut off in a segment", []byte("\xFF\xD8\xFF\xE1\x00\x40Exif\x00\x00MM")},
+		{"JPEG segment shorter than its length", []byte("\xFF\xD8\xFF\xE0\x00\x01")},
+		{"JPEG without a marker", []byte("\xFF\xD8\x00\x10JFIF")},
+		{"JPEG with no scan", []byte("\xFF\xD8\xFF\xE0\x00\x02")},
+		{"GIF with a bad block", []byte("GIF89a\x01\x00\x01\x00\x00\x00\x00\x99")},
+		{"WebP chunk past the end", []byte("RIFF\x20\x00\x00\x00WEBPVP8 \xFF\x00\x00\x00")},
+		{"box smaller than its header", append(ftyp("isom", "isom"), 0, 0, 0, 4, 'm', 'd', 'a', 't')},
+		{"meta past the end of moov", append(ftyp("isom", "isom"), box("moov", []byte{0, 0, 1, 0, 'm', 'e', 't', 'a'})...)},
+	}
+	for _, tt := range tests {
+		if err := Sanitize(&bytes.Buffer{}, bytes.NewReader(tt.in)); !errors.Is(err, ErrCannotSanitize) {
+			t.Errorf("%s: Sanitize = %v, want ErrCannotSanitize", tt.name, err)
+		}
+	}
+}
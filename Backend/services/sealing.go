@@ -0,0 +1,53 @@
+package services
+
+import (
+	"time"
+
+	"photovault/config"
+	"photovault/models"
+)
+
+// Access is what a request does with a capsule's content.
+type Access int
+
+const (
+	// AccessView reads uploads: listing them, serving them, searching them.
+	AccessView Access = iota
+	// AccessModify changes what a capsule holds or how it is presented.
+	AccessModify
+)
+
+// SealedError is returned for access a buried capsule doesn't allow. It
+// unwraps to ErrStillBuried.
+type SealedError struct {
+	VaultID    uint
+	UnlockDate *time.Time
+}
+
+func (e *SealedError) Error() string {
+	if e.UnlockDate == nil {
+		return "capsule is buried"
+	}
+	return "capsule is buried until " + e.UnlockDate.UTC().Format(time.RFC3339)
+}
+
+func (e *SealedError) Unwrap() error { return ErrStillBuried }
+
+// BuriedViewable reports whether the owner may still look at what a buried
+// capsule holds. It is off unless BURIED_CAPSULE_VIEWING is "allow".
+func BuriedViewable() bool {
+	return config.GetEnv("BURIED_CAPSULE_VIEWING", "block") == "allow"
+}
+
+// CheckAccess is the sealing policy every content endpoint goes through.
+// Buried capsules can't be changed until they unlock, and can't be viewed
+// either unless BuriedViewable.
+func CheckAccess(vault *models.Vault, access Access) error {
+	if !IsBuried(vault) {
+		return nil
+	}
+	if access == AccessView && BuriedViewable() {
+		return nil
+	}
+	return &SealedError{VaultID: vault.ID, UnlockDate: vault.UnlockDate}
+}
@@ -0,0 +1,109 @@
+package services
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"gorm.io/gorm/clause"
+	"photovault/config"
+	"photovault/models"
+)
+
+// MaxDeleteAttempts is how many times an object deletion is tried before it
+// is left for manual cleanup.
+const MaxDeleteAttempts = 10
+
+// DeleteObjects removes stored objects once their rows are permanently gone.
+// Every key is recorded as a PendingDeletion first so a failed or interrupted
+// delete is retried by the storage cleanup job instead of leaking.
+func DeleteObjects(keys ...string) {
+	var pending []models.PendingDeletion
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		pending = append(pending, models.PendingDeletion{
+			Key:           key,
+			NextAttemptAt: time.Now(),
+		})
+	}
+	if len(pending) == 0 {
+		return
+	}
+
+	if err := config.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&pending).Error; err != nil {
+		// Still try to delete, we just lose the retry if this fails
+		log.Printf("Failed to queue object deletions: %v", err)
+	}
+
+	go func() {
+		for i := range pending {
+			deleteObject(&pending[i])
+		}
+	}()
+}
+
+// RetryPendingDeletions retries deletions that are due and have not used up
+// their attempts.
+func RetryPendingDeletions() {
+	var pending []models.PendingDeletion
+	err := config.DB.
+		Where("next_attempt_at <= ?", time.Now()).
+		Where("attempts < ?", MaxDeleteAttempts).
+		Order("next_attempt_at").
+		Limit(500).
+		Find(&pending).Error
+	if err != nil {
+		log.Println("Error fetching pending deletions:", err)
+		return
+	}
+
+	for i := range pending {
+		deleteObject(&pending[i])
+	}
+}
+
+func deleteObject(p *models.PendingDeletion) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if strings.HasPrefix(p.Key, "blobs/") && BlobInUse(p.Key) {
+		config.DB.Where("key = ?", p.Key).Delete(&models.PendingDeletion{})
+		log.Printf("Kept object %s, its content was uploaded again", p.Key)
+		return
+	}
+
+	err := config.Storage.Delete(ctx, p.Key)
+	if err == nil {
+		config.DB.Where("key = ?", p.Key).Delete(&models.PendingDeletion{})
+		log.Printf("Deleted object %s", p.Key)
+		return
+	}
+
+	p.Attempts++
+	p.LastError = err.Error()
+	p.NextAttemptAt = time.Now().Add(deleteBackoff(p.Attempts))
+	config.DB.Model(&models.PendingDeletion{}).Where("key = ?", p.Key).Updates(map[string]interface{}{
+		"attempts":        p.Attempts,
+		"last_error":      p.LastError,
+		"next_attempt_at": p.NextAttemptAt,
+	})
+
+	if p.Attempts >= MaxDeleteAttempts {
+		log.Printf("Giving up deleting object %s after %d attempts: %v", p.Key, p.Attempts, err)
+		return
+	}
+	log.Printf("Failed to delete object %s (attempt %d), retrying at %s: %v", p.Key, p.Attempts, p.NextAttemptAt.Format(time.RFC3339), err)
+}
+
+// deleteBackoff doubles the wait after each failure, from one minute up to
+// six hours.
+func deleteBackoff(attempts int) time.Duration {
+	wait := time.Minute << uint(attempts-1)
+	if wait <= 0 || wait > 6*time.Hour {
+		return 6 * time.Hour
+	}
+	return wait
+}
@@ -0,0 +1,112 @@
+package services
+
+import (
+	"errors"
+	"strings"
+	"time"
+	// Zones resolve the same on hosts without a zoneinfo database
+	_ "time/tzdata"
+
+	"photovault/models"
+)
+
+var (
+	// ErrInvalidTimeZone is returned for a name that isn't an IANA time zone.
+	ErrInvalidTimeZone = errors.New("unknown time zone")
+	// ErrInvalidUnlockTime is returned for an unlock time that is neither a
+	// local date and time nor RFC3339.
+	ErrInvalidUnlockTime = errors.New("invalid unlock time (expected 2006-01-02T15:04, 2006-01-02 or RFC3339)")
+	// ErrUnlockInPast is returned for an unlock time that has already passed.
+	ErrUnlockInPast = errors.New("unlock time is in the past")
+)
+
+// localLayouts are the wall-clock forms an unlock time can be entered in.
+// A date alone means the start of that day.
+var localLayouts = []string{
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// LoadTimeZone resolves an IANA zone name such as "Europe/Berlin". An empty
+// name is UTC.
+func LoadTimeZone(name string) (*time.Location, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return time.UTC, nil
+	}
+	// "Local" is the server's zone, which says nothing about the user's
+	if name == "Local" {
+		return nil, ErrInvalidTimeZone
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, ErrInvalidTimeZone
+	}
+	return loc, nil
+}
+
+// VaultTimeZone is the zone a vault's unlock time is entered and shown in:
+// its own if set, otherwise its owner's. Unknown names fall back to UTC.
+func VaultTimeZone(vault *models.Vault, owner *models.User) *time.Location {
+	name := owner.TimeZone
+	if vault.TimeZone != nil && *vault.TimeZone != "" {
+		name = *vault.TimeZone
+	}
+	loc, err := LoadTimeZone(name)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// ParseUnlockTime reads an unlock time. An RFC3339 time is taken as the
+// instant it names; a local date and time is taken on the wall clock of loc.
+func ParseUnlockTime(s string, loc *time.Location) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range localLayouts {
+		if wall, err := time.Parse(layout, s); err == nil {
+			return LocalTime(wall, loc), nil
+		}
+	}
+	return time.Time{}, ErrInvalidUnlockTime
+}
+
+// LocalTime is the instant the wall clock of loc shows the date and time of
+// wall, whose own zone is ignored. Across DST changes a time that happens
+// twice is the earlier of the two, and a time skipped when clocks go forward
+// moves forward by the gap, so 02:30 on the night clocks jump from 02:00 to
+// 03:00 is 03:30.
+func LocalTime(wall time.Time, loc *time.Location) time.Time {
+	asUTC := time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), wall.Second(), wall.Nanosecond(), time.UTC)
+
+	// The offsets in force around the wall time; transitions are never
+	// closer together than a day
+	_, before := asUTC.Add(-24 * time.Hour).In(loc).Zone()
+	_, after := asUTC.Add(24 * time.Hour).In(loc).Zone()
+
+	var found *time.Time
+	for _, offset := range []int{before, after} {
+		t := asUTC.Add(-time.Duration(offset) * time.Second)
+		if sameWallClock(t.In(loc), asUTC) && (found == nil || t.Before(*found)) {
+			found = &t
+		}
+	}
+	if found != nil {
+		return found.In(loc)
+	}
+	// In the gap: the offset from before it lands the same distance past it
+	return asUTC.Add(-time.Duration(before) * time.Second).In(loc)
+}
+
+func sameWallClock(t, wall time.Time) bool {
+	y1, m1, d1 := t.Date()
+	y2, m2, d2 := wall.Date()
+	return y1 == y2 && m1 == m2 && d1 == d2 &&
+		t.Hour() == wall.Hour() && t.Minute() == wall.Minute() &&
+		t.Second() == wall.Second() && t.Nanosecond() == wall.Nanosecond()
+}
@@ -0,0 +1,115 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLocalTime(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sydney, err := time.LoadLocation("Australia/Sydney")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		wall time.Time
+		loc  *time.Location
+		want string // RFC3339
+	}{
+		{"plain", wall(2026, 6, 1, 12, 0), newYork, "2026-06-01T12:00:00-04:00"},
+		{"winter", wall(2026, 1, 15, 8, 0), newYork, "2026-01-15T08:00:00-05:00"},
+		{"UTC", wall(2026, 3, 8, 2, 30), time.UTC, "2026-03-08T02:30:00Z"},
+		// Clocks go from 02:00 to 03:00
+		{"in the spring-forward gap", wall(2026, 3, 8, 2, 30), newYork, "2026-03-08T03:30:00-04:00"},
+		{"start of the gap", wall(2026, 3, 8, 2, 0), newYork, "2026-03-08T03:00:00-04:00"},
+		{"before the gap", wall(2026, 3, 8, 1, 59), newYork, "2026-03-08T01:59:00-05:00"},
+		{"after the gap", wall(2026, 3, 8, 3, 0), newYork, "2026-03-08T03:00:00-04:00"},
+		// 01:00 to 02:00 happens twice; the first is daylight time
+		{"in the fall-back overlap", wall(2026, 11, 1, 1, 30), newYork, "2026-11-01T01:30:00-04:00"},
+		{"after the overlap", wall(2026, 11, 1, 2, 0), newYork, "2026-11-01T02:00:00-05:00"},
+		{"southern spring forward", wall(2026, 10, 4, 2, 30), sydney, "2026-10-04T03:30:00+11:00"},
+		{"southern fall back", wall(2026, 4, 5, 2, 30), sydney, "2026-04-05T02:30:00+11:00"},
+		{"zone of wall is ignored", time.Date(2026, 6, 1, 12, 0, 0, 0, sydney), newYork, "2026-06-01T12:00:00-04:00"},
+	}
+	for _, tt := range tests {
+		if got := LocalTime(tt.wall, tt.loc).Format(time.RFC3339); got != tt.want {
+			t.Errorf("%s: LocalTime = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func wall(year int, month time.Month, day, hour, min int) time.Time {
+	return time.Date(year, month, day, hour, min, 0, 0, time.UTC)
+}
+
+func TestParseUnlockTime(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		in   string
+		want string // RFC3339, or "" if it is invalid
+	}{
+		{"2027-01-01T09:30", "2027-01-01T09:30:00+01:00"},
+		{"2027-01-01T09:30:15", "2027-01-01T09:30:15+01:00"},
+		{"2027-07-01 09:30", "2027-07-01T09:30:00+02:00"},
+		{" 2027-07-01 ", "2027-07-01T00:00:00+02:00"},
+		{"2027-03-28T02:30", "2027-03-28T03:30:00+02:00"},
+		// RFC3339 names an instant, whatever the zone
+		{"2027-01-01T09:30:00Z", "2027-01-01T09:30:00Z"},
+		{"2027-01-01T09:30:00-08:00", "2027-01-01T09:30:00-08:00"},
+		{"", ""},
+		{"tomorrow", ""},
+		{"01/02/2027", ""},
+		{"2027-02-30", ""},
+	}
+	for _, tt := range tests {
+		got, err := ParseUnlockTime(tt.in, berlin)
+		if tt.want == "" {
+			if !errors.Is(err, ErrInvalidUnlockTime) {
+				t.Errorf("ParseUnlockTime(%q) = %v, %v, want ErrInvalidUnlockTime", tt.in, got, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseUnlockTime(%q) failed: %v", tt.in, err)
+		} else if s := got.Format(time.RFC3339); s != tt.want {
+			t.Errorf("ParseUnlockTime(%q) = %s, want %s", tt.in, s, tt.want)
+		}
+	}
+}
+
+func TestLoadTimeZone(t *testing.T) {
+	tests := []struct {
+		name string
+		want string // the location's name, or "" if it is invalid
+	}{
+		{"", "UTC"},
+		{"Europe/Berlin", "Europe/Berlin"},
+		{" Asia/Tokyo ", "Asia/Tokyo"},
+		{"UTC", "UTC"},
+		{"Local", ""},
+		{"Mars/Olympus_Mons", ""},
+		{"../etc/passwd", ""},
+	}
+	for _, tt := range tests {
+		loc, err := LoadTimeZone(tt.name)
+		if tt.want == "" {
+			if !errors.Is(err, ErrInvalidTimeZone) {
+				t.Errorf("LoadTimeZone(%q) = %v, %v, want ErrInvalidTimeZone", tt.name, loc, err)
+			}
+			continue
+		}
+		if err != nil || loc.String() != tt.want {
+			t.Errorf("LoadTimeZone(%q) = %v, %v, want %s", tt.name, loc, err, tt.want)
+		}
+	}
+}
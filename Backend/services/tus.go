@@ -0,0 +1,44 @@
+package services
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"photovault/config"
+	"photovault/models"
+)
+
+// TusPendingKey holds the tail of a resumable upload that is still too small
+// to be sent as a multipart part.
+func TusPendingKey(id string) string {
+	return "tus/" + id + ".part"
+}
+
+// ExpireTusUploads aborts resumable uploads that passed their expiry and
+// forgets finished ones.
+func ExpireTusUploads() {
+	var expired []models.TusUpload
+	if err := config.DB.Where("expires_at <= ?", time.Now()).Find(&expired).Error; err != nil {
+		log.Println("Error fetching expired resumable uploads:", err)
+		return
+	}
+
+	for _, t := range expired {
+		if t.UploadID == nil && t.Assembled {
+			// Joined but never recorded as an upload
+			DeleteObjects(t.Key)
+		} else if t.UploadID == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			if err := config.Storage.AbortMultipart(ctx, t.Key, t.MultipartID); err != nil {
+				log.Printf("Failed to abort resumable upload %s: %v", t.ID, err)
+				cancel()
+				continue
+			}
+			cancel()
+			DeleteObjects(TusPendingKey(t.ID))
+			log.Printf("Expired resumable upload %s at %d/%d bytes", t.ID, t.Offset, t.Length)
+		}
+		config.DB.Delete(&t)
+	}
+}
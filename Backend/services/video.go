@@ -0,0 +1,298 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"os"
+	"os/exec"
+	"time"
+
+	"photovault/config"
+	"photovault/models"
+	"photovault/storage"
+)
+
+// maxMovieBox bounds how much of a video's moov box is read. It holds the
+// sample tables, which for a few minutes of video are well under this.
+const maxMovieBox = 16 << 20
+
+// maxTopLevelBoxes bounds the walk over a file's top-level boxes, which
+// real files have a handful of.
+const maxTopLevelBoxes = 64
+
+// posterOffset is how far into a video its poster frame is taken, past the
+// black or blurred frames many clips start with.
+const posterOffset = "1"
+
+// ErrNotVideo is returned for files that aren't an MP4 or QuickTime movie
+// with a readable header.
+var ErrNotVideo = errors.New("not a readable MP4 or QuickTime video")
+
+// mp4Epoch is where MP4 and QuickTime start counting time.
+var mp4Epoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// VideoInfo is what the header of a movie says about it.
+type VideoInfo struct {
+	Duration  time.Duration
+	Width     int // as displayed, after the track's rotation
+	Height    int
+	CreatedAt *time.Time
+}
+
+// IsVideoType reports whether contentType is an allowed video type.
+func IsVideoType(contentType string) bool {
+	return IsAllowedType(contentType) && !IsImageType(contentType)
+}
+
+// ProbeVideo reads the duration, size and creation time of a stored MP4 or
+// QuickTime file. Only the box headers and the moov box are fetched, so the
+// media data itself is never downloaded, wherever in the file the moov is.
+func ProbeVideo(ctx context.Context, key string) (*VideoInfo, error) {
+	var offset int64
+	for i := 0; i < maxTopLevelBoxes; i++ {
+		header, err := readRange(ctx, key, offset, 16)
+		if errors.Is(err, storage.ErrInvalidRange) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		size, kind, headerLen, ok := boxHeader(header)
+		if !ok {
+			break
+		}
+		if size == 0 {
+			// The last box runs to the end of the file
+			if kind != "moov" {
+				break
+			}
+			size = maxMovieBox
+		}
+
+		if kind == "moov" {
+			if size > maxMovieBox {
+				return nil, fmt.Errorf("%w: moov box of %d bytes", ErrNotVideo, size)
+			}
+			moov, err := readRange(ctx, key, offset+int64(headerLen), size-int64(headerLen))
+			if err != nil {
+				return nil, err
+			}
+			return parseMovie(moov)
+		}
+		offset += size
+	}
+	return nil, ErrNotVideo
+}
+
+func readRange(ctx context.Context, key string, offset, length int64) ([]byte, error) {
+	spec := fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+	body, _, err := config.Storage.GetRange(ctx, key, storage.GetOptions{Range: spec})
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(io.LimitReader(body, length))
+}
+
+// boxHeader reads the size and type at the start of a box. size is 0 for a
+// box that runs to the end of its parent.
+func boxHeader(b []byte) (size int64, kind string, headerLen int, ok bool) {
+	if len(b) < 8 {
+		return 0, "", 0, false
+	}
+	size = int64(binary.BigEndian.Uint32(b[:4]))
+	kind = string(b[4:8])
+	headerLen = 8
+	if size == 1 {
+		if len(b) < 16 {
+			return 0, "", 0, false
+		}
+		size = int64(binary.BigEndian.Uint64(b[8:16]))
+		headerLen = 16
+	}
+	if size != 0 && size < int64(headerLen) {
+		return 0, "", 0, false
+	}
+	return size, kind, headerLen, true
+}
+
+// childBoxes calls fn with the type and payload of each box in b.
+func childBoxes(b []byte, fn func(kind string, payload []byte)) {
+	for len(b) >= 8 {
+		size, kind, headerLen, ok := boxHeader(b)
+		if !ok {
+			return
+		}
+		if size == 0 || size > int64(len(b)) {
+			size = int64(len(b))
+		}
+		fn(kind, b[headerLen:size])
+		b = b[size:]
+	}
+}
+
+// parseMovie reads the movie header for duration and creation time, and the
+// first track with a picture for the size.
+func parseMovie(moov []byte) (*VideoInfo, error) {
+	info := &VideoInfo{}
+	found := false
+	childBoxes(moov, func(kind string, payload []byte) {
+		switch kind {
+		case "mvhd":
+			found = parseMovieHeader(info, payload)
+		case "trak":
+			if info.Width != 0 {
+				return
+			}
+			childBoxes(payload, func(kind string, payload []byte) {
+				if kind == "tkhd" {
+					info.Width, info.Height = trackSize(payload)
+				}
+			})
+		}
+	})
+	if !found {
+		return nil, fmt.Errorf("%w: no movie header", ErrNotVideo)
+	}
+	return info, nil
+}
+
+func parseMovieHeader(info *VideoInfo, b []byte) bool {
+	if len(b) < 4 {
+		return false
+	}
+	var created uint64
+	var timescale uint32
+	var duration uint64
+	switch b[0] {
+	case 0:
+		if len(b) < 20 {
+			return false
+		}
+		created = uint64(binary.BigEndian.Uint32(b[4:8]))
+		timescale = binary.BigEndian.Uint32(b[12:16])
+		duration = uint64(binary.BigEndian.Uint32(b[16:20]))
+	case 1:
+		if len(b) < 32 {
+			return false
+		}
+		created = binary.BigEndian.Uint64(b[4:12])
+		timescale = binary.BigEndian.Uint32(b[20:24])
+		duration = binary.BigEndian.Uint64(b[24:32])
+	default:
+		return false
+	}
+	if timescale == 0 {
+		return false
+	}
+
+	seconds := duration / uint64(timescale)
+	rest := duration % uint64(timescale)
+	info.Duration = time.Duration(seconds)*time.Second + time.Duration(rest)*time.Second/time.Duration(timescale)
+	if created != 0 {
+		// Zero means the recorder didn't set it
+		t := mp4Epoch.Add(time.Duration(created) * time.Second)
+		info.CreatedAt = &t
+	}
+	return true
+}
+
+// trackSize reads a track's presentation size, swapping it for tracks whose
+// matrix turns them a quarter, as phones do for portrait video. Audio
+// tracks have no size.
+func trackSize(b []byte) (int, int) {
+	if len(b) < 4 {
+		return 0, 0
+	}
+	// Version 1 has 64-bit times and duration
+	matrixAt := 4 + 20 + 8 + 8
+	if b[0] == 1 {
+		matrixAt = 4 + 32 + 8 + 8
+	}
+	if len(b) < matrixAt+36+8 {
+		return 0, 0
+	}
+	matrix := b[matrixAt : matrixAt+36]
+	width := int(binary.BigEndian.Uint32(b[matrixAt+36:]) >> 16)
+	height := int(binary.BigEndian.Uint32(b[matrixAt+40:]) >> 16)
+
+	a := int32(binary.BigEndian.Uint32(matrix[0:4]))
+	d := int32(binary.BigEndian.Uint32(matrix[16:20]))
+	if a == 0 && d == 0 {
+		width, height = height, width
+	}
+	return width, height
+}
+
+// videoMetadata is the metadata row for a video upload.
+func videoMetadata(ctx context.Context, key string) (*models.UploadMetadata, error) {
+	info, err := ProbeVideo(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return &models.UploadMetadata{
+		CapturedAt:  info.CreatedAt,
+		Orientation: 1,
+		Width:       info.Width,
+		Height:      info.Height,
+		DurationMs:  info.Duration.Milliseconds(),
+	}, nil
+}
+
+// posterFrame grabs a frame near the start of a stored video with ffmpeg,
+// which handles every codec phones record in.
+func posterFrame(ctx context.Context, key string) (image.Image, error) {
+	// Clips shorter than the offset have nothing there
+	return ffmpegFrame(ctx, key, posterOffset, "0")
+}
+
+// ffmpegFrame decodes one frame of a stored file with ffmpeg, taken at the
+// first of offsets that has one. The file is copied to a temporary file
+// first because QuickTime files often keep their index at the end, where a
+// pipe can't reach.
+func ffmpegFrame(ctx context.Context, key string, offsets ...string) (image.Image, error) {
+	ffmpeg, err := exec.LookPath(config.GetEnv("FFMPEG_PATH", "ffmpeg"))
+	if err != nil {
+		return nil, fmt.Errorf("%w: ffmpeg is not installed", ErrNotImage)
+	}
+
+	body, _, err := config.Storage.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp("", "frame-*")
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, body)
+	body.Close()
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, offset := range offsets {
+		var out, stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, ffmpeg, "-v", "error", "-ss", offset, "-i", tmp.Name(),
+			"-frames:v", "1", "-f", "image2pipe", "-vcodec", "mjpeg", "-q:v", "2", "-")
+		cmd.Stdout, cmd.Stderr = &out, &stderr
+		if err := cmd.Run(); err != nil {
+			return nil, fmt.Errorf("ffmpeg: %v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+		}
+		if out.Len() > 0 {
+			// ffmpeg applies the track rotation itself
+			return jpeg.Decode(&out)
+		}
+	}
+	return nil, fmt.Errorf("%w: no frame in file", ErrNotImage)
+}
@@ -0,0 +1,454 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LocalStore keeps objects on the local filesystem under root. It is meant for
+// offline development and tests, where no R2 bucket is available.
+//
+// Presigned URLs point back at this server (see handlers.LocalObjectHandler)
+// and are signed with an HMAC of the method, key, expiry, pinned size and any
+// response overrides.
+type LocalStore struct {
+	root    string
+	baseURL string
+	secret  []byte
+}
+
+func NewLocalStore(root, baseURL string, secret []byte) (*LocalStore, error) {
+	if err := os.MkdirAll(root, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &LocalStore{
+		root:    root,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		secret:  secret,
+	}, nil
+}
+
+// path resolves key to a file below root, refusing keys that escape it.
+func (s *LocalStore) path(key string) (string, error) {
+	clean := path.Clean("/" + key)
+	if clean == "/" || strings.HasSuffix(key, "/") {
+		return "", fmt.Errorf("storage: invalid key %q", key)
+	}
+	return filepath.Join(s.root, filepath.FromSlash(clean)), nil
+}
+
+func (s *LocalStore) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+		return err
+	}
+
+	// Write to a temp file first so readers never see a partial object
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	written, err := io.Copy(tmp, body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if size >= 0 && written != size {
+		return fmt.Errorf("storage: wrote %d bytes, expected %d", written, size)
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return err
+	}
+	return writeContentType(p, contentType)
+}
+
+// The content type of an object is kept in a hidden file beside it, which
+// List skips like the temp files. Objects stored without one fall back to a
+// guess from the key's extension.
+func contentTypePath(p string) string {
+	return filepath.Join(filepath.Dir(p), "."+filepath.Base(p)+".content-type")
+}
+
+func writeContentType(p, contentType string) error {
+	if contentType == "" {
+		if err := os.Remove(contentTypePath(p)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	return os.WriteFile(contentTypePath(p), []byte(contentType), 0o644)
+}
+
+func (s *LocalStore) Get(ctx context.Context, key string) (io.ReadCloser, *Object, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, nil, mapLocalError(err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, localObject(key, p, info), nil
+}
+
+// GetRange evaluates the preconditions the way S3 does: If-None-Match wins
+// over If-Modified-Since, and a Range with several parts or bad syntax is
+// ignored in favour of the whole object.
+func (s *LocalStore) GetRange(ctx context.Context, key string, opts GetOptions) (io.ReadCloser, *Object, error) {
+	f, obj, err := s.Get(ctx, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if opts.IfNoneMatch != "" {
+		if etagMatches(opts.IfNoneMatch, obj.ETag) {
+			f.Close()
+			return nil, nil, ErrNotModified
+		}
+	} else if !opts.IfModifiedSince.IsZero() && !obj.LastModified.Truncate(time.Second).After(opts.IfModifiedSince) {
+		f.Close()
+		return nil, nil, ErrNotModified
+	}
+
+	if opts.Range == "" {
+		return f, obj, nil
+	}
+	start, length, err := parseRange(opts.Range, obj.Size)
+	if errors.Is(err, ErrInvalidRange) {
+		f.Close()
+		return nil, nil, err
+	}
+	if err != nil || length == obj.Size {
+		return f, obj, nil
+	}
+	if _, err := f.(io.Seeker).Seek(start, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	obj.ContentRange = fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, obj.Size)
+	obj.Size = length
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(f, length), f}, obj, nil
+}
+
+func (s *LocalStore) Delete(ctx context.Context, key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	// Match S3 semantics: deleting a missing key is not an error
+	if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return writeContentType(p, "")
+}
+
+func (s *LocalStore) Copy(ctx context.Context, srcKey, dstKey, contentType string) error {
+	body, obj, err := s.Get(ctx, srcKey)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	if contentType == "" {
+		// Like CopyObject, keep the source's type unless told otherwise
+		contentType = obj.ContentType
+	}
+	return s.Put(ctx, dstKey, body, obj.Size, contentType)
+}
+
+func (s *LocalStore) Head(ctx context.Context, key string) (*Object, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return nil, mapLocalError(err)
+	}
+	if info.IsDir() {
+		return nil, ErrNotFound
+	}
+	return localObject(key, p, info), nil
+}
+
+func (s *LocalStore) List(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+	err := filepath.WalkDir(s.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && p != s.root {
+			// Temp files and in-progress multipart parts
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, *localObject(key, p, info))
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	return objects, nil
+}
+
+func (s *LocalStore) Presign(ctx context.Context, method, key string, opts PresignOptions) (string, error) {
+	if _, err := s.path(key); err != nil {
+		return "", err
+	}
+	expires := time.Now().Add(opts.TTL).Unix()
+	if method != http.MethodGet {
+		// Response overrides only mean something on a GET
+		opts.ContentType, opts.ContentDisposition = "", ""
+	}
+
+	q := url.Values{}
+	q.Set("method", method)
+	q.Set("expires", strconv.FormatInt(expires, 10))
+	if opts.ContentLength > 0 {
+		q.Set("size", strconv.FormatInt(opts.ContentLength, 10))
+	}
+	if opts.ContentType != "" {
+		q.Set("type", opts.ContentType)
+	}
+	if opts.ContentDisposition != "" {
+		q.Set("disposition", opts.ContentDisposition)
+	}
+	q.Set("sig", s.sign(method, key, expires, opts))
+	return s.baseURL + "/storage/local/" + key + "?" + q.Encode(), nil
+}
+
+// Verify checks a signature produced by Presign. opts holds what the URL
+// carried: the pinned content length (0 if none) and, for a GET, the
+// response overrides.
+func (s *LocalStore) Verify(method, key string, expires int64, opts PresignOptions, sig string) bool {
+	if time.Now().Unix() > expires {
+		return false
+	}
+	return hmac.Equal([]byte(sig), []byte(s.sign(method, key, expires, opts)))
+}
+
+func (s *LocalStore) sign(method, key string, expires int64, opts PresignOptions) string {
+	mac := hmac.New(sha256.New, s.secret)
+	fmt.Fprintf(mac, "%s\n%s\n%d\n%d\n%s\n%s", method, key, expires, opts.ContentLength, opts.ContentType, opts.ContentDisposition)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Multipart parts are kept under root/.multipart/<uploadID>/ until the
+// upload is completed or aborted.
+func (s *LocalStore) multipartDir(uploadID string) (string, error) {
+	if uploadID == "" || strings.ContainsAny(uploadID, `/\.`) {
+		return "", fmt.Errorf("storage: invalid upload id %q", uploadID)
+	}
+	return filepath.Join(s.root, ".multipart", uploadID), nil
+}
+
+func (s *LocalStore) CreateMultipart(ctx context.Context, key, contentType string) (string, error) {
+	if _, err := s.path(key); err != nil {
+		return "", err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	uploadID := hex.EncodeToString(id)
+	dir, _ := s.multipartDir(uploadID)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", err
+	}
+	// Parts are numbered files, so this can't clash with one
+	if err := os.WriteFile(filepath.Join(dir, "content-type"), []byte(contentType), 0o644); err != nil {
+		return "", err
+	}
+	return uploadID, nil
+}
+
+func (s *LocalStore) UploadPart(ctx context.Context, key, uploadID string, number int32, body io.Reader, size int64) (Part, error) {
+	dir, err := s.multipartDir(uploadID)
+	if err != nil {
+		return Part{}, err
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return Part{}, mapLocalError(err)
+	}
+
+	f, err := os.Create(filepath.Join(dir, fmt.Sprintf("%05d", number)))
+	if err != nil {
+		return Part{}, err
+	}
+	h := md5.New()
+	written, err := io.Copy(io.MultiWriter(f, h), body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return Part{}, err
+	}
+	if written != size {
+		return Part{}, fmt.Errorf("storage: wrote %d bytes, expected %d", written, size)
+	}
+	return Part{Number: number, ETag: "\"" + hex.EncodeToString(h.Sum(nil)) + "\"", Size: size}, nil
+}
+
+func (s *LocalStore) CompleteMultipart(ctx context.Context, key, uploadID string, parts []Part) error {
+	dir, err := s.multipartDir(uploadID)
+	if err != nil {
+		return err
+	}
+
+	readers := make([]io.Reader, 0, len(parts))
+	var size int64
+	for _, p := range parts {
+		f, err := os.Open(filepath.Join(dir, fmt.Sprintf("%05d", p.Number)))
+		if err != nil {
+			return mapLocalError(err)
+		}
+		defer f.Close()
+		readers = append(readers, f)
+		size += p.Size
+	}
+
+	contentType, err := os.ReadFile(filepath.Join(dir, "content-type"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := s.Put(ctx, key, io.MultiReader(readers...), size, string(contentType)); err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+func (s *LocalStore) AbortMultipart(ctx context.Context, key, uploadID string) error {
+	dir, err := s.multipartDir(uploadID)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+func localObject(key, p string, info fs.FileInfo) *Object {
+	contentType := mime.TypeByExtension(path.Ext(key))
+	if stored, err := os.ReadFile(contentTypePath(p)); err == nil {
+		contentType = string(stored)
+	}
+	return &Object{
+		Key:          key,
+		Size:         info.Size(),
+		ContentType:  contentType,
+		ETag:         fmt.Sprintf("\"%x-%x\"", info.ModTime().UnixNano(), info.Size()),
+		LastModified: info.ModTime(),
+	}
+}
+
+func mapLocalError(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// etagMatches implements the weak comparison used by If-None-Match.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRange resolves a single "bytes=" range against an object of the given
+// size. Anything it can't serve as one range is reported as a plain error so
+// the caller can fall back to the whole object.
+func parseRange(spec string, size int64) (start, length int64, err error) {
+	spec, ok := strings.CutPrefix(spec, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, fmt.Errorf("unsupported range %q", spec)
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid range %q", spec)
+	}
+
+	if first == "" {
+		// Suffix range: the last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("invalid range %q", spec)
+		}
+		if n == 0 {
+			return 0, 0, ErrInvalidRange
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, nil
+	}
+
+	start, err = strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, fmt.Errorf("invalid range %q", spec)
+	}
+	if start >= size {
+		return 0, 0, ErrInvalidRange
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, fmt.Errorf("invalid range %q", spec)
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end - start + 1, nil
+}
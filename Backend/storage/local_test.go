@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		spec          string
+		size          int64
+		start, length int64
+		err           error // nil, ErrInvalidRange, or errFallback for a plain error
+	}{
+		{"bytes=0-99", 1000, 0, 100, nil},
+		{"bytes=100-", 1000, 100, 900, nil},
+		{"bytes=-100", 1000, 900, 100, nil},
+		{"bytes= 5-9", 1000, 5, 5, nil},
+		// Ends past the object are cut to its size
+		{"bytes=900-2000", 1000, 900, 100, nil},
+		{"bytes=-5000", 1000, 0, 1000, nil},
+		// Out of bounds
+		{"bytes=1000-", 1000, 0, 0, ErrInvalidRange},
+		{"bytes=5000-6000", 1000, 0, 0, ErrInvalidRange},
+		{"bytes=-0", 1000, 0, 0, ErrInvalidRange},
+		{"bytes=0-", 0, 0, 0, ErrInvalidRange},
+		// Served as the whole object
+		{"bytes=0-99,200-299", 1000, 0, 0, errFallback},
+		{"bytes=0-0, -1", 1000, 0, 0, errFallback},
+		{"bytes=99-0", 1000, 0, 0, errFallback},
+		{"bytes=abc-", 1000, 0, 0, errFallback},
+		{"bytes=-1-2", 1000, 0, 0, errFallback},
+		{"bytes=100", 1000, 0, 0, errFallback},
+		{"items=0-99", 1000, 0, 0, errFallback},
+		{"", 1000, 0, 0, errFallback},
+	}
+	for _, tt := range tests {
+		start, length, err := parseRange(tt.spec, tt.size)
+		switch {
+		case tt.err == nil && err != nil:
+			t.Errorf("parseRange(%q, %d) failed: %v", tt.spec, tt.size, err)
+		case tt.err == ErrInvalidRange && !errors.Is(err, ErrInvalidRange):
+			t.Errorf("parseRange(%q, %d) = %v, want ErrInvalidRange", tt.spec, tt.size, err)
+		case tt.err == errFallback && (err == nil || errors.Is(err, ErrInvalidRange)):
+			t.Errorf("parseRange(%q, %d) = %v, want a plain error", tt.spec, tt.size, err)
+		case tt.err == nil && (start != tt.start || length != tt.length):
+			t.Errorf("parseRange(%q, %d) = %d, %d, want %d, %d", tt.spec, tt.size, start, length, tt.start, tt.length)
+		}
+	}
+}
+
+// errFallback stands for any error other than ErrInvalidRange.
+var errFallback = errors.New("fallback")
+
+func TestLocalStoreContentType(t *testing.T) {
+	ctx := context.Background()
+	s, err := NewLocalStore(t.TempDir(), "http://localhost", []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(key, contentType string) {
+		t.Helper()
+		if err := s.Put(ctx, key, strings.NewReader("data"), 4, contentType); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(key, want string) {
+		t.Helper()
+		obj, err := s.Head(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if obj.ContentType != want {
+			t.Errorf("Head(%s).ContentType = %q, want %q", key, obj.ContentType, want)
+		}
+		body, obj, err := s.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body.Close()
+		if obj.ContentType != want {
+			t.Errorf("Get(%s).ContentType = %q, want %q", key, obj.ContentType, want)
+		}
+	}
+
+	// Keys have no extension once uploads share blobs
+	put("blobs/ab/photo", "image/heic")
+	check("blobs/ab/photo", "image/heic")
+	put("blobs/ab/photo", "image/jpeg")
+	check("blobs/ab/photo", "image/jpeg")
+	put("vaults/1/uploads/a.png", "")
+	check("vaults/1/uploads/a.png", "image/png")
+
+	if err := s.Copy(ctx, "blobs/ab/photo", "blobs/cd/copy", ""); err != nil {
+		t.Fatal(err)
+	}
+	check("blobs/cd/copy", "image/jpeg")
+	if err := s.Copy(ctx, "blobs/ab/photo", "blobs/cd/display", "image/webp"); err != nil {
+		t.Fatal(err)
+	}
+	check("blobs/cd/display", "image/webp")
+
+	uploadID, err := s.CreateMultipart(ctx, "blobs/ef/video", "video/mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part, err := s.UploadPart(ctx, "blobs/ef/video", uploadID, 1, strings.NewReader("data"), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CompleteMultipart(ctx, "blobs/ef/video", uploadID, []Part{part}); err != nil {
+		t.Fatal(err)
+	}
+	check("blobs/ef/video", "video/mp4")
+
+	objects, err := s.List(ctx, "blobs/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 4 {
+		t.Errorf("List returned %d objects, want 4: %v", len(objects), objects)
+	}
+	for _, obj := range objects {
+		if obj.ContentType == "" {
+			t.Errorf("List(%s).ContentType is empty", obj.Key)
+		}
+	}
+
+	// A new object under a deleted key doesn't inherit its type
+	if err := s.Delete(ctx, "blobs/ab/photo"); err != nil {
+		t.Fatal(err)
+	}
+	put("blobs/ab/photo", "")
+	check("blobs/ab/photo", "")
+}
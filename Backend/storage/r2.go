@@ -0,0 +1,336 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// R2Store keeps objects in a Cloudflare R2 (or any S3 compatible) bucket.
+type R2Store struct {
+	client  *s3.Client
+	presign *s3.PresignClient
+	bucket  string
+}
+
+func NewR2Store(client *s3.Client, bucket string) *R2Store {
+	return &R2Store{
+		client:  client,
+		presign: s3.NewPresignClient(client),
+		bucket:  bucket,
+	}
+}
+
+// Put streams body to the bucket. A body that fits in one part goes out as a
+// single PutObject; anything larger becomes a multipart upload, so only one
+// part is held in memory at a time whatever the object size.
+func (s *R2Store) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	buf := partBuffers.Get().(*[]byte)
+	defer partBuffers.Put(buf)
+
+	n, err := io.ReadFull(body, *buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		if size >= 0 && int64(n) != size {
+			return fmt.Errorf("storage: read %d bytes, expected %d", n, size)
+		}
+		input := &s3.PutObjectInput{
+			Bucket:        aws.String(s.bucket),
+			Key:           aws.String(key),
+			Body:          bytes.NewReader((*buf)[:n]),
+			ContentLength: aws.Int64(int64(n)),
+		}
+		if contentType != "" {
+			input.ContentType = aws.String(contentType)
+		}
+		_, err := s.client.PutObject(ctx, input)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	uploadID, err := s.CreateMultipart(ctx, key, contentType)
+	if err != nil {
+		return err
+	}
+	parts, err := s.putParts(ctx, key, uploadID, body, *buf)
+	if err == nil && size >= 0 && partsSize(parts) != size {
+		err = fmt.Errorf("storage: read %d bytes, expected %d", partsSize(parts), size)
+	}
+	if err == nil {
+		err = s.CompleteMultipart(ctx, key, uploadID, parts)
+	}
+	if err != nil {
+		s.AbortMultipart(context.WithoutCancel(ctx), key, uploadID)
+		return err
+	}
+	return nil
+}
+
+// putParts uploads buf, which is already full, and then the rest of body one
+// part at a time.
+func (s *R2Store) putParts(ctx context.Context, key, uploadID string, body io.Reader, buf []byte) ([]Part, error) {
+	var parts []Part
+	n := len(buf)
+	for {
+		part, err := s.UploadPart(ctx, key, uploadID, int32(len(parts)+1), bytes.NewReader(buf[:n]), int64(n))
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, part)
+
+		var readErr error
+		n, readErr = io.ReadFull(body, buf)
+		if readErr == io.EOF {
+			return parts, nil
+		}
+		if readErr != nil && readErr != io.ErrUnexpectedEOF {
+			return nil, readErr
+		}
+	}
+}
+
+func (s *R2Store) Get(ctx context.Context, key string) (io.ReadCloser, *Object, error) {
+	resp, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, nil, mapR2Error(err)
+	}
+	obj := &Object{
+		Key:          key,
+		Size:         aws.ToInt64(resp.ContentLength),
+		ContentType:  aws.ToString(resp.ContentType),
+		ETag:         aws.ToString(resp.ETag),
+		LastModified: aws.ToTime(resp.LastModified),
+	}
+	return resp.Body, obj, nil
+}
+
+func (s *R2Store) GetRange(ctx context.Context, key string, opts GetOptions) (io.ReadCloser, *Object, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}
+	if opts.Range != "" {
+		input.Range = aws.String(opts.Range)
+	}
+	if opts.IfNoneMatch != "" {
+		input.IfNoneMatch = aws.String(opts.IfNoneMatch)
+	}
+	if !opts.IfModifiedSince.IsZero() {
+		input.IfModifiedSince = aws.Time(opts.IfModifiedSince)
+	}
+	resp, err := s.client.GetObject(ctx, input)
+	if err != nil {
+		return nil, nil, mapR2Error(err)
+	}
+	obj := &Object{
+		Key:          key,
+		Size:         aws.ToInt64(resp.ContentLength),
+		ContentType:  aws.ToString(resp.ContentType),
+		ETag:         aws.ToString(resp.ETag),
+		LastModified: aws.ToTime(resp.LastModified),
+		ContentRange: aws.ToString(resp.ContentRange),
+	}
+	return resp.Body, obj, nil
+}
+
+func (s *R2Store) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	return mapR2Error(err)
+}
+
+func (s *R2Store) Copy(ctx context.Context, srcKey, dstKey, contentType string) error {
+	input := &s3.CopyObjectInput{
+		Bucket:     aws.String(s.bucket),
+		Key:        aws.String(dstKey),
+		CopySource: aws.String(url.PathEscape(s.bucket + "/" + srcKey)),
+	}
+	if contentType != "" {
+		input.ContentType = aws.String(contentType)
+		input.MetadataDirective = types.MetadataDirectiveReplace
+	}
+	_, err := s.client.CopyObject(ctx, input)
+	return mapR2Error(err)
+}
+
+func (s *R2Store) Head(ctx context.Context, key string) (*Object, error) {
+	resp, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, mapR2Error(err)
+	}
+	return &Object{
+		Key:          key,
+		Size:         aws.ToInt64(resp.ContentLength),
+		ContentType:  aws.ToString(resp.ContentType),
+		ETag:         aws.ToString(resp.ETag),
+		LastModified: aws.ToTime(resp.LastModified),
+	}, nil
+}
+
+func (s *R2Store) List(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range page.Contents {
+			objects = append(objects, Object{
+				Key:          aws.ToString(o.Key),
+				Size:         aws.ToInt64(o.Size),
+				ETag:         aws.ToString(o.ETag),
+				LastModified: aws.ToTime(o.LastModified),
+			})
+		}
+	}
+	return objects, nil
+}
+
+func (s *R2Store) Presign(ctx context.Context, method, key string, opts PresignOptions) (string, error) {
+	expires := func(o *s3.PresignOptions) { o.Expires = opts.TTL }
+
+	switch method {
+	case http.MethodGet:
+		input := &s3.GetObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+		}
+		if opts.ContentType != "" {
+			input.ResponseContentType = aws.String(opts.ContentType)
+		}
+		if opts.ContentDisposition != "" {
+			input.ResponseContentDisposition = aws.String(opts.ContentDisposition)
+		}
+		req, err := s.presign.PresignGetObject(ctx, input, expires)
+		if err != nil {
+			return "", err
+		}
+		return req.URL, nil
+	case http.MethodPut:
+		input := &s3.PutObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+		}
+		if opts.ContentLength > 0 {
+			input.ContentLength = aws.Int64(opts.ContentLength)
+		}
+		if opts.ContentType != "" {
+			input.ContentType = aws.String(opts.ContentType)
+		}
+		req, err := s.presign.PresignPutObject(ctx, input, expires)
+		if err != nil {
+			return "", err
+		}
+		return req.URL, nil
+	}
+	return "", errors.New("storage: unsupported presign method " + method)
+}
+
+func (s *R2Store) CreateMultipart(ctx context.Context, key, contentType string) (string, error) {
+	input := &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	}
+	if contentType != "" {
+		input.ContentType = aws.String(contentType)
+	}
+	resp, err := s.client.CreateMultipartUpload(ctx, input)
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(resp.UploadId), nil
+}
+
+func (s *R2Store) UploadPart(ctx context.Context, key, uploadID string, number int32, body io.Reader, size int64) (Part, error) {
+	resp, err := s.client.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:        aws.String(s.bucket),
+		Key:           aws.String(key),
+		UploadId:      aws.String(uploadID),
+		PartNumber:    aws.Int32(number),
+		Body:          body,
+		ContentLength: aws.Int64(size),
+	})
+	if err != nil {
+		return Part{}, err
+	}
+	return Part{Number: number, ETag: aws.ToString(resp.ETag), Size: size}, nil
+}
+
+func (s *R2Store) CompleteMultipart(ctx context.Context, key, uploadID string, parts []Part) error {
+	completed := make([]types.CompletedPart, 0, len(parts))
+	for _, p := range parts {
+		completed = append(completed, types.CompletedPart{
+			ETag:       aws.String(p.ETag),
+			PartNumber: aws.Int32(p.Number),
+		})
+	}
+	_, err := s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.bucket),
+		Key:             aws.String(key),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completed},
+	})
+	return err
+}
+
+func (s *R2Store) AbortMultipart(ctx context.Context, key, uploadID string) error {
+	_, err := s.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	})
+	var noSuchUpload *types.NoSuchUpload
+	if errors.As(err, &noSuchUpload) {
+		return nil
+	}
+	return err
+}
+
+// mapR2Error turns the SDK's "missing object" errors into ErrNotFound.
+func mapR2Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	var noSuchKey *types.NoSuchKey
+	var notFound *types.NotFound
+	if errors.As(err, &noSuchKey) || errors.As(err, &notFound) {
+		return ErrNotFound
+	}
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && (apiErr.ErrorCode() == "NoSuchKey" || apiErr.ErrorCode() == "NotFound") {
+		return ErrNotFound
+	}
+	// Failed preconditions come back as bare status codes
+	var respErr interface{ HTTPStatusCode() int }
+	if errors.As(err, &respErr) {
+		switch respErr.HTTPStatusCode() {
+		case http.StatusNotModified:
+			return ErrNotModified
+		case http.StatusRequestedRangeNotSatisfiable:
+			return ErrInvalidRange
+		}
+	}
+	return err
+}
@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrNotFound is returned when the requested key does not exist in the store.
+var ErrNotFound = errors.New("storage: object not found")
+
+// ErrNotModified is returned by GetRange when a conditional read matched the
+// client's copy.
+var ErrNotModified = errors.New("storage: object not modified")
+
+// ErrInvalidRange is returned by GetRange when the requested range starts
+// past the end of the object.
+var ErrInvalidRange = errors.New("storage: range not satisfiable")
+
+// Object describes a stored blob without its contents.
+type Object struct {
+	Key          string
+	Size         int64
+	ContentType  string
+	ETag         string
+	LastModified time.Time
+	// ContentRange is set when only part of the object was read, in the
+	// form of the Content-Range header ("bytes 0-99/1234"). Size is then the
+	// length of that part.
+	ContentRange string
+}
+
+// Store is the blob storage used for uploads and cover images.
+// Keys are slash separated, e.g. "vaults/12/uploads/34_photo.jpg".
+type Store interface {
+	Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error
+	Get(ctx context.Context, key string) (io.ReadCloser, *Object, error)
+	GetRange(ctx context.Context, key string, opts GetOptions) (io.ReadCloser, *Object, error)
+	Delete(ctx context.Context, key string) error
+	// Copy duplicates an object, replacing its content type when one is given.
+	Copy(ctx context.Context, srcKey, dstKey, contentType string) error
+	Head(ctx context.Context, key string) (*Object, error)
+	List(ctx context.Context, prefix string) ([]Object, error)
+	Presign(ctx context.Context, method, key string, opts PresignOptions) (string, error)
+
+	// Multipart uploads assemble one object from parts sent separately.
+	// Every part but the last must be at least MinPartSize bytes.
+	CreateMultipart(ctx context.Context, key, contentType string) (string, error)
+	UploadPart(ctx context.Context, key, uploadID string, number int32, body io.Reader, size int64) (Part, error)
+	CompleteMultipart(ctx context.Context, key, uploadID string, parts []Part) error
+	AbortMultipart(ctx context.Context, key, uploadID string) error
+}
+
+// MinPartSize is the smallest part S3 accepts for anything but the last part.
+const MinPartSize = 5 << 20
+
+// Part is one uploaded piece of a multipart upload.
+type Part struct {
+	Number int32  `json:"number"`
+	ETag   string `json:"etag"`
+	Size   int64  `json:"size"`
+}
+
+// PresignOptions controls what a presigned URL allows.
+type PresignOptions struct {
+	TTL time.Duration
+	// ContentLength pins the size of a presigned PUT; 0 leaves it open.
+	ContentLength int64
+	// ContentType is the type a PUT must send, or for a GET the type the
+	// response is served with.
+	ContentType string
+	// ContentDisposition overrides the header on a presigned GET's response.
+	ContentDisposition string
+}
+
+// GetOptions are the HTTP read preconditions passed through to the backend.
+type GetOptions struct {
+	// Range is a Range header value such as "bytes=0-1023"; empty reads the
+	// whole object.
+	Range           string
+	IfNoneMatch     string
+	IfModifiedSince time.Time
+}
@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"sync"
+)
+
+// ErrTooLarge is returned by PutHashed when the body goes over its limit.
+var ErrTooLarge = errors.New("storage: object exceeds size limit")
+
+// partBuffers recycles part-sized buffers so streaming uploads keep a flat
+// memory profile no matter how many files pass through.
+var partBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, MinPartSize)
+		return &buf
+	},
+}
+
+func partsSize(parts []Part) int64 {
+	var size int64
+	for _, p := range parts {
+		size += p.Size
+	}
+	return size
+}
+
+// PutHashed streams body into the store under key while computing its size
+// and SHA-256. It fails with ErrTooLarge, leaving nothing stored, once more
+// than limit bytes have been read; a negative limit means no limit.
+func PutHashed(ctx context.Context, store Store, key string, body io.Reader, limit int64, contentType string) (int64, string, error) {
+	hr := &hashingReader{r: body, h: sha256.New(), limit: limit}
+	if err := store.Put(ctx, key, hr, -1, contentType); err != nil {
+		if hr.tooLarge {
+			return hr.n, "", ErrTooLarge
+		}
+		return hr.n, "", err
+	}
+	return hr.n, hex.EncodeToString(hr.h.Sum(nil)), nil
+}
+
+type hashingReader struct {
+	r        io.Reader
+	h        hash.Hash
+	n        int64
+	limit    int64
+	tooLarge bool
+}
+
+func (hr *hashingReader) Read(p []byte) (int, error) {
+	n, err := hr.r.Read(p)
+	hr.h.Write(p[:n])
+	hr.n += int64(n)
+	if hr.limit >= 0 && hr.n > hr.limit {
+		hr.tooLarge = true
+		return n, ErrTooLarge
+	}
+	return n, err
+}
+
+// HashObject reads a stored object back and returns its SHA-256. It is used
+// for objects that were written without passing through PutHashed, such as
+// presigned and resumable uploads.
+func HashObject(ctx context.Context, store Store, key string) (string, error) {
+	body, _, err := store.Get(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
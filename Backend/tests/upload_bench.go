@@ -0,0 +1,188 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"photovault/storage"
+)
+
+// formBody streams the files as a multipart form the way a browser would send
+// them, without holding the whole form in memory.
+func formBody(files []string) (io.Reader, string) {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+
+	go func() {
+		for _, path := range files {
+			f, err := os.Open(path)
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			part, err := mw.CreateFormFile("images", filepath.Base(path))
+			if err == nil {
+				_, err = io.Copy(part, f)
+			}
+			f.Close()
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.CloseWithError(mw.Close())
+	}()
+
+	return pr, mw.Boundary()
+}
+
+// bufferedUpload is the old UploadHandler path: parse the whole form, then
+// copy every file into a bytes.Buffer in its own goroutine.
+func bufferedUpload(store storage.Store, body io.Reader, boundary string) error {
+	form, err := multipart.NewReader(body, boundary).ReadForm(50 << 20)
+	if err != nil {
+		return err
+	}
+	defer form.RemoveAll()
+
+	files := form.File["images"]
+	var wg sync.WaitGroup
+	errCh := make(chan error, len(files))
+	for i, h := range files {
+		wg.Add(1)
+		go func(i int, h *multipart.FileHeader) {
+			defer wg.Done()
+			file, err := h.Open()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			defer file.Close()
+
+			buf := new(bytes.Buffer)
+			if _, err := io.Copy(buf, file); err != nil {
+				errCh <- err
+				return
+			}
+			key := fmt.Sprintf("bench/buffered/%d_%s", i, h.Filename)
+			errCh <- store.Put(context.TODO(), key, bytes.NewReader(buf.Bytes()), int64(buf.Len()), "")
+		}(i, h)
+	}
+	wg.Wait()
+	close(errCh)
+
+	for err := range errCh {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// streamingUpload is the current UploadHandler path: read the form part by
+// part and stream each file into storage while hashing it.
+func streamingUpload(store storage.Store, body io.Reader, boundary string) error {
+	reader := multipart.NewReader(body, boundary)
+	for i := 0; ; i++ {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		key := fmt.Sprintf("bench/streaming/%d_%s", i, part.FileName())
+		_, _, err = storage.PutHashed(context.TODO(), store, key, part, -1, "")
+		part.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// peakHeap samples the heap while fn runs and returns the highest value seen.
+func peakHeap(fn func()) uint64 {
+	runtime.GC()
+	var peak uint64
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var m runtime.MemStats
+		for {
+			runtime.ReadMemStats(&m)
+			if m.HeapInuse > peak {
+				peak = m.HeapInuse
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(2 * time.Millisecond):
+			}
+		}
+	}()
+	fn()
+	close(done)
+	wg.Wait()
+	return peak
+}
+
+// RunUploadBenchmark compares the buffered and streaming upload paths on the
+// files in ./test_uploads, writing to local storage so no bucket or database
+// is needed.
+func RunUploadBenchmark() error {
+	files := []string{}
+	for i := 503; i <= 649; i++ {
+		files = append(files, fmt.Sprintf("./test_uploads/image_%d.png", i))
+	}
+
+	dir, err := os.MkdirTemp("", "upload-bench-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	store, err := storage.NewLocalStore(dir, "", nil)
+	if err != nil {
+		return err
+	}
+
+	paths := []struct {
+		name string
+		fn   func(storage.Store, io.Reader, string) error
+	}{
+		{"buffered", bufferedUpload},
+		{"streaming", streamingUpload},
+	}
+
+	for _, p := range paths {
+		var runErr error
+		var result testing.BenchmarkResult
+		peak := peakHeap(func() {
+			result = testing.Benchmark(func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					body, boundary := formBody(files)
+					if err := p.fn(store, body, boundary); err != nil {
+						runErr = err
+						b.FailNow()
+					}
+				}
+			})
+		})
+		if runErr != nil {
+			return fmt.Errorf("%s upload: %w", p.name, runErr)
+		}
+		fmt.Printf("%-10s %s %s  peak heap %.1f MB\n", p.name, result.String(), result.MemString(), float64(peak)/(1<<20))
+	}
+	return nil
+}
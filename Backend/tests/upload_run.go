@@ -13,7 +13,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/google/uuid"
 	"gorm.io/gorm"
 
@@ -67,12 +66,8 @@ func uploadFile(user *models.User, vault *models.Vault, filePath string) error {
 	}
 	file.Close()
 
-	// Upload to R2 with the precomputed key
-	_, err = config.R2Client.PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket: &config.R2Bucket,
-		Key:    &upload.Key,
-		Body:   bytes.NewReader(buf.Bytes()),
-	})
+	// Upload to storage with the precomputed key
+	err = config.Storage.Put(context.TODO(), upload.Key, bytes.NewReader(buf.Bytes()), int64(buf.Len()), "")
 	if err != nil {
 		// Rollback the DB row if upload fails
 		config.DB.Delete(&upload)
@@ -1,5 +1,7 @@
 package utils
 
+import "time"
+
 // PlanLimits maps plan names to their limits
 var PlanLimits = map[string]struct{
     MaxStorage int64 // in bytes
@@ -7,4 +9,15 @@ var PlanLimits = map[string]struct{
 }{
     "free": {MaxStorage: 50 * 1024 * 1024, MaxVaults: 3}, // 50 MB
     "pro":  {MaxStorage: 10 * 1024 * 1024 * 1024, MaxVaults: 50}, // 10 GB
-}
\ No newline at end of file
+}
+// VideoLimit bounds each video a plan may upload
+type VideoLimit struct {
+    MaxDuration time.Duration
+    MaxSize     int64 // in bytes
+}
+
+// VideoLimits maps plan names to their per-video limits, on top of PlanLimits
+var VideoLimits = map[string]VideoLimit{
+    "free": {MaxDuration: 30 * time.Second, MaxSize: 25 * 1024 * 1024}, // 25 MB
+    "pro":  {MaxDuration: 10 * time.Minute, MaxSize: 2 * 1024 * 1024 * 1024}, // 2 GB
+}
@@ -459,7 +459,7 @@ export default function CapsulesPage() {
     {
       id: "opened",
       label: "📤 Opened",
-      filterFn: (capsule) => capsule.Status === "open",
+      filterFn: (capsule) => capsule.Status === "unlocked",
     },
     {
       id: "buried",